@@ -0,0 +1,82 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FrpcSpec describes the pool of frp clients serving an IngressClass. The pool reaches the frp clients through their
+// admin api, the embedded and Secret deliveries are only available to the pools the manager starts with.
+type FrpcSpec struct {
+	// Addr is resolved to the addresses of the frp clients, e.g. a headless service
+	Addr string `json:"addr"`
+	// Port is the port of the frp client admin api
+	// +kubebuilder:default=7400
+	// +optional
+	Port int32 `json:"port,omitempty"`
+	// ConfigFormat is the config format served by the frp client admin api
+	// +kubebuilder:validation:Enum=auto;ini;toml;yaml;json
+	// +optional
+	ConfigFormat string `json:"configFormat,omitempty"`
+	// AdminSecretRef references a Secret holding the username and password, or the bearer token, of the frp client
+	// admin api
+	// +optional
+	AdminSecretRef *corev1.SecretReference `json:"adminSecretRef,omitempty"`
+	// Common are keys of the [common] section written to the config of every frp client, e.g. server_addr
+	// +optional
+	Common map[string]string `json:"common,omitempty"`
+	// CommonSecretRef references a Secret whose keys are merged over Common, e.g. token
+	// +optional
+	CommonSecretRef *corev1.SecretReference `json:"commonSecretRef,omitempty"`
+}
+
+// FrpIngressClassParametersSpec defines the frp settings of the IngressClasses referencing it
+type FrpIngressClassParametersSpec struct {
+	Frpc FrpcSpec `json:"frpc"`
+	// DefaultAnnotations are used for the annotations an Ingress of the class does not set
+	// +optional
+	DefaultAnnotations map[string]string `json:"defaultAnnotations,omitempty"`
+	// FrpsAddress is the public address of the frp server, published in the load balancer status of the ingresses
+	// +optional
+	FrpsAddress string `json:"frpsAddress,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// FrpIngressClassParameters is the Schema for the frpingressclassparameters API
+type FrpIngressClassParameters struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec FrpIngressClassParametersSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// FrpIngressClassParametersList contains a list of FrpIngressClassParameters
+type FrpIngressClassParametersList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FrpIngressClassParameters `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&FrpIngressClassParameters{}, &FrpIngressClassParametersList{})
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// FrpProxyBackend references the Service port a proxy forwards to
+type FrpProxyBackend struct {
+	// ServiceName is the name of the Service, in the namespace of the FrpProxy
+	ServiceName string `json:"serviceName"`
+	// ServicePort is the name or number of the Service port
+	ServicePort intstr.IntOrString `json:"servicePort"`
+}
+
+// FrpProxyPlugin is a frp client plugin serving the proxy instead of a backend
+type FrpProxyPlugin struct {
+	// Name is the plugin, e.g. socks5, static_file, unix_domain_socket or http_proxy
+	Name string `json:"name"`
+	// Options are the plugin options without the plugin_ prefix, e.g. local_path for static_file
+	// +optional
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// FrpProxySpec mirrors the options of a frp proxy
+type FrpProxySpec struct {
+	// IngressClassName selects the pool of frp clients, the default IngressClass if unset
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+	// Type is the frp proxy type
+	// +kubebuilder:validation:Enum=tcp;udp;http;https;stcp;xtcp;sudp;tcpmux
+	Type string `json:"type"`
+	// Backend is the Service the proxy forwards to, exclusive with Plugin
+	// +optional
+	Backend *FrpProxyBackend `json:"backend,omitempty"`
+	// Plugin serves the proxy from the frp client, exclusive with Backend
+	// +optional
+	Plugin *FrpProxyPlugin `json:"plugin,omitempty"`
+	// Options are the other proxy options, as keys of the frpc ini config, e.g. remote_port, custom_domains or multiplexer
+	// +optional
+	Options map[string]string `json:"options,omitempty"`
+	// SecretOptions are proxy options read from Secrets in the namespace of the FrpProxy, e.g. sk or http_pwd
+	// +optional
+	SecretOptions map[string]corev1.SecretKeySelector `json:"secretOptions,omitempty"`
+}
+
+// FrpProxyClientStatus is the live state of the proxy on a frp client
+type FrpProxyClientStatus struct {
+	// Client is the address of the frp client
+	Client string `json:"client"`
+	// Name is the proxy name on the frp client
+	Name string `json:"name"`
+	// Status is the proxy status reported by the frp client, e.g. running or start error
+	Status string `json:"status"`
+	// +optional
+	Error string `json:"error,omitempty"`
+	// +optional
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+// FrpProxyStatus defines the observed state of FrpProxy
+type FrpProxyStatus struct {
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Proxies is the live state of the proxy on the frp clients it is placed on
+	// +optional
+	Proxies []FrpProxyClientStatus `json:"proxies,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+//+kubebuilder:printcolumn:name="Class",type=string,JSONPath=`.spec.ingressClassName`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// FrpProxy is the Schema for the frpproxies API
+type FrpProxy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   FrpProxySpec   `json:"spec,omitempty"`
+	Status FrpProxyStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// FrpProxyList contains a list of FrpProxy
+type FrpProxyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FrpProxy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&FrpProxy{}, &FrpProxyList{})
+}
@@ -18,9 +18,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
 	"github.com/grydovee/ingress-frp/pkg/controllers"
 	"github.com/grydovee/ingress-frp/pkg/frp"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -30,6 +34,7 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	//+kubebuilder:scaffold:imports
@@ -42,11 +47,16 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(frpv1alpha1.AddToScheme(scheme))
 
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(render(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
@@ -55,12 +65,65 @@ func main() {
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
-	var frpcAddr, uname, passwd string
+	var frpcAddr, uname, passwd, frpcFormat, ingressClass, poolsConfig, watchNamespaces, ingressSelector string
+	var unameFile, passwdFile, tokenFile, caFile, certFile, keyFile, serverName, embeddedConfig string
+	var commonConfig, configSecret, podSelector, proxyPlugins, adminSecretName, remotePorts, groupKeySecretName string
+	var adminRotationInterval time.Duration
 	var frpcPort int
+	var frpcTLS bool
+	flag.StringVar(&ingressClass, "ingress-class", constants.IngressClassName, "The IngressClass served by the frp client of --frp-addr.")
+	flag.StringVar(&poolsConfig, "frp-pools", "", "The file of frp client pools, one pool per IngressClass. "+
+		"Overrides --ingress-class and the frp client flags.")
 	flag.StringVar(&frpcAddr, "frp-addr", "127.0.0.1", "The web address of frp client.")
 	flag.IntVar(&frpcPort, "frp-port", 7400, "The web port of frp client.")
 	flag.StringVar(&uname, "frp-uname", "admin", "The username of frp client")
 	flag.StringVar(&passwd, "frp-passwd", "admin", "The password of frp client")
+	flag.StringVar(&unameFile, "frp-uname-file", "", "The file holding the username of frp client, e.g. a key of a mounted Secret. "+
+		"Read again when it changes, overrides --frp-uname.")
+	flag.StringVar(&passwdFile, "frp-passwd-file", "", "The file holding the password of frp client, e.g. a key of a mounted Secret. "+
+		"Read again when it changes, overrides --frp-passwd.")
+	flag.StringVar(&tokenFile, "frp-token-file", "", "The file holding a bearer token of the frp client admin api, "+
+		"used instead of the username and password. Read again when it changes.")
+	flag.StringVar(&adminSecretName, "frp-admin-secret", "",
+		"The Secret, as namespace/name, the manager generates the admin password of the frp client of --ingress-class into. "+
+			"The password is written to the frp client config and rotated, --frp-uname names the user and --frp-passwd is still accepted "+
+			"from the frp clients started before the Secret existed. Empty keeps the credentials of the flags.")
+	flag.DurationVar(&adminRotationInterval, "frp-admin-rotation-interval", constants.DefaultFrpAdminRotationInterval,
+		"How often the admin password of --frp-admin-secret is rotated, 0 never rotates it.")
+	flag.StringVar(&commonConfig, "frp-common-config", "", "The frpc config file whose [common] section is merged into the config "+
+		"of the frp clients of --ingress-class, e.g. a mounted Secret holding server_addr and token.")
+	flag.StringVar(&configSecret, "frp-config-secret", "", "The <namespace>/<name> of a Secret the configs of the frp clients of "+
+		"--ingress-class are written to, instead of their admin api. The frp client pods are selected by --frp-pod-selector. "+
+		"An existing Secret must be labeled frp.graydove.cn/pool=<ingress class>.")
+	flag.StringVar(&podSelector, "frp-pod-selector", "", "The label selector of the frp client pods of --frp-config-secret, e.g. app=ingress-frpc.")
+	flag.StringVar(&embeddedConfig, "frp-embedded-config", "", "The frpc config file whose [common] section configures a frp client "+
+		"run in the manager process for --ingress-class, instead of the frp client of --frp-addr.")
+	flag.BoolVar(&frpcTLS, "frp-tls", false, "Connect to the frp client admin api with https.")
+	flag.StringVar(&caFile, "frp-tls-ca-file", "", "The CA the frp client admin api certificate must be issued by, the system CAs if empty.")
+	flag.StringVar(&certFile, "frp-tls-cert-file", "", "The client certificate presented to the frp client admin api.")
+	flag.StringVar(&keyFile, "frp-tls-key-file", "", "The key of the client certificate presented to the frp client admin api.")
+	flag.StringVar(&serverName, "frp-tls-server-name", "", "The name verified in the frp client admin api certificate, --frp-addr if empty.")
+	syncOptions := frp.DefaultSyncOptions()
+	flag.DurationVar(&syncOptions.Debounce, "frp-sync-debounce", syncOptions.Debounce,
+		"The quiet period after an ingress change before the frp client config is applied, 0 applies every change immediately.")
+	flag.DurationVar(&syncOptions.MaxWait, "frp-sync-max-wait", syncOptions.MaxWait,
+		"The longest time a burst of ingress changes can delay applying the frp client config.")
+	flag.StringVar(&syncOptions.DriftMode, "frp-drift-mode", syncOptions.DriftMode,
+		"How out-of-band edits of the frp client config are handled: correct overwrites them, report only logs them.")
+	flag.DurationVar(&syncOptions.SlotReuseDelay, "frp-slot-reuse-delay", syncOptions.SlotReuseDelay,
+		"How long the proxy names of a frp client gone from discovery are kept from the new frp clients after it was last seen "+
+			"holding them. Should exceed the heartbeat timeout of frps.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "", "Comma separated namespaces whose ingresses, services and secrets are watched, "+
+		"all namespaces if empty.")
+	flag.StringVar(&ingressSelector, "ingress-label-selector", "", "Only the ingresses and the remote-port services matching the label selector are served, e.g. tenant=a.")
+	flag.StringVar(&remotePorts, "frp-remote-port-range", constants.DefaultFrpRemotePortRange,
+		"The remote ports services annotated with frp.kubernetes.io/remote-port and FrpProxies may allocate on frps, e.g. 6000-7000.")
+	flag.StringVar(&groupKeySecretName, "group-key-secret", constants.DefaultFrpGroupKeySecret,
+		"The Secret, as namespace/name, keeping the keys of the frp load balancing groups. Deleting it rotates the keys.")
+	flag.StringVar(&proxyPlugins, "frp-proxy-plugins", "", "Comma separated frpc plugins the FrpProxies may use, e.g. socks5. "+
+		"A plugin serves whatever its options point to from the frp client, none are allowed if empty.")
+	flag.StringVar(&frpcFormat, "frp-config-format", frp.FormatAuto, "The config format of frp client, one of auto, ini, toml, yaml or json. "+
+		"auto detects the format from the config served by the frp client.")
 
 	opts := zap.Options{
 		Development: true,
@@ -70,8 +133,31 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if syncOptions.DriftMode != constants.DriftModeCorrect && syncOptions.DriftMode != constants.DriftModeReport {
+		setupLog.Error(fmt.Errorf("unknown drift mode: %s", syncOptions.DriftMode), "invalid frp drift mode")
+		os.Exit(1)
+	}
+
+	scope, err := controllers.ParseScope(watchNamespaces, ingressSelector)
+	if err != nil {
+		setupLog.Error(err, "invalid scope")
+		os.Exit(1)
+	}
+	remotePortRange, err := controllers.ParsePortRange(remotePorts)
+	if err != nil {
+		setupLog.Error(err, "invalid frp remote port range")
+		os.Exit(1)
+	}
+
+	groupKeySecret, err := controllers.ParseNamespacedName(groupKeySecretName)
+	if err != nil {
+		setupLog.Error(err, "invalid group key secret")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
+		NewCache:               scope.NewCache(),
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
@@ -94,14 +180,162 @@ func main() {
 		os.Exit(1)
 	}
 
-	fs := frp.NewSyncer(frpcAddr, uint16(frpcPort), uname, passwd)
-	if err := mgr.Add(fs); err != nil {
-		return
+	pools := []frp.PoolConfig{{
+		IngressClass: ingressClass,
+		Addr:         frpcAddr,
+		Port:         uint16(frpcPort),
+		Username:     uname,
+		Password:     passwd,
+		ConfigFormat: frpcFormat,
+		UsernameFile: unameFile,
+		PasswordFile: passwdFile,
+		TokenFile:    tokenFile,
+	}}
+	if frpcTLS {
+		pools[0].TLS = &frp.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: serverName}
+	}
+	if poolsConfig != "" {
+		if pools, err = frp.LoadPoolConfigs(poolsConfig); err != nil {
+			setupLog.Error(err, "unable to load frp pools")
+			os.Exit(1)
+		}
+	}
+	if commonConfig != "" {
+		common, err := frp.LoadCommon(commonConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load the frp client [common] section")
+			os.Exit(1)
+		}
+		for i := range pools {
+			if pools[i].IngressClass == ingressClass {
+				pools[i].Common = common
+			}
+		}
+	}
+	if (configSecret != "" || embeddedConfig != "") && adminSecretName != "" {
+		setupLog.Error(fmt.Errorf("--frp-admin-secret needs the admin api of a frp client"), "invalid frp client flags")
+		os.Exit(1)
+	}
+	if configSecret != "" {
+		key, err := controllers.ParseNamespacedName(configSecret)
+		if err != nil {
+			setupLog.Error(err, "invalid frp config secret")
+			os.Exit(1)
+		}
+		for i := range pools {
+			if pools[i].IngressClass == ingressClass {
+				pools[i].Secret = &frp.SecretDelivery{Namespace: key.Namespace, Name: key.Name, PodSelector: podSelector}
+			}
+		}
+	}
+	if embeddedConfig != "" {
+		common, err := frp.LoadCommon(embeddedConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load the embedded frp client config")
+			os.Exit(1)
+		}
+		for i := range pools {
+			if pools[i].IngressClass == ingressClass {
+				pools[i].Embedded = true
+				pools[i].Common = common
+			}
+		}
 	}
-	if err = (controllers.NewFrpIngressReconciler(mgr.GetClient(), mgr.GetScheme(), fs)).SetupWithManager(mgr); err != nil {
+	var adminAuth *frp.RotatingBasicAuth
+	if adminSecretName != "" {
+		adminAuth = frp.NewRotatingBasicAuth(uname, passwd, "")
+		for i := range pools {
+			if pools[i].IngressClass == ingressClass {
+				pools[i].Auth = adminAuth
+			}
+		}
+	}
+	// the configs delivered through Secrets and the frp client pods are read from the api server, not cached
+	kubeClient, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		setupLog.Error(err, "unable to create kubernetes client")
+		os.Exit(1)
+	}
+	fs, err := frp.NewPoolSyncers(pools, kubeClient, syncOptions)
+	if err != nil {
+		setupLog.Error(err, "unable to create frp syncers")
+		os.Exit(1)
+	}
+	if adminAuth != nil {
+		adminSecret, err := controllers.ParseNamespacedName(adminSecretName)
+		if err != nil {
+			setupLog.Error(err, "invalid frp admin secret")
+			os.Exit(1)
+		}
+		syncer, ok := fs[ingressClass]
+		if !ok {
+			setupLog.Error(fmt.Errorf("no frp pool serves the ingress class %s", ingressClass), "unable to manage frp admin credentials")
+			os.Exit(1)
+		}
+		adminCredentials := controllers.NewAdminCredentials(mgr.GetClient(), adminSecret, adminAuth, syncer)
+		adminCredentials.APIReader = mgr.GetAPIReader()
+		adminCredentials.Username = uname
+		adminCredentials.BootstrapPassword = passwd
+		adminCredentials.RotationInterval = adminRotationInterval
+		if err := mgr.Add(adminCredentials); err != nil {
+			setupLog.Error(err, "unable to add frp admin credentials")
+			os.Exit(1)
+		}
+	}
+	frpPools := frp.NewPools(fs)
+	frpPools.SyncOptions = syncOptions
+	if err := mgr.Add(frpPools); err != nil {
+		setupLog.Error(err, "unable to add frp pools")
+		os.Exit(1)
+	}
+	if err := mgr.AddMetricsExtraHandler("/debug/frp", frp.NewDebugHandler(frpPools)); err != nil {
+		setupLog.Error(err, "unable to set up frp debug handler")
+		os.Exit(1)
+	}
+	classReconciler := controllers.NewIngressClassReconciler(mgr.GetClient(), frpPools)
+	if err = classReconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IngressClass")
+		os.Exit(1)
+	}
+	groupKeys := controllers.NewGroupKeys(mgr.GetClient(), groupKeySecret)
+	groupKeys.Pools = frpPools
+	if err = groupKeys.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GroupKeys")
+		os.Exit(1)
+	}
+	ingressReconciler := controllers.NewFrpIngressReconciler(mgr.GetClient(), mgr.GetScheme(), frpPools)
+	ingressReconciler.ClassEvents = classReconciler.Events()
+	ingressReconciler.DefaultClass = classReconciler.DefaultClass
+	ingressReconciler.Scope = scope
+	ingressReconciler.GroupKeys = groupKeys
+	if err = ingressReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "")
 		os.Exit(1)
 	}
+	serviceReconciler := controllers.NewServiceReconciler(mgr.GetClient(), mgr.GetScheme(), mgr.GetEventRecorderFor("ingress-frp"), frpPools, remotePortRange)
+	serviceReconciler.DefaultClass = classReconciler.DefaultClass
+	serviceReconciler.GroupKeys = groupKeys
+	serviceReconciler.Scope = scope
+	if err = serviceReconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Service")
+		os.Exit(1)
+	}
+	frpProxyReconciler := controllers.NewFrpProxyReconciler(mgr.GetClient(), mgr.GetScheme(), frpPools)
+	frpProxyReconciler.DefaultClass = classReconciler.DefaultClass
+	frpProxyReconciler.GroupKeys = groupKeys
+	frpProxyReconciler.Plugins = controllers.ParsePlugins(proxyPlugins)
+	frpProxyReconciler.PortRange = remotePortRange
+	frpProxyReconciler.Scope = scope
+	if err = frpProxyReconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "FrpProxy")
+		os.Exit(1)
+	}
+	statusCollector := controllers.NewIngressStatusCollector(mgr.GetClient(), mgr.GetEventRecorderFor("ingress-frp"), frpPools)
+	statusCollector.DefaultClass = classReconciler.DefaultClass
+	if err = mgr.Add(statusCollector); err != nil {
+		setupLog.Error(err, "unable to add ingress status collector")
+		os.Exit(1)
+	}
 
 	//+kubebuilder:scaffold:builder
 
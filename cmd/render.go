@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/controllers"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	"io"
+	"os"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sort"
+	"strings"
+)
+
+// stringsFlag is a repeatable string flag
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// render prints the frpc configs the manager would push for the manifests, or their diff against a saved output.
+// It returns the exit code: 1 on error, when proxies are left out of the configs or when --diff finds changes.
+func render(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var files stringsFlag
+	var ingressClass, namespace, commonConfig, format, portRange, diffFile, plugins string
+	var clients int
+	fs.Var(&files, "f", "A manifest file or a directory of manifests, - reads stdin. Repeatable.")
+	fs.StringVar(&ingressClass, "ingress-class", constants.IngressClassName, "The IngressClass served in addition to the "+
+		"IngressClasses of the controller found in the manifests.")
+	fs.StringVar(&namespace, "namespace", "default", "The namespace of the manifests setting none.")
+	fs.IntVar(&clients, "clients", 1, "The number of frp clients of every pool.")
+	fs.StringVar(&commonConfig, "frp-common-config", "", "The frpc config file whose [common] section is rendered, "+
+		"the sensitive values are masked.")
+	fs.StringVar(&format, "frp-config-format", frp.FormatIni, "The rendered config format, one of ini, toml, yaml or json.")
+	fs.StringVar(&portRange, "frp-remote-port-range", constants.DefaultFrpRemotePortRange,
+		"The remote ports services annotated with frp.kubernetes.io/remote-port and FrpProxies may allocate on frps.")
+	fs.StringVar(&plugins, "frp-proxy-plugins", "", "Comma separated frpc plugins the FrpProxies may use, none if empty.")
+	fs.StringVar(&diffFile, "diff", "", "A saved output of render, the proxies which would change are printed instead of the configs.")
+	opts := zap.Options{Development: true, DestWriter: stderr}
+	opts.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	fail := func(err error) int {
+		fmt.Fprintf(stderr, "render: %v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		return fail(fmt.Errorf("no manifests, set -f"))
+	}
+	codec, err := frp.NewCodec(format)
+	if err != nil {
+		return fail(err)
+	}
+	if codec == nil {
+		return fail(fmt.Errorf("the config format must be set"))
+	}
+	renderOpts := controllers.RenderOptions{
+		IngressClass: ingressClass,
+		Clients:      clients,
+		Codec:        codec,
+		Plugins:      controllers.ParsePlugins(plugins),
+	}
+	if renderOpts.PortRange, err = controllers.ParsePortRange(portRange); err != nil {
+		return fail(err)
+	}
+	if commonConfig != "" {
+		if renderOpts.Common, err = frp.LoadCommon(commonConfig); err != nil {
+			return fail(err)
+		}
+	}
+	objects, err := readManifests(files, namespace)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx := ctrl.LoggerInto(context.Background(), ctrl.Log.WithName("render"))
+	rendered, failures, err := controllers.Render(ctx, objects, renderOpts)
+	if err != nil {
+		return fail(err)
+	}
+	// the proxies left out of the configs fail the render, the configs and the diff are still printed
+	code := 0
+	for _, failure := range failures {
+		fmt.Fprintf(stderr, "render: proxy left out: %s\n", failure)
+		code = 1
+	}
+	if diffFile == "" {
+		if err := frp.WriteRendered(stdout, rendered); err != nil {
+			return fail(err)
+		}
+		return code
+	}
+
+	data, err := os.ReadFile(diffFile)
+	if err != nil {
+		return fail(err)
+	}
+	saved, err := frp.ReadRendered(bytes.NewReader(data))
+	if err != nil {
+		return fail(err)
+	}
+	diffs, err := frp.DiffRendered(saved, rendered, codec)
+	if err != nil {
+		return fail(err)
+	}
+	if len(diffs) == 0 {
+		return code
+	}
+	writeDiffs(stdout, diffs)
+	return 1
+}
+
+// readManifests reads the manifests of the files and of the yaml and json files of the directories
+func readManifests(files []string, namespace string) ([]client.Object, error) {
+	scheme, err := controllers.NewRenderScheme()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if file == "-" {
+			paths = append(paths, file)
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, file)
+			continue
+		}
+		err = filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch filepath.Ext(path) {
+			case ".yaml", ".yml", ".json":
+				if !info.IsDir() {
+					paths = append(paths, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []client.Object
+	for _, path := range paths {
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+		objs, err := controllers.ReadManifests(r, scheme, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		objects = append(objects, objs...)
+	}
+	return objects, nil
+}
+
+// writeDiffs prints the proxies added, removed and changed on every client, the changed proxies with their keys
+func writeDiffs(w io.Writer, diffs map[string]frp.Diff) {
+	names := make([]string, 0, len(diffs))
+	for name := range diffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := diffs[name]
+		fmt.Fprintf(w, "### %s\n", name)
+		for _, proxy := range d.Added {
+			fmt.Fprintf(w, "+ %s\n", proxy)
+		}
+		for _, proxy := range d.Removed {
+			fmt.Fprintf(w, "- %s\n", proxy)
+		}
+		proxies := make([]string, 0, len(d.Changed))
+		for proxy := range d.Changed {
+			proxies = append(proxies, proxy)
+		}
+		sort.Strings(proxies)
+		for _, proxy := range proxies {
+			pd := d.Changed[proxy]
+			fmt.Fprintf(w, "~ %s\n", proxy)
+			for _, k := range sortedKeys(pd.Added) {
+				fmt.Fprintf(w, "    + %s = %s\n", k, pd.Added[k])
+			}
+			for _, k := range sortedKeys(pd.Removed) {
+				fmt.Fprintf(w, "    - %s = %s\n", k, pd.Removed[k])
+			}
+			changed := make([]string, 0, len(pd.Changed))
+			for k := range pd.Changed {
+				changed = append(changed, k)
+			}
+			sort.Strings(changed)
+			for _, k := range changed {
+				fmt.Fprintf(w, "    ~ %s = %s -> %s\n", k, pd.Changed[k].Live, pd.Changed[k].Desired)
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -49,3 +49,12 @@ Selector labels
 app.kubernetes.io/name: {{ include "ingress-frp.name" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
 {{- end }}
+
+{{/*
+File extension of the frpc configs written by the manager to the Secret <release>-frpc-configs, the format of
+--frp-config-format, ini when it is auto
+*/}}
+{{- define "ingress-frp.frpcConfigExt" -}}
+{{- $format := lower (default "auto" .Values.frp.frpc.configFormat) }}
+{{- if eq $format "auto" }}ini{{ else if eq $format "yml" }}yaml{{ else }}{{ $format }}{{ end }}
+{{- end }}
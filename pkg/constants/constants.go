@@ -1,7 +1,11 @@
 package constants
 
+import "time"
+
 const (
 	IngressClassName = "frp"
+	// ControllerName is the spec.controller of the IngressClasses served by the controller
+	ControllerName = "graydove.cn/ingress-frp"
 )
 
 const (
@@ -11,8 +15,97 @@ const (
 	AnnotationHeaderXFromWhere  = "frp.kubernetes.io/header-x-from-where"
 	AnnotationBackendProtocol   = "frp.kubernetes.io/backend-protocol"
 	AnnotationBasicAuth         = "frp.kubernetes.io/basic-auth"
+
+	// AnnotationStatus holds the conditions of the frp proxies of an ingress, written by the controller
+	AnnotationStatus = "frp.kubernetes.io/status"
+
+	// AnnotationRemotePort publishes the ports of a service as tcp or udp proxies, values like "5432" for a
+	// single port service, or "postgres:5432,9187:9187" mapping service port names or numbers to remote ports
+	AnnotationRemotePort = "frp.kubernetes.io/remote-port"
+	// AnnotationServiceIngressClass selects the frp client pool of a service, the default class if unset
+	AnnotationServiceIngressClass = "frp.kubernetes.io/ingress-class"
+)
+
+const (
+	ConditionReady = "Ready"
+
+	ReasonProxyRunning    = "ProxyRunning"
+	ReasonProxyPending    = "ProxyPending"
+	ReasonProxyStartError = "ProxyStartError"
+	ReasonApplyFailed     = "ApplyFailed"
+	ReasonNoProxy         = "NoProxy"
+	// ReasonProxyUnverified is set when the proxies were delivered to ready frp clients which report no proxy status
+	ReasonProxyUnverified = "ProxyUnverified"
+
+	ReasonInvalidRemotePort  = "InvalidRemotePort"
+	ReasonRemotePortConflict = "RemotePortConflict"
+	ReasonNoPool             = "NoPool"
+	ReasonInvalidProxy       = "InvalidProxy"
+)
+
+const (
+	// DriftModeCorrect overwrites out-of-band edits of the frpc config
+	DriftModeCorrect = "correct"
+	// DriftModeReport only reports out-of-band edits and leaves the frpc config in place
+	DriftModeReport = "report"
+)
+
+const (
+	// SecretKeyUsername, SecretKeyPassword and SecretKeyToken are the keys of the frp client admin credentials Secret
+	SecretKeyUsername = "username"
+	SecretKeyPassword = "password"
+	SecretKeyToken    = "token"
+	// SecretKeyPreviousPassword is the password replaced by the last rotation of the managed admin credentials,
+	// still accepted by the frp clients started before the rotation
+	SecretKeyPreviousPassword = "previousPassword"
+	// AnnotationRotatedAt is the time of the last rotation of the managed admin credentials, in RFC 3339
+	AnnotationRotatedAt = "frp.graydove.cn/rotated-at"
+	// LabelConfigsPool marks the Secret the configs of the frp client pods of a pool are written to, the manager only
+	// writes to a Secret labeled with the IngressClass of its pool
+	LabelConfigsPool = "frp.graydove.cn/pool"
 )
 
+// the defaults of the sync options of the frp client pools
+const (
+	// DefaultFrpSyncDebounce is the quiet period after a change before the config is applied, 0 disables debouncing
+	DefaultFrpSyncDebounce = time.Second
+	// DefaultFrpSyncMaxWait bounds how long a burst of changes can delay the apply
+	DefaultFrpSyncMaxWait = 10 * time.Second
+	DefaultFrpDriftMode   = DriftModeCorrect
+	// DefaultFrpSlotReuseDelay is how long the slot of a frpc gone from discovery is kept from the new frpc after it
+	// was last seen holding it, longer than frps keeps the proxies of a frpc which stopped sending heartbeats (90s by
+	// default)
+	DefaultFrpSlotReuseDelay = 2 * time.Minute
+)
+
+const (
+	// FrpStatusSyncInterval is how often the status of the proxies is read from the frp clients
+	FrpStatusSyncInterval = 30 * time.Second
+	// FrpGroupKeyPruneInterval is how often the keys of the groups no proxy uses are looked for, they are removed from
+	// the Secret when still unused at the next look
+	FrpGroupKeyPruneInterval = time.Hour
+)
+
+// the defaults of the manager flags
+const (
+	// DefaultFrpGroupKeySecret is the Secret, as namespace/name, holding the keys of the load balancing groups
+	DefaultFrpGroupKeySecret = "ingress-frp-system/ingress-frp-group-keys"
+	// DefaultFrpAdminRotationInterval is how often the managed admin password is rotated, 0 never rotates it
+	DefaultFrpAdminRotationInterval = 30 * 24 * time.Hour
+	// DefaultFrpRemotePortRange are the remote ports services and FrpProxies may allocate on frps
+	DefaultFrpRemotePortRange = "1024-65535"
+)
+
+// FrpVerifyTimeout bounds the wait for a frpc to know the applied proxies, which is polled every FrpVerifyInterval
+const (
+	FrpVerifyTimeout  = 10 * time.Second
+	FrpVerifyInterval = 500 * time.Millisecond
+)
+
+// ProxyNameMaxLength bounds the proxy names set by the controllers, leaving room for the prefixes added to the names
+// by the syncer and by frps
+const ProxyNameMaxLength = 128
+
 const (
 	IndexIngressSecretName = ".spec.tls.secretName"
 )
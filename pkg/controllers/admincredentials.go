@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"context"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"time"
+)
+
+// adminCommonKey owns the admin credentials in the [common] section of the frp clients
+const adminCommonKey = "admin-credentials"
+
+// AdminCredentials owns the admin credentials of a pool of frp clients: the password is generated into a Secret,
+// written to the [common] section of the clients and rotated every RotationInterval.
+// frpc only reads its admin credentials when it starts, so a client keeps accepting the previous password until it
+// restarts. The controller falls back to the previous password meanwhile, and postpones the next rotation until no
+// client accepts only the previous password, so that it is never locked out.
+type AdminCredentials struct {
+	client.Client
+	clock.Clock
+	// APIReader reads the Secret from the api server, secrets are only cached as metadata
+	APIReader client.Reader
+	// Secret holds the username, the password and the previous password
+	Secret types.NamespacedName
+	// Auth is the credentials used by the clients of the pool, updated from the Secret
+	Auth *frp.RotatingBasicAuth
+	// Syncer is the syncer of the pool, it writes the credentials to the [common] section of the clients
+	Syncer frp.Syncer
+	// Username and BootstrapPassword create the Secret, the clients started before it existed accept BootstrapPassword
+	Username          string
+	BootstrapPassword string
+	// RotationInterval is how often the password is rotated, 0 never rotates it
+	RotationInterval time.Duration
+	Interval         time.Duration
+}
+
+var _ manager.LeaderElectionRunnable = (*AdminCredentials)(nil)
+
+func NewAdminCredentials(client client.Client, secret types.NamespacedName, auth *frp.RotatingBasicAuth, syncer frp.Syncer) *AdminCredentials {
+	return &AdminCredentials{
+		Client:           client,
+		Clock:            clock.RealClock{},
+		Secret:           secret,
+		Auth:             auth,
+		Syncer:           syncer,
+		RotationInterval: constants.DefaultFrpAdminRotationInterval,
+		Interval:         constants.FrpClientSyncInterval,
+	}
+}
+
+func (c *AdminCredentials) Start(ctx context.Context) error {
+	l := log.FromContext(ctx)
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Ensure(ctx); err != nil {
+			l.Error(err, "ensure frpc admin credentials error", "secret", c.Secret)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *AdminCredentials) NeedLeaderElection() bool {
+	return true
+}
+
+// Ensure creates the Secret or rotates the password when it is due, and hands the credentials to the pool
+func (c *AdminCredentials) Ensure(ctx context.Context) error {
+	l := log.FromContext(ctx)
+	now := c.Now()
+
+	reader := c.APIReader
+	if reader == nil {
+		reader = c.Client
+	}
+	var secret corev1.Secret
+	err := reader.Get(ctx, c.Secret, &secret)
+	switch {
+	case apierrors.IsNotFound(err):
+		password, err := randomKey()
+		if err != nil {
+			return err
+		}
+		secret = corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   c.Secret.Namespace,
+				Name:        c.Secret.Name,
+				Annotations: map[string]string{constants.AnnotationRotatedAt: now.UTC().Format(time.RFC3339)},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				constants.SecretKeyUsername:         []byte(c.Username),
+				constants.SecretKeyPassword:         []byte(password),
+				constants.SecretKeyPreviousPassword: []byte(c.BootstrapPassword),
+			},
+		}
+		if err := c.Create(ctx, &secret); err != nil {
+			return err
+		}
+		l.Info("frpc admin credentials generated", "secret", c.Secret)
+	case err != nil:
+		return err
+	case c.rotationDue(&secret, now):
+		// the clients which accepted the previous password lately still run with it
+		if previous := c.Auth.PreviousHosts(now.Add(-2 * c.Interval)); len(previous) > 0 {
+			l.Info("frpc admin password rotation postponed, restart the frp clients still running with the previous password",
+				"clients", previous)
+			break
+		}
+		password, err := randomKey()
+		if err != nil {
+			return err
+		}
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		secret.Annotations[constants.AnnotationRotatedAt] = now.UTC().Format(time.RFC3339)
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[constants.SecretKeyPreviousPassword] = secret.Data[constants.SecretKeyPassword]
+		secret.Data[constants.SecretKeyPassword] = []byte(password)
+		if err := c.Update(ctx, &secret); err != nil {
+			return err
+		}
+		l.Info("frpc admin password rotated", "secret", c.Secret)
+	}
+
+	username := string(secret.Data[constants.SecretKeyUsername])
+	password := string(secret.Data[constants.SecretKeyPassword])
+	if password == "" {
+		// an emptied password whose rotation is postponed
+		return nil
+	}
+	c.Auth.Set(username, password, string(secret.Data[constants.SecretKeyPreviousPassword]))
+	c.Syncer.SetCommon(adminCommonKey, map[string]string{"admin_user": username, "admin_pwd": password})
+	return nil
+}
+
+// rotationDue reports whether the password is older than RotationInterval, a Secret created by hand is rotated after
+// RotationInterval from its creation
+func (c *AdminCredentials) rotationDue(secret *corev1.Secret, now time.Time) bool {
+	if len(secret.Data[constants.SecretKeyPassword]) == 0 {
+		return true
+	}
+	if c.RotationInterval <= 0 {
+		return false
+	}
+	rotatedAt := secret.CreationTimestamp.Time
+	if t, err := time.Parse(time.RFC3339, secret.Annotations[constants.AnnotationRotatedAt]); err == nil {
+		rotatedAt = t
+	}
+	return !now.Before(rotatedAt.Add(c.RotationInterval))
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+type commonSyncer struct {
+	frp.Syncer
+	common map[string]map[string]string
+}
+
+func (s *commonSyncer) SetCommon(key string, common map[string]string) {
+	s.common[key] = common
+}
+
+func TestAdminCredentials(t *testing.T) {
+	cli, _ := newFakeClient(t)
+
+	secretKey := client.ObjectKey{Namespace: "ingress-frp-system", Name: "ingress-frp-frpc-admin"}
+	syncer := &commonSyncer{common: make(map[string]map[string]string)}
+	auth := frp.NewRotatingBasicAuth("admin", "admin", "")
+	credentials := NewAdminCredentials(cli, secretKey, auth, syncer)
+	credentials.Username = "admin"
+	credentials.BootstrapPassword = "admin"
+	credentials.RotationInterval = time.Minute
+	now := time.Now()
+	credentials.Clock = clocktesting.NewFakeClock(now)
+	current := func() (string, string) {
+		t.Helper()
+		if err := credentials.Ensure(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		var secret corev1.Secret
+		if err := cli.Get(context.Background(), secretKey, &secret); err != nil {
+			t.Fatal(err)
+		}
+		password := string(secret.Data[constants.SecretKeyPassword])
+		if pushed := syncer.common[adminCommonKey]["admin_pwd"]; pushed != password {
+			t.Errorf("pushed password %q, want the password of the secret", pushed)
+		}
+		return password, string(secret.Data[constants.SecretKeyPreviousPassword])
+	}
+
+	// the frpc started before the secret existed keep the bootstrap password
+	password, previous := current()
+	if len(password) != 64 || previous != "admin" {
+		t.Fatalf("generated password %q, previous %q", password, previous)
+	}
+	if again, _ := current(); again != password {
+		t.Error("password rotated before the interval")
+	}
+
+	// the rotation waits for the frpc still running with the previous password
+	credentials.Clock = clocktesting.NewFakeClock(now.Add(credentials.RotationInterval))
+	auth.Accepted("10.0.0.1:7400", true)
+	if again, _ := current(); again != password {
+		t.Error("password rotated while a frpc runs with the previous password")
+	}
+
+	auth.Accepted("10.0.0.1:7400", false)
+	rotated, previous := current()
+	if rotated == password || previous != password {
+		t.Errorf("password not rotated: %q, previous %q", rotated, previous)
+	}
+}
@@ -0,0 +1,504 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strconv"
+	"strings"
+)
+
+// FrpProxyReconciler configures a frp proxy for each FrpProxy, for the proxy types and plugins an ingress can not express.
+// The Ready condition is set here when the spec is invalid or no pool serves the class, the IngressStatusCollector
+// reports the live state of the proxy afterwards.
+type FrpProxyReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Pools are the syncers of the frp client pools, keyed by the IngressClass they serve
+	Pools *frp.Pools
+	// DefaultClass is the class of the proxies setting no class
+	DefaultClass *DefaultIngressClass
+	// APIReader reads the secret options from the api server, secrets are only cached as metadata
+	APIReader client.Reader
+	// GroupKeys are the keys of the load balancing groups, required to configure grouped proxies
+	GroupKeys *GroupKeys
+	// Plugins are the frpc plugins the FrpProxies may use, none if empty. A plugin serves whatever its options point
+	// to from the frpc, e.g. static_file its local_path.
+	Plugins []string
+	// PortRange are the remote ports the FrpProxies may allocate, they share them with the services
+	PortRange PortRange
+	// Scope restricts the services sharing the remote ports, nil counts every service
+	Scope *Scope
+}
+
+// localOptions are the options pointing the proxy at an address or file of the frpc, they are set from the backend
+// or the plugin only
+var localOptions = map[string]bool{"local_ip": true, "local_port": true, "plugin": true}
+
+// groupOptions are the options of the load balancing groups, the controller sets them with a key of its own so that
+// a proxy can not join the group of another one
+var groupOptions = map[string]bool{"group": true, "group_key": true}
+
+func NewFrpProxyReconciler(client client.Client, scheme *runtime.Scheme, pools *frp.Pools) *FrpProxyReconciler {
+	return &FrpProxyReconciler{
+		Client: client,
+		Scheme: scheme,
+		Pools:  pools,
+	}
+}
+
+//+kubebuilder:rbac:groups=frp.graydove.cn,resources=frpproxies,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=frp.graydove.cn,resources=frpproxies/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=,resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=,resources=secrets,verbs=get;list;watch
+
+func (r *FrpProxyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("Reconciling", "req", req)
+
+	key := frpProxyKey(req.NamespacedName.String())
+	var proxy frpv1alpha1.FrpProxy
+	if err := r.Get(ctx, req.NamespacedName, &proxy); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.deleteProxies(key, "")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !proxy.DeletionTimestamp.IsZero() {
+		r.deleteProxies(key, "")
+		return ctrl.Result{}, nil
+	}
+
+	className := FrpProxyClassName(&proxy, r.DefaultClass.Get())
+	frpSyncer, ok := r.Pools.Get(className)
+	if !ok {
+		r.deleteProxies(key, "")
+		// the pool of the class may be applied later by the IngressClassReconciler
+		return ctrl.Result{RequeueAfter: constants.FrpStatusSyncInterval},
+			r.setNotReady(ctx, &proxy, constants.ReasonNoPool, fmt.Sprintf("no frp client pool serves the class %q", className))
+	}
+	r.deleteProxies(key, className)
+
+	cfg, err := r.proxyConfig(ctx, &proxy)
+	if err != nil {
+		if isInvalidProxy(err) {
+			frpSyncer.DeleteProxies(key)
+			return ctrl.Result{}, r.setNotReady(ctx, &proxy, constants.ReasonInvalidProxy, err.Error())
+		}
+		return ctrl.Result{}, err
+	}
+	// the options are written in the config format of the pool, the syncer checks the inline certificates, it knows
+	// whether it writes them to files
+	if err := frp.CheckFormat(frp.SyncerFormat(frpSyncer), frpProxyName(&proxy), cfg, true); err != nil {
+		frpSyncer.DeleteProxies(key)
+		return ctrl.Result{}, r.setNotReady(ctx, &proxy, constants.ReasonInvalidProxy, err.Error())
+	}
+	if claim, ok := frpProxyRemotePort(&proxy, r.PortRange); ok {
+		claimants, err := listRemotePortClaimants(ctx, r.Client, r.DefaultClass.Get(), r.PortRange, r.Scope)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if owner := remotePortOwners(claimants, className)[claim]; owner != nil && (owner.kind != "FrpProxy" || owner.name != req.NamespacedName) {
+			frpSyncer.DeleteProxies(key)
+			return ctrl.Result{}, r.setNotReady(ctx, &proxy, constants.ReasonRemotePortConflict,
+				fmt.Sprintf("remote port %s/%d is allocated to %s", strings.ToLower(string(claim.protocol)), claim.remotePort, owner))
+		}
+	}
+
+	cfgs := map[string]frp.Config{frpProxyName(&proxy): cfg}
+	l.Info("update frp config", "cfgs", fmt.Sprintf("%v", cfgs))
+	frpSyncer.SetProxies(key, cfgs)
+
+	// keep the live state written by the IngressStatusCollector, only leave the error states set here
+	cond := meta.FindStatusCondition(proxy.Status.Conditions, constants.ConditionReady)
+	if cond != nil && !frpProxyNotConfigured(cond.Reason) && proxy.Status.ObservedGeneration == proxy.Generation {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, r.setCondition(ctx, &proxy, metav1.Condition{
+		Type:    constants.ConditionReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  constants.ReasonProxyPending,
+		Message: "waiting for the frp clients to apply the proxy",
+	})
+}
+
+// invalidProxyError reports a spec which can not be turned into a frp proxy
+type invalidProxyError struct {
+	msg string
+}
+
+func (e *invalidProxyError) Error() string {
+	return e.msg
+}
+
+func invalidProxy(format string, args ...any) error {
+	return &invalidProxyError{msg: fmt.Sprintf(format, args...)}
+}
+
+func isInvalidProxy(err error) bool {
+	_, ok := err.(*invalidProxyError)
+	return ok
+}
+
+// frpProxyNotConfigured reports whether the reason of the Ready condition is set by the FrpProxyReconciler for a
+// proxy it did not configure
+func frpProxyNotConfigured(reason string) bool {
+	return reason == constants.ReasonInvalidProxy || reason == constants.ReasonNoPool || reason == constants.ReasonRemotePortConflict
+}
+
+// checkOptions validates the options of the spec, which need no lookup
+func checkOptions(spec *frpv1alpha1.FrpProxySpec, portRange PortRange) error {
+	for k := range spec.Options {
+		if localOptions[k] || strings.HasPrefix(k, "plugin_") {
+			return invalidProxy("option %s can not be set, use backend or plugin", k)
+		}
+		if groupOptions[k] {
+			return invalidProxy("option %s can not be set, the load balancing groups are set by the controller", k)
+		}
+	}
+	for k := range spec.SecretOptions {
+		if localOptions[k] || strings.HasPrefix(k, "plugin_") {
+			return invalidProxy("secret option %s can not be set, use backend or plugin", k)
+		}
+		if groupOptions[k] {
+			return invalidProxy("secret option %s can not be set, the load balancing groups are set by the controller", k)
+		}
+		if k == "remote_port" {
+			return invalidProxy("secret option remote_port can not be set, use options")
+		}
+	}
+	if v, ok := spec.Options["remote_port"]; ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return invalidProxy("invalid remote port %q", v)
+		}
+		if !portRange.Contains(port) {
+			return invalidProxy("remote port %d is outside of the allowed range %s", port, portRange)
+		}
+	}
+	return nil
+}
+
+// frpProxyRemotePort returns the remote port the FrpProxy claims, a FrpProxy with invalid options claims none
+func frpProxyRemotePort(proxy *frpv1alpha1.FrpProxy, portRange PortRange) (remotePortClaim, bool) {
+	v, ok := proxy.Spec.Options["remote_port"]
+	if !ok || checkOptions(&proxy.Spec, portRange) != nil {
+		return remotePortClaim{}, false
+	}
+	port, _ := strconv.Atoi(v)
+	protocol := corev1.ProtocolTCP
+	if proxy.Spec.Type == frp.TypeUdp {
+		protocol = corev1.ProtocolUDP
+	}
+	return remotePortClaim{protocol: protocol, remotePort: port}, true
+}
+
+func claimsRemotePort(object client.Object) bool {
+	proxy, ok := object.(*frpv1alpha1.FrpProxy)
+	return ok && proxy.Spec.Options["remote_port"] != ""
+}
+
+// proxyConfig builds the frp proxy section of the FrpProxy
+func (r *FrpProxyReconciler) proxyConfig(ctx context.Context, proxy *frpv1alpha1.FrpProxy) (frp.Config, error) {
+	spec := &proxy.Spec
+	if spec.Backend != nil && spec.Plugin != nil {
+		return nil, invalidProxy("backend and plugin are exclusive")
+	}
+	if err := checkOptions(spec, r.PortRange); err != nil {
+		return nil, err
+	}
+	if spec.Plugin != nil && !containsString(r.Plugins, spec.Plugin.Name) {
+		return nil, invalidProxy("plugin %s is not allowed", spec.Plugin.Name)
+	}
+	// a visitor connects to the proxy of another frpc and forwards to nothing
+	if spec.Backend == nil && spec.Plugin == nil && spec.Options["role"] != "visitor" {
+		return nil, invalidProxy("backend or plugin is required")
+	}
+
+	m := map[string]string{"type": spec.Type}
+	if spec.Backend != nil {
+		var svc corev1.Service
+		if err := r.Get(ctx, types.NamespacedName{Namespace: proxy.Namespace, Name: spec.Backend.ServiceName}, &svc); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, invalidProxy("service %s not found", spec.Backend.ServiceName)
+			}
+			return nil, err
+		}
+		port, err := backendPort(&svc, spec.Backend.ServicePort)
+		if err != nil {
+			return nil, err
+		}
+		m["local_ip"] = svcToDomain(&svc)
+		m["local_port"] = port
+	}
+	if spec.Plugin != nil {
+		m["plugin"] = spec.Plugin.Name
+		for k, v := range spec.Plugin.Options {
+			m["plugin_"+k] = v
+		}
+	}
+	for k, v := range spec.Options {
+		if _, ok := m[k]; ok {
+			return nil, invalidProxy("option %s is set by the spec", k)
+		}
+		m[k] = v
+	}
+	for k, ref := range spec.SecretOptions {
+		if _, ok := m[k]; ok {
+			return nil, invalidProxy("secret option %s is set by the spec", k)
+		}
+		v, ok, err := r.secretValue(ctx, proxy.Namespace, ref)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m[k] = v
+		}
+	}
+
+	// load balance the proxy over the clients of the pool, the other types are placed on a single client
+	switch spec.Type {
+	case frp.TypeTcp, frp.TypeHttp, "tcpmux":
+		if m["role"] != "visitor" {
+			group, key, err := r.GroupKeys.Group(ctx, frpProxyName(proxy), spec.Type)
+			if err != nil {
+				return nil, err
+			}
+			m["group"], m["group_key"] = group, key
+		}
+	}
+	cfg := frp.NewConfig(m)
+	if err := frp.ValidateProxy(frpProxyName(proxy), cfg); err != nil {
+		return nil, invalidProxy("%s", err)
+	}
+	return cfg, nil
+}
+
+func (r *FrpProxyReconciler) secretValue(ctx context.Context, namespace string, ref corev1.SecretKeySelector) (string, bool, error) {
+	optional := ref.Optional != nil && *ref.Optional
+	var secret corev1.Secret
+	if err := r.secretReader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			if optional {
+				return "", false, nil
+			}
+			return "", false, invalidProxy("secret %s not found", ref.Name)
+		}
+		return "", false, err
+	}
+	v, ok := secret.Data[ref.Key]
+	if !ok {
+		if optional {
+			return "", false, nil
+		}
+		return "", false, invalidProxy("key %s not found in secret %s", ref.Key, ref.Name)
+	}
+	return string(v), true, nil
+}
+
+func backendPort(svc *corev1.Service, port intstr.IntOrString) (string, error) {
+	for _, p := range svc.Spec.Ports {
+		if (port.Type == intstr.String && p.Name == port.StrVal) || (port.Type == intstr.Int && p.Port == port.IntVal) {
+			return strconv.Itoa(int(p.Port)), nil
+		}
+	}
+	return "", invalidProxy("port %s not found in service %s", port.String(), svc.Name)
+}
+
+// FrpProxyClassName returns the class of the FrpProxy, the default class if it sets no class
+func FrpProxyClassName(proxy *frpv1alpha1.FrpProxy, defaultClass string) string {
+	if proxy.Spec.IngressClassName != nil && *proxy.Spec.IngressClassName != "" {
+		return *proxy.Spec.IngressClassName
+	}
+	if defaultClass != "" {
+		return defaultClass
+	}
+	return constants.IngressClassName
+}
+
+// deleteProxies deletes the proxies of the FrpProxy from every syncer except the one of the given class
+func (r *FrpProxyReconciler) deleteProxies(key string, exceptClass string) {
+	for className, frpSyncer := range r.Pools.Syncers() {
+		if className != exceptClass {
+			frpSyncer.DeleteProxies(key)
+		}
+	}
+}
+
+func (r *FrpProxyReconciler) setNotReady(ctx context.Context, proxy *frpv1alpha1.FrpProxy, reason, message string) error {
+	log.FromContext(ctx).Info(message, "frpProxy", client.ObjectKeyFromObject(proxy), "reason", reason)
+	return r.setCondition(ctx, proxy, metav1.Condition{
+		Type:    constants.ConditionReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+func (r *FrpProxyReconciler) setCondition(ctx context.Context, proxy *frpv1alpha1.FrpProxy, cond metav1.Condition) error {
+	patch := client.MergeFrom(proxy.DeepCopy())
+	cond.ObservedGeneration = proxy.Generation
+	meta.SetStatusCondition(&proxy.Status.Conditions, cond)
+	proxy.Status.ObservedGeneration = proxy.Generation
+	if frpProxyNotConfigured(cond.Reason) {
+		proxy.Status.Proxies = nil
+	}
+	return r.Status().Patch(ctx, proxy, patch)
+}
+
+func (r *FrpProxyReconciler) secretReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+// frpProxyKey is the syncer key of the proxy of a FrpProxy, distinct from the keys of ingresses and services
+func frpProxyKey(name string) string {
+	return "frpproxy/" + name
+}
+
+func frpProxyName(proxy *frpv1alpha1.FrpProxy) string {
+	return shortenProxyName(fmt.Sprintf("%s/%s:%s", proxy.Namespace, proxy.Name, proxy.Spec.Type))
+}
+
+func (r *FrpProxyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Pools == nil {
+		r.Pools = frp.NewPools(map[string]frp.Syncer{constants.IngressClassName: frp.NewFakeSyncer()})
+	}
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
+
+	bldr := ctrl.NewControllerManagedBy(mgr)
+	if r.GroupKeys != nil {
+		bldr = bldr.Watches(&source.Channel{Source: r.GroupKeys.Subscribe()}, handler.EnqueueRequestsFromMapFunc(r.groupKeysMapFunc))
+	}
+	return bldr.
+		For(&frpv1alpha1.FrpProxy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.serviceMapFunc)).
+		// a change of a FrpProxy may free or take a remote port claimed by the other FrpProxies
+		Watches(&source.Kind{Type: &frpv1alpha1.FrpProxy{}}, handler.EnqueueRequestsFromMapFunc(r.claimMapFunc), builder.WithPredicates(claimPredicate(claimsRemotePort))).
+		// only the metadata of the secrets is cached, the secret options are read with APIReader
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretMapFunc), builder.OnlyMetadata).
+		Complete(r)
+}
+
+// groupKeysMapFunc requeues every FrpProxy when the group keys are rotated
+func (r *FrpProxyReconciler) groupKeysMapFunc(client.Object) []reconcile.Request {
+	var proxyList frpv1alpha1.FrpProxyList
+	if err := r.List(context.Background(), &proxyList); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range proxyList.Items {
+		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&proxyList.Items[i])})
+	}
+	return reqs
+}
+
+// claimMapFunc maps a FrpProxy to the other FrpProxies claiming its remote port. An update maps both the old and the
+// new object, so the FrpProxies waiting for a released port are requeued too.
+func (r *FrpProxyReconciler) claimMapFunc(object client.Object) []reconcile.Request {
+	claims := objectClaims(object)
+	if len(claims) == 0 {
+		return nil
+	}
+	var proxyList frpv1alpha1.FrpProxyList
+	if err := r.List(context.Background(), &proxyList); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range proxyList.Items {
+		key := client.ObjectKeyFromObject(&proxyList.Items[i])
+		if key != client.ObjectKeyFromObject(object) && claimsOverlap(objectClaims(&proxyList.Items[i]), claims) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: key})
+		}
+	}
+	return reqs
+}
+
+// serviceMapFunc maps a service to the FrpProxies using it as backend and to the FrpProxies claiming one of its remote
+// ports, which the service may take or free
+func (r *FrpProxyReconciler) serviceMapFunc(object client.Object) []reconcile.Request {
+	claims := objectClaims(object)
+	var opts []client.ListOption
+	if len(claims) == 0 {
+		opts = append(opts, client.InNamespace(object.GetNamespace()))
+	}
+	var proxyList frpv1alpha1.FrpProxyList
+	if err := r.List(context.Background(), &proxyList, opts...); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range proxyList.Items {
+		proxy := &proxyList.Items[i]
+		backend := proxy.Spec.Backend
+		usesService := backend != nil && proxy.Namespace == object.GetNamespace() && backend.ServiceName == object.GetName()
+		if usesService || claimsOverlap(objectClaims(proxy), claims) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(proxy)})
+		}
+	}
+	return reqs
+}
+
+// secretMapFunc maps a secret to the FrpProxies reading secret options from it
+func (r *FrpProxyReconciler) secretMapFunc(object client.Object) []reconcile.Request {
+	var proxyList frpv1alpha1.FrpProxyList
+	if err := r.List(context.Background(), &proxyList, client.InNamespace(object.GetNamespace())); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range proxyList.Items {
+		for _, ref := range proxyList.Items[i].Spec.SecretOptions {
+			if ref.Name == object.GetName() {
+				reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&proxyList.Items[i])})
+				break
+			}
+		}
+	}
+	return reqs
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePlugins parses a comma separated list of frpc plugins
+func ParsePlugins(s string) []string {
+	var plugins []string
+	for _, plugin := range strings.Split(s, ",") {
+		if plugin = strings.TrimSpace(plugin); plugin != "" {
+			plugins = append(plugins, plugin)
+		}
+	}
+	return plugins
+}
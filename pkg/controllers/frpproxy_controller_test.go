@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"context"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	controllerruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestFrpProxyReconciler_Reconcile(t *testing.T) {
+	newProxy := func(name string, spec frpv1alpha1.FrpProxySpec) *frpv1alpha1.FrpProxy {
+		return &frpv1alpha1.FrpProxy{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Generation: 1},
+			Spec:       spec,
+		}
+	}
+	partner := "partner"
+	postgres := newProxy("postgres", frpv1alpha1.FrpProxySpec{
+		Type:          "stcp",
+		Backend:       &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromString("postgres")},
+		SecretOptions: map[string]corev1.SecretKeySelector{"sk": {LocalObjectReference: corev1.LocalObjectReference{Name: "postgres-stcp"}, Key: "sk"}},
+	})
+	socks := newProxy("socks", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Plugin:  &frpv1alpha1.FrpProxyPlugin{Name: "socks5", Options: map[string]string{"user": "admin"}},
+		Options: map[string]string{"remote_port": "1080"},
+	})
+	missingPort := newProxy("missing-port", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Backend: &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromInt(5433)},
+	})
+	overridden := newProxy("overridden", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Backend: &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromInt(5432)},
+		Options: map[string]string{"type": "udp"},
+	})
+	noPool := newProxy("no-pool", frpv1alpha1.FrpProxySpec{
+		Type:             "tcp",
+		Backend:          &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromInt(5432)},
+		IngressClassName: &partner,
+	})
+	staticFile := newProxy("static-file", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Plugin:  &frpv1alpha1.FrpProxyPlugin{Name: "static_file", Options: map[string]string{"local_path": "/"}},
+		Options: map[string]string{"remote_port": "8080"},
+	})
+	localIP := newProxy("local-ip", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Options: map[string]string{"local_ip": "169.254.169.254", "local_port": "80", "remote_port": "8080"},
+	})
+	pluginOption := newProxy("plugin-option", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Plugin:  &frpv1alpha1.FrpProxyPlugin{Name: "socks5"},
+		Options: map[string]string{"remote_port": "1080", "plugin_local_path": "/"},
+	})
+	noBackend := newProxy("no-backend", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Options: map[string]string{"remote_port": "8080"},
+	})
+	visitor := newProxy("visitor", frpv1alpha1.FrpProxySpec{
+		Type:    "stcp",
+		Options: map[string]string{"role": "visitor", "server_name": "postgres", "bind_port": "5432"},
+	})
+	privilegedPort := newProxy("privileged-port", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Plugin:  &frpv1alpha1.FrpProxyPlugin{Name: "socks5"},
+		Options: map[string]string{"remote_port": "80"},
+	})
+	// claims the remote port published by the older postgres service
+	stolenPort := newProxy("stolen-port", frpv1alpha1.FrpProxySpec{
+		Type:    "tcp",
+		Backend: &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromInt(5432)},
+		Options: map[string]string{"remote_port": "5432"},
+	})
+	stolenPort.CreationTimestamp = metav1.NewTime(time.Now().Truncate(time.Second))
+	// joins the load balancing group of another proxy
+	group := newProxy("group", frpv1alpha1.FrpProxySpec{
+		Type:    "http",
+		Backend: &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromInt(5432)},
+		Options: map[string]string{"custom_domains": "example.com", "group": "0123456789abcdef"},
+	})
+	groupKey := newProxy("group-key", frpv1alpha1.FrpProxySpec{
+		Type:          "http",
+		Backend:       &frpv1alpha1.FrpProxyBackend{ServiceName: "postgres", ServicePort: intstr.FromInt(5432)},
+		Options:       map[string]string{"custom_domains": "example.com"},
+		SecretOptions: map[string]corev1.SecretKeySelector{"group_key": {LocalObjectReference: corev1.LocalObjectReference{Name: "postgres-stcp"}, Key: "sk"}},
+	})
+	v1 := "frp-v1"
+	// meta_owner has no path in the frp v1 formats
+	unmapped := newProxy("unmapped", frpv1alpha1.FrpProxySpec{
+		Type:             "tcp",
+		Plugin:           &frpv1alpha1.FrpProxyPlugin{Name: "socks5"},
+		Options:          map[string]string{"remote_port": "1081", "meta_owner": "a"},
+		IngressClassName: &v1,
+	})
+	v1Path := newProxy("v1-path", frpv1alpha1.FrpProxySpec{
+		Type:             "tcp",
+		Plugin:           &frpv1alpha1.FrpProxyPlugin{Name: "socks5"},
+		Options:          map[string]string{"remote_port": "1082", "metadatas.owner": "a"},
+		IngressClassName: &v1,
+	})
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "postgres",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second)),
+			Annotations:       map[string]string{constants.AnnotationRemotePort: "5432"},
+		},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "postgres", Port: 5432}}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "postgres-stcp", Namespace: "default"},
+		Data:       map[string][]byte{"sk": []byte("secret")},
+	}
+	cli, scheme := newFakeClient(t, postgres, socks, missingPort, overridden, noPool, staticFile, localIP, pluginOption, noBackend, visitor,
+		privilegedPort, stolenPort, group, groupKey, unmapped, v1Path, svc, secret)
+
+	syncer := &recordSyncer{proxies: make(map[string]map[string]frp.Config)}
+	v1Syncer := &recordSyncer{proxies: make(map[string]map[string]frp.Config), format: frp.FormatToml}
+	reconciler := NewFrpProxyReconciler(cli, scheme, frp.NewPools(map[string]frp.Syncer{"frp": syncer, v1: v1Syncer}))
+	reconciler.GroupKeys = NewMemoryGroupKeys()
+	reconciler.Plugins = []string{"socks5"}
+	reconciler.PortRange = PortRange{Min: 1024, Max: 65535}
+
+	tests := []struct {
+		proxy      *frpv1alpha1.FrpProxy
+		wantConfig map[string]string
+		wantReason string
+	}{
+		{
+			proxy: postgres,
+			wantConfig: map[string]string{
+				"type": "stcp", "local_ip": "postgres.default.svc.cluster.local", "local_port": "5432", "sk": "secret",
+			},
+			wantReason: constants.ReasonProxyPending,
+		},
+		{
+			proxy: socks,
+			wantConfig: map[string]string{
+				"type": "tcp", "plugin": "socks5", "plugin_user": "admin", "remote_port": "1080",
+			},
+			wantReason: constants.ReasonProxyPending,
+		},
+		{proxy: missingPort, wantReason: constants.ReasonInvalidProxy},
+		{proxy: overridden, wantReason: constants.ReasonInvalidProxy},
+		{proxy: noPool, wantReason: constants.ReasonNoPool},
+		{proxy: staticFile, wantReason: constants.ReasonInvalidProxy},
+		{proxy: localIP, wantReason: constants.ReasonInvalidProxy},
+		{proxy: pluginOption, wantReason: constants.ReasonInvalidProxy},
+		{proxy: noBackend, wantReason: constants.ReasonInvalidProxy},
+		{
+			proxy: visitor,
+			wantConfig: map[string]string{
+				"type": "stcp", "role": "visitor", "server_name": "postgres", "bind_port": "5432",
+			},
+			wantReason: constants.ReasonProxyPending,
+		},
+		{proxy: privilegedPort, wantReason: constants.ReasonInvalidProxy},
+		{proxy: stolenPort, wantReason: constants.ReasonRemotePortConflict},
+		{proxy: group, wantReason: constants.ReasonInvalidProxy},
+		{proxy: groupKey, wantReason: constants.ReasonInvalidProxy},
+		{proxy: unmapped, wantReason: constants.ReasonInvalidProxy},
+		{
+			proxy: v1Path,
+			wantConfig: map[string]string{
+				"type": "tcp", "plugin": "socks5", "remote_port": "1082", "metadatas.owner": "a",
+			},
+			wantReason: constants.ReasonProxyPending,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy.Name, func(t *testing.T) {
+			key := client.ObjectKeyFromObject(tt.proxy)
+			if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			proxies := syncer.proxies[frpProxyKey(key.String())]
+			if tt.proxy.Spec.IngressClassName != nil && *tt.proxy.Spec.IngressClassName == v1 {
+				proxies = v1Syncer.proxies[frpProxyKey(key.String())]
+			}
+			if tt.wantConfig == nil {
+				if len(proxies) != 0 {
+					t.Errorf("unexpected proxies %v", proxies)
+				}
+			} else {
+				cfg, ok := proxies[frpProxyName(tt.proxy)]
+				if !ok {
+					t.Fatalf("proxy %s not set: %v", frpProxyName(tt.proxy), proxies)
+				}
+				got := cfg.ToMap()
+				delete(got, "group")
+				delete(got, "group_key")
+				if !equality.Semantic.DeepEqual(got, tt.wantConfig) {
+					t.Errorf("config = %v, want %v", got, tt.wantConfig)
+				}
+				if wantGroup := tt.proxy.Spec.Type == frp.TypeTcp; cfg.EnableGroup() != wantGroup {
+					t.Errorf("group enabled = %v, want %v", cfg.EnableGroup(), wantGroup)
+				}
+			}
+
+			var got frpv1alpha1.FrpProxy
+			if err := cli.Get(context.Background(), key, &got); err != nil {
+				t.Fatal(err)
+			}
+			if cond := meta.FindStatusCondition(got.Status.Conditions, constants.ConditionReady); cond == nil || cond.Reason != tt.wantReason {
+				t.Errorf("condition = %v, want reason %s", cond, tt.wantReason)
+			}
+		})
+	}
+
+	// the collector reports the live state of the configured proxies and leaves the invalid ones
+	key := frpProxyKey("default/postgres")
+	collector := NewIngressStatusCollector(cli, nil, frp.NewPools(map[string]frp.Syncer{"frp": &statusSyncer{status: map[string][]frp.ProxyStatus{
+		key: {{Name: "default/postgres:stcp", Status: frp.ProxyPhaseRunning, Client: "10.0.0.1:7400"}},
+	}}}))
+	collector.Collect(context.Background())
+	for name, wantReason := range map[string]string{
+		"postgres":     constants.ReasonProxyRunning,
+		"socks":        constants.ReasonNoProxy,
+		"missing-port": constants.ReasonInvalidProxy,
+		"stolen-port":  constants.ReasonRemotePortConflict,
+	} {
+		var got frpv1alpha1.FrpProxy
+		if err := cli.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: name}, &got); err != nil {
+			t.Fatal(err)
+		}
+		if cond := meta.FindStatusCondition(got.Status.Conditions, constants.ConditionReady); cond == nil || cond.Reason != wantReason {
+			t.Errorf("%s: condition = %v, want reason %s", name, cond, wantReason)
+		}
+		if name == "postgres" && (len(got.Status.Proxies) != 1 || got.Status.Proxies[0].Client != "10.0.0.1:7400") {
+			t.Errorf("%s: proxies = %v", name, got.Status.Proxies)
+		}
+	}
+
+	// a service requeues the FrpProxies of its namespace using it as backend and the FrpProxies claiming one of its
+	// remote ports, a FrpProxy the other FrpProxies claiming its remote port
+	socksService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "socks", Namespace: "other", Annotations: map[string]string{constants.AnnotationRemotePort: "1080"}},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "socks", Port: 1080}}},
+	}
+	if reqs := reconciler.serviceMapFunc(socksService); len(reqs) != 1 || reqs[0].Name != "socks" {
+		t.Errorf("service requeued %v, want the socks FrpProxy", reqs)
+	}
+	if reqs := reconciler.claimMapFunc(newProxy("socks-copy", socks.Spec)); len(reqs) != 1 || reqs[0].Name != "socks" {
+		t.Errorf("FrpProxy requeued %v, want the socks FrpProxy", reqs)
+	}
+	if reqs := reconciler.claimMapFunc(socks); len(reqs) != 0 {
+		t.Errorf("FrpProxy requeued %v, want none", reqs)
+	}
+
+	// deleting the FrpProxy removes its proxy
+	if err := cli.Delete(context.Background(), socks); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: client.ObjectKeyFromObject(socks)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := syncer.proxies[frpProxyKey("default/socks")]; ok {
+		t.Error("proxy of the deleted FrpProxy not removed")
+	}
+}
@@ -0,0 +1,307 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GroupKeys hands out the keys of the frp load balancing groups. frps lets any client knowing the name and the key of
+// a group join it, so the keys are random rather than derived from the public group names, and kept in a Secret owned
+// by the controller so that they survive restarts.
+// Deleting the Secret, or some of its keys, rotates the keys: the subscribed reconcilers are requeued and push the new
+// keys to the frp clients one after the other, the clients still holding the old key serve the group meanwhile.
+type GroupKeys struct {
+	client.Client
+	// APIReader reads the Secret from the api server, so that concurrent updates of the keys conflict
+	APIReader client.Reader
+	// Secret is the Secret holding the keys, by group name
+	Secret types.NamespacedName
+	// Pools are the syncers whose proxies use the keys, the keys of the groups none of their proxies use are pruned.
+	// Nothing is pruned if nil.
+	Pools *frp.Pools
+
+	keys        map[string]string
+	subscribers []chan event.GenericEvent
+	mu          sync.Mutex
+}
+
+func NewGroupKeys(client client.Client, secret types.NamespacedName) *GroupKeys {
+	return &GroupKeys{
+		Client: client,
+		Secret: secret,
+		keys:   make(map[string]string),
+	}
+}
+
+// NewMemoryGroupKeys returns GroupKeys keeping random keys in memory only, for tests and offline rendering. Its keys
+// do not survive the process, it must not be set up with a manager.
+func NewMemoryGroupKeys() *GroupKeys {
+	return &GroupKeys{keys: make(map[string]string)}
+}
+
+// ParseNamespacedName parses a namespace/name
+func ParseNamespacedName(s string) (types.NamespacedName, error) {
+	split := strings.Split(s, "/")
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("invalid namespace/name: %q", s)
+	}
+	return types.NamespacedName{Namespace: split[0], Name: split[1]}, nil
+}
+
+// Subscribe returns the events sent when the keys are rotated, to be watched by a reconciler which then requeues
+// every object it configures groups for
+func (g *GroupKeys) Subscribe() <-chan event.GenericEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ch := make(chan event.GenericEvent)
+	g.subscribers = append(g.subscribers, ch)
+	return ch
+}
+
+// Group returns the name and the key of the load balancing group of a proxy. The name is derived from the proxy, the
+// key is random.
+func (g *GroupKeys) Group(ctx context.Context, name string, proxyType string) (string, string, error) {
+	if g == nil {
+		return "", "", fmt.Errorf("no group keys to configure the load balancing group of proxy %s", name)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", name, proxyType)))
+	group := fmt.Sprintf("%x", sum[:8])
+	key, err := g.key(ctx, group)
+	if err != nil {
+		return "", "", err
+	}
+	return group, key, nil
+}
+
+// key returns the key of the group, a new group gets a random key which is added to the Secret
+func (g *GroupKeys) key(ctx context.Context, group string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if key, ok := g.keys[group]; ok {
+		return key, nil
+	}
+	if g.Client == nil {
+		key, err := randomKey()
+		if err != nil {
+			return "", fmt.Errorf("get key of group %s: %w", group, err)
+		}
+		g.keys[group] = key
+		return key, nil
+	}
+	var key string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var secret corev1.Secret
+		if err := g.reader().Get(ctx, g.Secret, &secret); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			if key, err = randomKey(); err != nil {
+				return err
+			}
+			secret = corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: g.Secret.Namespace, Name: g.Secret.Name},
+				Type:       corev1.SecretTypeOpaque,
+				Data:       map[string][]byte{group: []byte(key)},
+			}
+			err = g.Create(ctx, &secret)
+			if apierrors.IsAlreadyExists(err) {
+				// created concurrently, read it again
+				return apierrors.NewConflict(corev1.Resource("secrets"), g.Secret.Name, err)
+			}
+			return err
+		}
+		if data, ok := secret.Data[group]; ok {
+			key = string(data)
+			return nil
+		}
+		var err error
+		if key, err = randomKey(); err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[group] = []byte(key)
+		return g.Update(ctx, &secret)
+	})
+	if err != nil {
+		return "", fmt.Errorf("get key of group %s: %w", group, err)
+	}
+	g.keys[group] = key
+	return key, nil
+}
+
+func randomKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (g *GroupKeys) reader() client.Reader {
+	if g.APIReader != nil {
+		return g.APIReader
+	}
+	return g.Client
+}
+
+// Reconcile reloads the keys when the Secret changes, the subscribers are notified when a key in use was removed
+// or changed
+func (g *GroupKeys) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var secret corev1.Secret
+	if err := g.reader().Get(ctx, g.Secret, &secret); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+
+	g.mu.Lock()
+	var rotated []string
+	for group, key := range g.keys {
+		if string(secret.Data[group]) != key {
+			rotated = append(rotated, group)
+		}
+	}
+	g.keys = make(map[string]string, len(secret.Data))
+	for group, key := range secret.Data {
+		g.keys[group] = string(key)
+	}
+	subscribers := make([]chan event.GenericEvent, len(g.subscribers))
+	copy(subscribers, g.subscribers)
+	g.mu.Unlock()
+
+	if len(rotated) == 0 {
+		return ctrl.Result{}, nil
+	}
+	l.Info("group keys rotated", "groups", len(rotated))
+	for _, ch := range subscribers {
+		select {
+		case ch <- event.GenericEvent{Object: &secret}:
+		case <-ctx.Done():
+			return ctrl.Result{}, ctx.Err()
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// Prune removes from the Secret the keys of the groups which were unused at the previous prune and still are, and
+// returns the unused groups. A group unused once is kept, its proxies may not be set yet after a restart.
+func (g *GroupKeys) Prune(ctx context.Context, unused map[string]bool) (map[string]bool, error) {
+	if g.Pools == nil {
+		return nil, nil
+	}
+	inUse := g.Pools.Groups()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var pruned []string
+	var next map[string]bool
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var secret corev1.Secret
+		if err := g.reader().Get(ctx, g.Secret, &secret); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		pruned = pruned[:0]
+		next = make(map[string]bool)
+		for group := range secret.Data {
+			if inUse[group] {
+				continue
+			}
+			next[group] = true
+			if unused[group] {
+				pruned = append(pruned, group)
+				delete(secret.Data, group)
+			}
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		return g.Update(ctx, &secret)
+	})
+	if err != nil {
+		return unused, fmt.Errorf("prune group keys: %w", err)
+	}
+	for _, group := range pruned {
+		delete(g.keys, group)
+		delete(next, group)
+	}
+	if len(pruned) > 0 {
+		log.FromContext(ctx).Info("group keys pruned", "groups", len(pruned))
+	}
+	return next, nil
+}
+
+// prune prunes the keys every FrpGroupKeyPruneInterval
+func (g *GroupKeys) prune(ctx context.Context) error {
+	ticker := time.NewTicker(constants.FrpGroupKeyPruneInterval)
+	defer ticker.Stop()
+	var unused map[string]bool
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		var err error
+		if unused, err = g.Prune(ctx, unused); err != nil {
+			log.FromContext(ctx).Error(err, "prune group keys error")
+		}
+	}
+}
+
+// SetupWithManager watches the Secret through a cache of its own, the Secret usually lives in the namespace of the
+// controller which may be out of the watched namespaces
+func (g *GroupKeys) SetupWithManager(mgr ctrl.Manager) error {
+	if g.APIReader == nil {
+		g.APIReader = mgr.GetAPIReader()
+	}
+	secretCache, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:    mgr.GetScheme(),
+		Mapper:    mgr.GetRESTMapper(),
+		Namespace: g.Secret.Namespace,
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Secret{}: {Field: fields.OneTermEqualSelector("metadata.name", g.Secret.Name)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := mgr.Add(secretCache); err != nil {
+		return err
+	}
+	c, err := controller.New("groupkeys", mgr, controller.Options{Reconciler: g})
+	if err != nil {
+		return err
+	}
+	if g.Pools != nil {
+		if err := mgr.Add(manager.RunnableFunc(g.prune)); err != nil {
+			return err
+		}
+	}
+	return c.Watch(source.NewKindWithCache(&corev1.Secret{}, secretCache), &handler.EnqueueRequestForObject{})
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"context"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	controllerruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestGroupKeys(t *testing.T) {
+	var service corev1.Service
+	if err := yaml.Unmarshal([]byte(YamlServiceStr), &service); err != nil {
+		t.Fatal(err)
+	}
+	var ingress networkingv1.Ingress
+	if err := yaml.Unmarshal([]byte(YamlIngressStr), &ingress); err != nil {
+		t.Fatal(err)
+	}
+	cli, scheme := newFakeClient(t, &ingress, &service)
+
+	secretKey := client.ObjectKey{Namespace: "ingress-frp-system", Name: "ingress-frp-group-keys"}
+	syncer := &recordSyncer{proxies: make(map[string]map[string]frp.Config)}
+	reconciler := NewFrpIngressReconciler(cli, scheme, frp.NewPools(map[string]frp.Syncer{constants.IngressClassName: syncer}))
+	key := client.ObjectKeyFromObject(&ingress)
+
+	// the keys can not be derived from the public group names
+	if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: key}); err == nil {
+		t.Error("proxies grouped without group keys")
+	}
+	memoryKeys := NewMemoryGroupKeys()
+	group, groupKey, err := memoryKeys.Group(context.Background(), "default/web", frp.TypeHttp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, again, _ := memoryKeys.Group(context.Background(), "default/web", frp.TypeHttp); again != groupKey {
+		t.Error("memory group key not kept")
+	}
+	if _, other, _ := NewMemoryGroupKeys().Group(context.Background(), "default/web", frp.TypeHttp); other == groupKey || len(groupKey) != 64 {
+		t.Errorf("memory group key %s of group %s is not random", groupKey, group)
+	}
+
+	reconciler.GroupKeys = NewGroupKeys(cli, secretKey)
+	reconcileKeys := func() map[string]string {
+		t.Helper()
+		if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		keys := make(map[string]string)
+		for name, cfg := range syncer.proxies[key.String()] {
+			m := cfg.ToMap()
+			if m["group"] == "" || len(m["group_key"]) != 64 {
+				t.Fatalf("proxy %s has no group key: %v", name, m)
+			}
+			keys[m["group"]] = m["group_key"]
+		}
+		return keys
+	}
+
+	keys := reconcileKeys()
+	if len(keys) == 0 {
+		t.Fatal("no group configured")
+	}
+	var secret corev1.Secret
+	if err := cli.Get(context.Background(), secretKey, &secret); err != nil {
+		t.Fatal(err)
+	}
+	for group, groupKey := range keys {
+		if string(secret.Data[group]) != groupKey {
+			t.Errorf("key of group %s is not kept in the secret", group)
+		}
+	}
+
+	// the keys survive a restart of the controller
+	reconciler.GroupKeys = NewGroupKeys(cli, secretKey)
+	events := reconciler.GroupKeys.Subscribe()
+	if again := reconcileKeys(); !equality.Semantic.DeepEqual(keys, again) {
+		t.Errorf("keys changed across reconciles: %v, %v", keys, again)
+	}
+
+	// deleting the secret rotates the keys
+	if err := cli.Delete(context.Background(), &secret); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := reconciler.GroupKeys.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: secretKey})
+		errs <- err
+	}()
+	select {
+	case <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("rotation not notified")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	rotated := reconcileKeys()
+	for group, groupKey := range rotated {
+		if keys[group] == groupKey {
+			t.Errorf("key of group %s not rotated", group)
+		}
+	}
+
+	// the keys of the groups no proxy uses are pruned once found unused twice
+	pruneSyncer := frp.NewFakeSyncer()
+	pruneSyncer.SetProxies(key.String(), syncer.proxies[key.String()])
+	reconciler.GroupKeys.Pools = frp.NewPools(map[string]frp.Syncer{constants.IngressClassName: pruneSyncer})
+	if err := cli.Get(context.Background(), secretKey, &secret); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data["deleted-proxy"] = []byte("key")
+	if err := cli.Update(context.Background(), &secret); err != nil {
+		t.Fatal(err)
+	}
+	unused, err := reconciler.GroupKeys.Prune(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(unused, map[string]bool{"deleted-proxy": true}) {
+		t.Errorf("unused groups = %v", unused)
+	}
+	if _, err := reconciler.GroupKeys.Prune(context.Background(), unused); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Get(context.Background(), secretKey, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["deleted-proxy"]; ok {
+		t.Error("key of the unused group not pruned")
+	}
+	for group, groupKey := range rotated {
+		if string(secret.Data[group]) != groupKey {
+			t.Errorf("key of group %s in use pruned", group)
+		}
+	}
+}
@@ -1,18 +1,27 @@
 package controllers
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
 	"github.com/grydovee/ingress-frp/pkg/constants"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"strconv"
+	"sync"
+	"unicode/utf8"
 )
 
-func IngressMatch(ingress *networkingv1.Ingress) bool {
+// IngressClassName returns the class of the ingress, set by spec.ingressClassName or the legacy annotation.
+// An ingress with conflicting values has no class.
+func IngressClassName(ingress *networkingv1.Ingress) string {
 	if ingress == nil {
-		return false
+		return ""
 	}
 	var ingressClassName string
 	ingressClassName = ingress.Annotations[constants.AnnotationIngressClass]
@@ -21,16 +30,146 @@ func IngressMatch(ingress *networkingv1.Ingress) bool {
 		if len(ingressClassName) == 0 {
 			ingressClassName = *ingress.Spec.IngressClassName
 		} else if *ingress.Spec.IngressClassName != ingressClassName {
-			return false
+			return ""
 		}
 	}
-	return ingressClassName == constants.IngressClassName
+	return ingressClassName
+}
+
+// ResolveIngressClassName returns the class of the ingress like IngressClassName,
+// an ingress setting neither spec.ingressClassName nor the legacy annotation belongs to the default class
+func ResolveIngressClassName(ingress *networkingv1.Ingress, defaultClass string) string {
+	if ingress == nil {
+		return ""
+	}
+	if _, ok := ingress.Annotations[constants.AnnotationIngressClass]; !ok && ingress.Spec.IngressClassName == nil {
+		return defaultClass
+	}
+	return IngressClassName(ingress)
+}
+
+// IngressMatch reports whether the ingress belongs to one of the classes, class-less ingresses belong to the default class
+func IngressMatch(ingress *networkingv1.Ingress, defaultClass string, classNames ...string) bool {
+	ingressClassName := ResolveIngressClassName(ingress, defaultClass)
+	if ingressClassName == "" {
+		return false
+	}
+	for _, name := range classNames {
+		if name == ingressClassName {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultIngressClass holds the IngressClass of the controller marked as the cluster default
+type DefaultIngressClass struct {
+	name string
+	mu   sync.RWMutex
+}
+
+// Get returns the default class, "" if none of the classes of the controller is the default
+func (d *DefaultIngressClass) Get() string {
+	if d == nil {
+		return ""
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.name
+}
+
+// Set sets the default class and reports whether it changed
+func (d *DefaultIngressClass) Set(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.name == name {
+		return false
+	}
+	d.name = name
+	return true
+}
+
+// IngressClassParameters returns the FrpIngressClassParameters referenced by the IngressClass,
+// nil if the class references no parameters or parameters of another kind
+func IngressClassParameters(ctx context.Context, c client.Reader, class *networkingv1.IngressClass) (*frpv1alpha1.FrpIngressClassParameters, error) {
+	if !referencesParameters(class) {
+		return nil, nil
+	}
+	var params frpv1alpha1.FrpIngressClassParameters
+	if err := c.Get(ctx, types.NamespacedName{Name: class.Spec.Parameters.Name}, &params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func referencesParameters(class *networkingv1.IngressClass) bool {
+	ref := class.Spec.Parameters
+	if ref == nil || ref.APIGroup == nil || *ref.APIGroup != frpv1alpha1.GroupVersion.Group || ref.Kind != "FrpIngressClassParameters" {
+		return false
+	}
+	return ref.Scope == nil || *ref.Scope == networkingv1.IngressClassParametersReferenceScopeCluster
 }
 
-func GenerateGroup(name, proxyType string) (string, string) {
-	hashKey := fmt.Sprintf("%s/%s", name, proxyType)
-	bytes := sha256.Sum256([]byte(hashKey))
-	return fmt.Sprintf("%x", bytes[:8]), fmt.Sprintf("%x", bytes[:])
+// withDefaultAnnotations returns the annotations of the ingress completed with the defaults it does not set
+func withDefaultAnnotations(annotations, defaults map[string]string) map[string]string {
+	res := make(map[string]string, len(annotations)+len(defaults))
+	for k, v := range defaults {
+		res[k] = v
+	}
+	for k, v := range annotations {
+		res[k] = v
+	}
+	return res
+}
+
+// statusOnlyChanged reports whether an update only touched the status annotation written by the IngressStatusCollector
+func statusOnlyChanged(oldIngress, newIngress *networkingv1.Ingress) bool {
+	if oldIngress.Generation != newIngress.Generation ||
+		!equality.Semantic.DeepEqual(oldIngress.Labels, newIngress.Labels) ||
+		!equality.Semantic.DeepEqual(oldIngress.DeletionTimestamp, newIngress.DeletionTimestamp) {
+		return false
+	}
+	oldAnnotations := make(map[string]string, len(oldIngress.Annotations))
+	for k, v := range oldIngress.Annotations {
+		oldAnnotations[k] = v
+	}
+	newAnnotations := make(map[string]string, len(newIngress.Annotations))
+	for k, v := range newIngress.Annotations {
+		newAnnotations[k] = v
+	}
+	if oldAnnotations[constants.AnnotationStatus] == newAnnotations[constants.AnnotationStatus] {
+		return false
+	}
+	delete(oldAnnotations, constants.AnnotationStatus)
+	delete(newAnnotations, constants.AnnotationStatus)
+	return equality.Semantic.DeepEqual(oldAnnotations, newAnnotations)
+}
+
+// ingressProxyName names the proxies of a path of an ingress rule after the host and the path, so that the paths of an
+// ingress never share a proxy, even when they point at the same service
+func ingressProxyName(ingress *networkingv1.Ingress, host string, path string) string {
+	if host == "" {
+		host = "*"
+	}
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s/%s/%s%s", ingress.Namespace, ingress.Name, host, path)
+}
+
+// shortenProxyName bounds a proxy name to constants.ProxyNameMaxLength, a longer name is cut and suffixed with a hash
+// of the full name, so that it stays unique and does not change across reconciles
+func shortenProxyName(name string) string {
+	if len(name) <= constants.ProxyNameMaxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := fmt.Sprintf("%x", sum[:8])
+	cut := constants.ProxyNameMaxLength - len(hash) - 1
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + "~" + hash
 }
 
 func base64Encode(data []byte) string {
@@ -4,14 +4,17 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
 	"github.com/grydovee/ingress-frp/pkg/constants"
 	"github.com/grydovee/ingress-frp/pkg/frp"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/utils/clock"
+	"net"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -29,14 +32,25 @@ type FrpIngressReconciler struct {
 	Scheme *runtime.Scheme
 	clock.Clock
 
-	FrpSyncer frp.Syncer
+	// Pools are the syncers of the frp client pools, keyed by the IngressClass they serve
+	Pools *frp.Pools
+	// ClassEvents requeues the ingresses of an IngressClass whose parameters changed
+	ClassEvents <-chan event.GenericEvent
+	// DefaultClass is the class of the ingresses setting no class
+	DefaultClass *DefaultIngressClass
+	// Scope restricts the served ingresses, nil serves every ingress
+	Scope *Scope
+	// APIReader reads the TLS secrets from the api server, secrets are only cached as metadata
+	APIReader client.Reader
+	// GroupKeys are the keys of the load balancing groups, required to configure grouped proxies
+	GroupKeys *GroupKeys
 }
 
-func NewFrpIngressReconciler(client client.Client, scheme *runtime.Scheme, frpSyncer frp.Syncer) *FrpIngressReconciler {
+func NewFrpIngressReconciler(client client.Client, scheme *runtime.Scheme, pools *frp.Pools) *FrpIngressReconciler {
 	return &FrpIngressReconciler{
-		Client:    client,
-		Scheme:    scheme,
-		FrpSyncer: frpSyncer,
+		Client: client,
+		Scheme: scheme,
+		Pools:  pools,
 	}
 }
 
@@ -52,16 +66,29 @@ func (r *FrpIngressReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	var ingress networkingv1.Ingress
 	if err := r.Get(ctx, req.NamespacedName, &ingress); err != nil {
 		if apierrors.IsNotFound(err) {
-			r.FrpSyncer.DeleteProxies(req.String())
+			r.deleteProxies(req.String(), "")
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
 
-	if !ingress.DeletionTimestamp.IsZero() {
-		r.FrpSyncer.DeleteProxies(req.String())
+	className := ResolveIngressClassName(&ingress, r.DefaultClass.Get())
+	frpSyncer, ok := r.Pools.Get(className)
+	if !ingress.DeletionTimestamp.IsZero() || !ok || !r.Scope.Contains(&ingress) {
+		r.deleteProxies(req.String(), "")
 		return ctrl.Result{}, nil
 	}
+	// the ingress may have moved from another class
+	r.deleteProxies(req.String(), className)
+
+	params, err := r.classParameters(ctx, className)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	annotations := ingress.Annotations
+	if params != nil {
+		annotations = withDefaultAnnotations(ingress.Annotations, params.Spec.DefaultAnnotations)
+	}
 
 	cfgs := make(map[string]frp.Config)
 
@@ -100,16 +127,16 @@ func (r *FrpIngressReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				cfg.Host = rule.Host
 				cfg.LocalIp = svcToDomain(&svc)
 				cfg.Locations = path.Path
-				name := fmt.Sprintf("%s/%s/%s", ingress.Namespace, ingress.Name, svc.Name)
-				if h, ok := ingress.Annotations[constants.AnnotationHostHeaderRewrite]; ok {
+				name := ingressProxyName(&ingress, rule.Host, path.Path)
+				if h, ok := annotations[constants.AnnotationHostHeaderRewrite]; ok {
 					cfg.HostHeaderRewrite = h
 				}
-				if f, ok := ingress.Annotations[constants.AnnotationHeaderXFromWhere]; ok {
+				if f, ok := annotations[constants.AnnotationHeaderXFromWhere]; ok {
 					cfg.HeaderXFromWhere = f
 				} else {
 					cfg.HeaderXFromWhere = "frp-ingress"
 				}
-				if a, ok := ingress.Annotations[constants.AnnotationBasicAuth]; ok {
+				if a, ok := annotations[constants.AnnotationBasicAuth]; ok {
 					split := strings.Split(a, ":")
 					if len(split) != 2 {
 						l.Info("invalid annotation basic-auth", "key", key)
@@ -120,32 +147,40 @@ func (r *FrpIngressReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				}
 				if tls, ok := tlsMap[rule.Host]; ok && path.Path == "/" {
 					// https
-					if ingress.Annotations[constants.AnnotationBackendProtocol] == "https" {
+					if annotations[constants.AnnotationBackendProtocol] == "https" {
 						httpsCfg := &frp.ServerHttps2HttpsConfig{
 							HttpConfig: cfg,
 							TlsCrt:     tls.crtBase64,
 							TlsKey:     tls.keyBase64,
 						}
-						httpsCfg.Group, httpsCfg.GroupKey = GenerateGroup(name, "server_https")
-						cfgs[name+":https"] = httpsCfg
+						if httpsCfg.Group, httpsCfg.GroupKey, err = r.GroupKeys.Group(ctx, name, "server_https"); err != nil {
+							return ctrl.Result{}, err
+						}
+						cfgs[shortenProxyName(name+":https")] = httpsCfg
 					} else {
 						httpsCfg := &frp.ServerHttpsConfig{
 							HttpConfig: cfg,
 							TlsCrt:     tls.crtBase64,
 							TlsKey:     tls.keyBase64,
 						}
-						httpsCfg.Group, httpsCfg.GroupKey = GenerateGroup(name, "server_https")
-						cfgs[name+":https"] = httpsCfg
+						if httpsCfg.Group, httpsCfg.GroupKey, err = r.GroupKeys.Group(ctx, name, "server_https"); err != nil {
+							return ctrl.Result{}, err
+						}
+						cfgs[shortenProxyName(name+":https")] = httpsCfg
 					}
 					// http redirect
 					httpCfg := cfg
 					httpCfg.Redirect = fmt.Sprintf("https://%s:443", httpCfg.Host)
-					httpCfg.Group, httpCfg.GroupKey = GenerateGroup(name, "http")
-					cfgs[name+":http"] = &httpCfg
+					if httpCfg.Group, httpCfg.GroupKey, err = r.GroupKeys.Group(ctx, name, "http"); err != nil {
+						return ctrl.Result{}, err
+					}
+					cfgs[shortenProxyName(name+":http")] = &httpCfg
 				} else {
 					// http
-					cfg.Group, cfg.GroupKey = GenerateGroup(name, "http")
-					cfgs[name+":http"] = &cfg
+					if cfg.Group, cfg.GroupKey, err = r.GroupKeys.Group(ctx, name, "http"); err != nil {
+						return ctrl.Result{}, err
+					}
+					cfgs[shortenProxyName(name+":http")] = &cfg
 				}
 			default:
 				l.Info("unsupported service type", "key", key)
@@ -154,18 +189,68 @@ func (r *FrpIngressReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 
 	l.Info("update frp config", "cfgs", fmt.Sprintf("%v", cfgs))
-	r.FrpSyncer.SetProxies(req.String(), cfgs)
+	frpSyncer.SetProxies(req.String(), cfgs)
+
+	if params != nil && params.Spec.FrpsAddress != "" {
+		if err := r.updateLoadBalancerStatus(ctx, &ingress, params.Spec.FrpsAddress); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 	return ctrl.Result{}, nil
 }
 
+// deleteProxies deletes the proxies of the ingress from every syncer except the one of the given class
+func (r *FrpIngressReconciler) deleteProxies(key string, exceptClass string) {
+	for className, frpSyncer := range r.Pools.Syncers() {
+		if className != exceptClass {
+			frpSyncer.DeleteProxies(key)
+		}
+	}
+}
+
+// classParameters returns the parameters of the IngressClass, nil if the class is not served with parameters
+func (r *FrpIngressReconciler) classParameters(ctx context.Context, className string) (*frpv1alpha1.FrpIngressClassParameters, error) {
+	var class networkingv1.IngressClass
+	if err := r.Get(ctx, types.NamespacedName{Name: className}, &class); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if class.Spec.Controller != constants.ControllerName {
+		return nil, nil
+	}
+	return IngressClassParameters(ctx, r.Client, &class)
+}
+
+// updateLoadBalancerStatus publishes the frps address in the load balancer status of the ingress
+func (r *FrpIngressReconciler) updateLoadBalancerStatus(ctx context.Context, ingress *networkingv1.Ingress, frpsAddress string) error {
+	lb := corev1.LoadBalancerIngress{Hostname: frpsAddress}
+	if net.ParseIP(frpsAddress) != nil {
+		lb = corev1.LoadBalancerIngress{IP: frpsAddress}
+	}
+	want := []corev1.LoadBalancerIngress{lb}
+	if equality.Semantic.DeepEqual(ingress.Status.LoadBalancer.Ingress, want) {
+		return nil
+	}
+	patch := client.MergeFrom(ingress.DeepCopy())
+	ingress.Status.LoadBalancer.Ingress = want
+	return r.Status().Patch(ctx, ingress, patch)
+}
+
+// match reports whether the ingress is in the scope and belongs to a class served by the pools
+func (r *FrpIngressReconciler) match(ingress *networkingv1.Ingress) bool {
+	return r.Scope.Contains(ingress) && IngressMatch(ingress, r.DefaultClass.Get(), r.Pools.ClassNames()...)
+}
+
 func (r *FrpIngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// set up a real clock, since we're not in a test
 	if r.Clock == nil {
 		r.Clock = clock.RealClock{}
 	}
 
-	if r.FrpSyncer == nil {
-		r.FrpSyncer = frp.NewFakeSyncer()
+	if r.Pools == nil {
+		r.Pools = frp.NewPools(map[string]frp.Syncer{constants.IngressClassName: frp.NewFakeSyncer()})
+	}
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
 	}
 
 	// UAPServic e
@@ -185,21 +270,28 @@ func (r *FrpIngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	bldr := ctrl.NewControllerManagedBy(mgr)
+	if r.ClassEvents != nil {
+		bldr = bldr.Watches(&source.Channel{Source: r.ClassEvents}, &handler.EnqueueRequestForObject{})
+	}
+	if r.GroupKeys != nil {
+		bldr = bldr.Watches(&source.Channel{Source: r.GroupKeys.Subscribe()}, handler.EnqueueRequestsFromMapFunc(r.groupKeysMapFunc))
+	}
+	return bldr.
 		For(&networkingv1.Ingress{}, builder.WithPredicates(predicate.Funcs{
 			CreateFunc: func(event event.CreateEvent) bool {
 				ingress, ok := event.Object.(*networkingv1.Ingress)
 				if !ok {
 					return false
 				}
-				return IngressMatch(ingress)
+				return r.match(ingress)
 			},
 			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
 				ingress, ok := deleteEvent.Object.(*networkingv1.Ingress)
 				if !ok {
 					return false
 				}
-				return IngressMatch(ingress)
+				return r.match(ingress)
 			},
 			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
 				ingressNew, ok := updateEvent.ObjectNew.(*networkingv1.Ingress)
@@ -210,33 +302,41 @@ func (r *FrpIngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if !ok {
 					return false
 				}
-				return IngressMatch(ingressNew) || IngressMatch(ingressOld)
+				if statusOnlyChanged(ingressOld, ingressNew) {
+					return false
+				}
+				return r.match(ingressNew) || r.match(ingressOld)
 			},
 			GenericFunc: func(genericEvent event.GenericEvent) bool {
 				ingress, ok := genericEvent.Object.(*networkingv1.Ingress)
 				if !ok {
 					return false
 				}
-				return IngressMatch(ingress)
-			},
-		})).
-		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretMapFunc), builder.WithPredicates(predicate.Funcs{
-			DeleteFunc: func(event event.DeleteEvent) bool {
-				return true
-			},
-			CreateFunc: func(createEvent event.CreateEvent) bool {
-				return true
-			},
-			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
-				return true
-			},
-			GenericFunc: func(genericEvent event.GenericEvent) bool {
-				return false
+				return r.match(ingress)
 			},
 		})).
+		// only the metadata of the secrets is cached, the referenced TLS secrets are read with APIReader
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretMapFunc), builder.OnlyMetadata).
 		Complete(r)
 }
 
+// groupKeysMapFunc requeues every frp ingress when the group keys are rotated
+func (r *FrpIngressReconciler) groupKeysMapFunc(client.Object) []reconcile.Request {
+	var ingressList networkingv1.IngressList
+	if err := r.List(context.Background(), &ingressList); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range ingressList.Items {
+		if r.match(&ingressList.Items[i]) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ingressList.Items[i])})
+		}
+	}
+	return reqs
+}
+
+// secretMapFunc maps a secret to the frp ingresses referencing it as TLS secret
 func (r *FrpIngressReconciler) secretMapFunc(object client.Object) []reconcile.Request {
 	var ingressList networkingv1.IngressList
 	if err := r.List(context.Background(), &ingressList, client.MatchingFields{constants.IndexIngressSecretName: object.GetName()}, client.InNamespace(object.GetNamespace())); client.IgnoreNotFound(err) != nil {
@@ -245,11 +345,20 @@ func (r *FrpIngressReconciler) secretMapFunc(object client.Object) []reconcile.R
 
 	var reqs []reconcile.Request
 	for i := range ingressList.Items {
-		reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ingressList.Items[i])})
+		if r.match(&ingressList.Items[i]) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ingressList.Items[i])})
+		}
 	}
 	return reqs
 }
 
+func (r *FrpIngressReconciler) secretReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
 type tlsCert struct {
 	secretUID string
 	crtBase64 string
@@ -261,7 +370,7 @@ func (r *FrpIngressReconciler) loadTlsSecrets(ctx context.Context, ingress *netw
 	for _, tls := range ingress.Spec.TLS {
 		secret := &corev1.Secret{}
 		key := types.NamespacedName{Name: tls.SecretName, Namespace: ingress.Namespace}
-		if err := r.Get(ctx, key, secret); err != nil {
+		if err := r.secretReader().Get(ctx, key, secret); err != nil {
 			if apierrors.IsNotFound(err) {
 				continue
 			}
@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// IngressClassReconciler serves the IngressClasses of constants.ControllerName whose parameters reference a
+// FrpIngressClassParameters: it applies a pool of frp clients for each of them and requeues their ingresses
+// whenever the class, its parameters or its admin credentials change.
+// It also tracks whether one of the classes is the cluster default, which serves the class-less ingresses.
+type IngressClassReconciler struct {
+	client.Client
+
+	Pools        *frp.Pools
+	DefaultClass *DefaultIngressClass
+	// APIReader reads the referenced secrets from the api server, secrets are only cached as metadata
+	APIReader client.Reader
+	events    chan event.GenericEvent
+}
+
+func NewIngressClassReconciler(client client.Client, pools *frp.Pools) *IngressClassReconciler {
+	return &IngressClassReconciler{
+		Client:       client,
+		Pools:        pools,
+		DefaultClass: &DefaultIngressClass{},
+		events:       make(chan event.GenericEvent),
+	}
+}
+
+// Events are the ingresses to requeue, to be watched by the FrpIngressReconciler
+func (r *IngressClassReconciler) Events() <-chan event.GenericEvent {
+	return r.events
+}
+
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingressclasses,verbs=get;list;watch
+//+kubebuilder:rbac:groups=frp.graydove.cn,resources=frpingressclassparameters,verbs=get;list;watch
+//+kubebuilder:rbac:groups=,resources=secrets,verbs=get;list;watch
+
+func (r *IngressClassReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("Reconciling", "req", req)
+
+	if err := r.updateDefaultClass(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var class networkingv1.IngressClass
+	if err := r.Get(ctx, req.NamespacedName, &class); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		if r.Pools.Remove(req.Name) {
+			return ctrl.Result{}, r.requeueIngresses(ctx, req.Name)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	var params *frpv1alpha1.FrpIngressClassParameters
+	if class.Spec.Controller == constants.ControllerName {
+		var err error
+		if params, err = IngressClassParameters(ctx, r.Client, &class); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if params == nil {
+		removed := r.Pools.Remove(class.Name)
+		if removed || class.Spec.Controller == constants.ControllerName {
+			return ctrl.Result{}, r.requeueIngresses(ctx, class.Name)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	pool, err := r.poolConfig(ctx, class.Name, params)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	changed, err := r.Pools.Apply(pool)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if changed {
+		l.Info("frp pool applied", "ingressClass", class.Name, "addr", pool.Addr, "port", pool.Port)
+	}
+	// the default annotations and the frps address of the parameters apply to every ingress of the class
+	return ctrl.Result{}, r.requeueIngresses(ctx, class.Name)
+}
+
+func (r *IngressClassReconciler) poolConfig(ctx context.Context, className string, params *frpv1alpha1.FrpIngressClassParameters) (frp.PoolConfig, error) {
+	pool := frp.PoolConfig{
+		IngressClass: className,
+		Addr:         params.Spec.Frpc.Addr,
+		Port:         uint16(params.Spec.Frpc.Port),
+		ConfigFormat: params.Spec.Frpc.ConfigFormat,
+	}
+	if ref := params.Spec.Frpc.AdminSecretRef; ref != nil {
+		secret, err := r.getSecret(ctx, ref)
+		if err != nil {
+			return pool, fmt.Errorf("get admin secret of %s: %w", params.Name, err)
+		}
+		pool.Username = string(secret.Data[constants.SecretKeyUsername])
+		pool.Password = string(secret.Data[constants.SecretKeyPassword])
+		pool.Token = string(secret.Data[constants.SecretKeyToken])
+	}
+	common, err := r.commonConfig(ctx, params)
+	if err != nil {
+		return pool, err
+	}
+	pool.Common = common
+	return pool, nil
+}
+
+// commonConfig merges the keys of the common Secret over the [common] keys of the parameters
+func (r *IngressClassReconciler) commonConfig(ctx context.Context, params *frpv1alpha1.FrpIngressClassParameters) (map[string]string, error) {
+	if len(params.Spec.Frpc.Common) == 0 && params.Spec.Frpc.CommonSecretRef == nil {
+		return nil, nil
+	}
+	common := make(map[string]string, len(params.Spec.Frpc.Common))
+	for k, v := range params.Spec.Frpc.Common {
+		common[k] = v
+	}
+	if ref := params.Spec.Frpc.CommonSecretRef; ref != nil {
+		secret, err := r.getSecret(ctx, ref)
+		if err != nil {
+			return common, fmt.Errorf("get common secret of %s: %w", params.Name, err)
+		}
+		for k, v := range secret.Data {
+			common[k] = string(v)
+		}
+	}
+	return common, nil
+}
+
+func (r *IngressClassReconciler) getSecret(ctx context.Context, ref *corev1.SecretReference) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// updateDefaultClass looks for the cluster default IngressClass, the default is ignored if several classes claim it.
+// The class-less ingresses are requeued when the default moves to or away from a class of the controller.
+func (r *IngressClassReconciler) updateDefaultClass(ctx context.Context) error {
+	var classList networkingv1.IngressClassList
+	if err := r.List(ctx, &classList); err != nil {
+		return err
+	}
+	var defaults []*networkingv1.IngressClass
+	for i := range classList.Items {
+		if isDefaultClass(&classList.Items[i]) {
+			defaults = append(defaults, &classList.Items[i])
+		}
+	}
+	var name string
+	if len(defaults) == 1 && ingressClassServed(defaults[0]) {
+		name = defaults[0].Name
+	}
+	if !r.DefaultClass.Set(name) {
+		return nil
+	}
+	log.FromContext(ctx).Info("default ingress class changed", "ingressClass", name)
+	return r.requeueIngresses(ctx, "")
+}
+
+// requeueIngresses requeues the ingresses of the class, an empty class requeues the class-less ingresses
+func (r *IngressClassReconciler) requeueIngresses(ctx context.Context, className string) error {
+	var ingressList networkingv1.IngressList
+	if err := r.List(ctx, &ingressList); err != nil {
+		return err
+	}
+	for i := range ingressList.Items {
+		ingress := &ingressList.Items[i]
+		if className == "" && ResolveIngressClassName(ingress, "") != "" {
+			continue
+		}
+		if className != "" && ResolveIngressClassName(ingress, r.DefaultClass.Get()) != className {
+			continue
+		}
+		select {
+		case r.events <- event.GenericEvent{Object: ingress}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *IngressClassReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.APIReader == nil {
+		r.APIReader = mgr.GetAPIReader()
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&networkingv1.IngressClass{}, builder.WithPredicates(predicate.Funcs{
+			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+				return ingressClassServed(updateEvent.ObjectOld) || ingressClassServed(updateEvent.ObjectNew) ||
+					isDefaultClass(updateEvent.ObjectOld) || isDefaultClass(updateEvent.ObjectNew)
+			},
+			CreateFunc: func(createEvent event.CreateEvent) bool {
+				return ingressClassServed(createEvent.Object) || isDefaultClass(createEvent.Object)
+			},
+			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+				return ingressClassServed(deleteEvent.Object) || isDefaultClass(deleteEvent.Object)
+			},
+			GenericFunc: func(genericEvent event.GenericEvent) bool {
+				return ingressClassServed(genericEvent.Object) || isDefaultClass(genericEvent.Object)
+			},
+		})).
+		Watches(&source.Kind{Type: &frpv1alpha1.FrpIngressClassParameters{}}, handler.EnqueueRequestsFromMapFunc(r.parametersMapFunc)).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.secretMapFunc), builder.OnlyMetadata).
+		Complete(r)
+}
+
+func ingressClassServed(object client.Object) bool {
+	class, ok := object.(*networkingv1.IngressClass)
+	return ok && class.Spec.Controller == constants.ControllerName
+}
+
+func isDefaultClass(object client.Object) bool {
+	_, ok := object.(*networkingv1.IngressClass)
+	return ok && object.GetAnnotations()[networkingv1.AnnotationIsDefaultIngressClass] == "true"
+}
+
+// parametersMapFunc maps FrpIngressClassParameters to the IngressClasses referencing them
+func (r *IngressClassReconciler) parametersMapFunc(object client.Object) []reconcile.Request {
+	var classList networkingv1.IngressClassList
+	if err := r.List(context.Background(), &classList); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range classList.Items {
+		class := &classList.Items[i]
+		if ingressClassServed(class) && referencesParameters(class) && class.Spec.Parameters.Name == object.GetName() {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(class)})
+		}
+	}
+	return reqs
+}
+
+// secretMapFunc maps admin credentials and [common] Secrets to the IngressClasses whose parameters reference them
+func (r *IngressClassReconciler) secretMapFunc(object client.Object) []reconcile.Request {
+	var paramsList frpv1alpha1.FrpIngressClassParametersList
+	if err := r.List(context.Background(), &paramsList); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range paramsList.Items {
+		frpc := paramsList.Items[i].Spec.Frpc
+		for _, ref := range []*corev1.SecretReference{frpc.AdminSecretRef, frpc.CommonSecretRef} {
+			if ref != nil && ref.Namespace == object.GetNamespace() && ref.Name == object.GetName() {
+				reqs = append(reqs, r.parametersMapFunc(&paramsList.Items[i])...)
+				break
+			}
+		}
+	}
+	return reqs
+}
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	controllerruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"testing"
+	"time"
+)
+
+func TestIngressClassReconciler_Reconcile(t *testing.T) {
+	var ingress networkingv1.Ingress
+	if err := yaml.Unmarshal([]byte(YamlIngressStr), &ingress); err != nil {
+		t.Fatal(err)
+	}
+	className := "frp-params"
+	ingress.Spec.IngressClassName = &className
+	var service corev1.Service
+	if err := yaml.Unmarshal([]byte(YamlServiceStr), &service); err != nil {
+		t.Fatal(err)
+	}
+	apiGroup := frpv1alpha1.GroupVersion.Group
+	class := networkingv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: className},
+		Spec: networkingv1.IngressClassSpec{
+			Controller: constants.ControllerName,
+			Parameters: &networkingv1.IngressClassParametersReference{
+				APIGroup: &apiGroup,
+				Kind:     "FrpIngressClassParameters",
+				Name:     "partner",
+			},
+		},
+	}
+	params := frpv1alpha1.FrpIngressClassParameters{
+		ObjectMeta: metav1.ObjectMeta{Name: "partner"},
+		Spec: frpv1alpha1.FrpIngressClassParametersSpec{
+			Frpc: frpv1alpha1.FrpcSpec{
+				Addr:           "partner-frpc.kube-system.svc.cluster.local",
+				AdminSecretRef: &corev1.SecretReference{Namespace: "kube-system", Name: "partner-frpc-admin"},
+			},
+			DefaultAnnotations: map[string]string{
+				constants.AnnotationHeaderXFromWhere: "partner",
+				constants.AnnotationBasicAuth:        "default:default",
+			},
+			FrpsAddress: "203.0.113.10",
+		},
+	}
+	admin := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "partner-frpc-admin"},
+		Data: map[string][]byte{
+			constants.SecretKeyUsername: []byte("admin"),
+			constants.SecretKeyPassword: []byte("secret"),
+		},
+	}
+	cli, scheme := newFakeClient(t, &ingress, &service, &class, &params, &admin)
+
+	pools := frp.NewPools(nil)
+	classReconciler := NewIngressClassReconciler(cli, pools)
+	requeued := make(chan client.ObjectKey, 1)
+	go func() {
+		for e := range classReconciler.Events() {
+			requeued <- client.ObjectKeyFromObject(e.Object)
+		}
+	}()
+	classReq := controllerruntime.Request{NamespacedName: client.ObjectKeyFromObject(&class)}
+	if _, err := classReconciler.Reconcile(context.Background(), classReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pools.Get(className); !ok {
+		t.Fatalf("no pool applied for %s", className)
+	}
+	select {
+	case key := <-requeued:
+		if key != client.ObjectKeyFromObject(&ingress) {
+			t.Errorf("requeued %s, want %s", key, client.ObjectKeyFromObject(&ingress))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ingress of the class not requeued")
+	}
+
+	// the ingress is reconciled with the defaults of the parameters
+	syncer := &recordSyncer{proxies: make(map[string]map[string]frp.Config)}
+	reconciler := NewFrpIngressReconciler(cli, scheme, frp.NewPools(map[string]frp.Syncer{className: syncer}))
+	reconciler.GroupKeys = NewMemoryGroupKeys()
+	key := client.ObjectKeyFromObject(&ingress)
+	if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, ok := syncer.proxies[key.String()]["default/gitea-ingress/gitea.example.com/:http"].(*frp.HttpConfig)
+	if !ok {
+		t.Fatalf("http proxy not set: %v", syncer.proxies[key.String()])
+	}
+	if cfg.HeaderXFromWhere != "partner" {
+		t.Errorf("header_X-From-Where = %s, want the default partner", cfg.HeaderXFromWhere)
+	}
+	if cfg.HttpUser != "username" {
+		t.Errorf("http_user = %s, want the annotation of the ingress", cfg.HttpUser)
+	}
+	var current networkingv1.Ingress
+	if err := cli.Get(context.Background(), key, &current); err != nil {
+		t.Fatal(err)
+	}
+	if lb := current.Status.LoadBalancer.Ingress; len(lb) != 1 || lb[0].IP != "203.0.113.10" {
+		t.Errorf("load balancer status = %v, want the frps address", lb)
+	}
+
+	// deleting the class removes its pool
+	if err := cli.Delete(context.Background(), &class); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := classReconciler.Reconcile(context.Background(), classReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pools.Get(className); ok {
+		t.Errorf("pool of the deleted class %s not removed", className)
+	}
+}
+
+func TestIngressClassReconciler_DefaultClass(t *testing.T) {
+	var ingress networkingv1.Ingress
+	if err := yaml.Unmarshal([]byte(YamlIngressStr), &ingress); err != nil {
+		t.Fatal(err)
+	}
+	ingress.Spec.IngressClassName = nil
+	frpClass := networkingv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        constants.IngressClassName,
+			Annotations: map[string]string{networkingv1.AnnotationIsDefaultIngressClass: "true"},
+		},
+		Spec: networkingv1.IngressClassSpec{Controller: constants.ControllerName},
+	}
+	nginxClass := networkingv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec:       networkingv1.IngressClassSpec{Controller: "k8s.io/ingress-nginx"},
+	}
+	cli, _ := newFakeClient(t, &ingress, &frpClass, &nginxClass)
+
+	reconciler := NewIngressClassReconciler(cli, frp.NewPools(map[string]frp.Syncer{constants.IngressClassName: frp.NewFakeSyncer()}))
+	requeued := make(chan client.ObjectKey, 10)
+	go func() {
+		for e := range reconciler.Events() {
+			requeued <- client.ObjectKeyFromObject(e.Object)
+		}
+	}()
+
+	tests := []struct {
+		name         string
+		frpDefault   bool
+		nginxDefault bool
+		want         string
+	}{
+		{name: "frp is the default", frpDefault: true, want: constants.IngressClassName},
+		{name: "both are the default", frpDefault: true, nginxDefault: true},
+		{name: "nginx is the default", nginxDefault: true},
+		{name: "frp is the default again", frpDefault: true, want: constants.IngressClassName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []struct {
+				class      *networkingv1.IngressClass
+				setDefault bool
+			}{{&frpClass, tt.frpDefault}, {&nginxClass, tt.nginxDefault}} {
+				if err := cli.Get(context.Background(), client.ObjectKeyFromObject(c.class), c.class); err != nil {
+					t.Fatal(err)
+				}
+				c.class.Annotations = map[string]string{networkingv1.AnnotationIsDefaultIngressClass: fmt.Sprint(c.setDefault)}
+				if err := cli.Update(context.Background(), c.class); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := reconciler.DefaultClass.Get()
+			req := controllerruntime.Request{NamespacedName: client.ObjectKeyFromObject(&frpClass)}
+			if _, err := reconciler.Reconcile(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if got := reconciler.DefaultClass.Get(); got != tt.want {
+				t.Errorf("default class = %q, want %q", got, tt.want)
+			}
+			if got := ResolveIngressClassName(&ingress, reconciler.DefaultClass.Get()); got != tt.want {
+				t.Errorf("class-less ingress resolved to %q, want %q", got, tt.want)
+			}
+			if before != tt.want {
+				select {
+				case key := <-requeued:
+					if key != client.ObjectKeyFromObject(&ingress) {
+						t.Errorf("requeued %s, want the class-less ingress", key)
+					}
+				case <-time.After(time.Second):
+					t.Error("class-less ingress not requeued when the default class changed")
+				}
+			}
+			for len(requeued) > 0 {
+				<-requeued
+			}
+		})
+	}
+
+	if !IngressMatch(&ingress, constants.IngressClassName, constants.IngressClassName) {
+		t.Error("class-less ingress does not match the default class")
+	}
+	legacy := ingress.DeepCopy()
+	legacy.Annotations[constants.AnnotationIngressClass] = "nginx"
+	if IngressMatch(legacy, constants.IngressClassName, constants.IngressClassName) {
+		t.Error("ingress of another class matches the default class")
+	}
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+)
+
+// RenderOptions configures Render
+type RenderOptions struct {
+	// IngressClass is served in addition to the IngressClasses of the controller found in the objects
+	IngressClass string
+	// Clients is the number of frp clients of every pool
+	Clients int
+	// Common is the live [common] section of the frp clients
+	Common map[string]string
+	// Codec renders the configs, ini if nil
+	Codec frp.Codec
+	// PortRange are the remote ports services and FrpProxies may allocate
+	PortRange PortRange
+	// Plugins are the frpc plugins the FrpProxies may use
+	Plugins []string
+}
+
+// NewRenderScheme returns the scheme of the objects Render reads
+func NewRenderScheme() (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err := frpv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	return scheme, nil
+}
+
+// ReadManifests decodes the yaml or json documents of the reader, the kinds unknown to the scheme are skipped and the
+// namespaced objects setting no namespace are put in the namespace. The defaults of the api server the reconcilers
+// depend on are applied.
+func ReadManifests(r io.Reader, scheme *runtime.Scheme, namespace string) ([]client.Object, error) {
+	var objects []client.Object
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var u unstructured.Unstructured
+		if err := decoder.Decode(&u.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objects, nil
+			}
+			return nil, err
+		}
+		if len(u.Object) == 0 {
+			continue
+		}
+		items := []unstructured.Unstructured{u}
+		if u.IsList() {
+			list, err := u.ToList()
+			if err != nil {
+				return nil, err
+			}
+			items = list.Items
+		}
+		for i := range items {
+			gvk := items[i].GroupVersionKind()
+			if !scheme.Recognizes(gvk) {
+				continue
+			}
+			obj, err := scheme.New(gvk)
+			if err != nil {
+				return nil, err
+			}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(items[i].Object, obj); err != nil {
+				return nil, fmt.Errorf("decode %s %s: %w", gvk.Kind, items[i].GetName(), err)
+			}
+			o, ok := obj.(client.Object)
+			if !ok {
+				continue
+			}
+			if o.GetNamespace() == "" && !clusterScoped(o) {
+				o.SetNamespace(namespace)
+			}
+			if svc, ok := o.(*corev1.Service); ok && svc.Spec.Type == "" {
+				svc.Spec.Type = corev1.ServiceTypeClusterIP
+			}
+			objects = append(objects, o)
+		}
+	}
+}
+
+func clusterScoped(o client.Object) bool {
+	switch o.(type) {
+	case *networkingv1.IngressClass, *frpv1alpha1.FrpIngressClassParameters, *corev1.Namespace:
+		return true
+	}
+	return false
+}
+
+// Render runs the reconcilers of the ingresses, services and FrpProxies against the objects in memory and returns
+// the configs the Syncers would push to the frp clients, keyed by client, e.g. frp.0, together with the failures of
+// the proxies the Syncers left out of them. The sensitive values are masked.
+func Render(ctx context.Context, objects []client.Object, opts RenderOptions) (map[string][]byte, []frp.RenderFailure, error) {
+	scheme, err := NewRenderScheme()
+	if err != nil {
+		return nil, nil, err
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	l := log.FromContext(ctx)
+
+	classes := make(map[string]*networkingv1.IngressClass)
+	if opts.IngressClass != "" {
+		classes[opts.IngressClass] = nil
+	}
+	defaultClass := &DefaultIngressClass{}
+	var defaults []string
+	for _, o := range objects {
+		class, ok := o.(*networkingv1.IngressClass)
+		if !ok || !ingressClassServed(class) {
+			continue
+		}
+		classes[class.Name] = class
+		if isDefaultClass(class) {
+			defaults = append(defaults, class.Name)
+		}
+	}
+	if len(defaults) == 1 {
+		defaultClass.Set(defaults[0])
+	}
+
+	classReconciler := NewIngressClassReconciler(cli, nil)
+	renderers := make(map[string]*frp.Renderer, len(classes))
+	syncers := make(map[string]frp.Syncer, len(classes))
+	for className, class := range classes {
+		renderer := frp.NewRenderer(className, opts.Clients, opts.Common, opts.Codec)
+		if class != nil {
+			params, err := IngressClassParameters(ctx, cli, class)
+			if apierrors.IsNotFound(err) {
+				l.Info("parameters of the IngressClass not found", "ingressClass", className)
+			} else if err != nil {
+				return nil, nil, err
+			}
+			if params != nil {
+				common, err := classReconciler.commonConfig(ctx, params)
+				if apierrors.IsNotFound(err) {
+					l.Info("common secret not found, rendering the [common] keys of the parameters only", "ingressClass", className)
+				} else if err != nil {
+					return nil, nil, err
+				}
+				renderer.SetPoolCommon(common)
+			}
+		}
+		renderers[className] = renderer
+		syncers[className] = renderer
+	}
+	pools := frp.NewPools(syncers)
+
+	// the rendered group keys are random and masked, the keys of the cluster are kept in its Secret
+	groupKeys := NewMemoryGroupKeys()
+	ingressReconciler := NewFrpIngressReconciler(cli, scheme, pools)
+	ingressReconciler.DefaultClass = defaultClass
+	ingressReconciler.GroupKeys = groupKeys
+	serviceReconciler := NewServiceReconciler(cli, scheme, &record.FakeRecorder{}, pools, opts.PortRange)
+	serviceReconciler.DefaultClass = defaultClass
+	serviceReconciler.GroupKeys = groupKeys
+	proxyReconciler := NewFrpProxyReconciler(cli, scheme, pools)
+	proxyReconciler.DefaultClass = defaultClass
+	proxyReconciler.GroupKeys = groupKeys
+	proxyReconciler.Plugins = opts.Plugins
+	proxyReconciler.PortRange = opts.PortRange
+
+	// the objects are reconciled in a stable order, e.g. the remote ports are allocated to the first services
+	sorted := make([]client.Object, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return client.ObjectKeyFromObject(sorted[i]).String() < client.ObjectKeyFromObject(sorted[j]).String()
+	})
+	for _, o := range sorted {
+		var reconciler interface {
+			Reconcile(context.Context, ctrl.Request) (ctrl.Result, error)
+		}
+		switch o.(type) {
+		case *networkingv1.Ingress:
+			reconciler = ingressReconciler
+		case *corev1.Service:
+			reconciler = serviceReconciler
+		case *frpv1alpha1.FrpProxy:
+			reconciler = proxyReconciler
+		default:
+			continue
+		}
+		req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(o)}
+		if _, err := reconciler.Reconcile(ctx, req); err != nil {
+			return nil, nil, fmt.Errorf("reconcile %T %s: %w", o, req, err)
+		}
+	}
+
+	res := make(map[string][]byte)
+	var failures []frp.RenderFailure
+	for _, renderer := range renderers {
+		rendered, rendererFailures, err := renderer.Render(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, data := range rendered {
+			res[name] = data
+		}
+		failures = append(failures, rendererFailures...)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].String() < failures[j].String()
+	})
+	return res, failures, nil
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	"strings"
+	"testing"
+)
+
+func TestRenderMasksCommon(t *testing.T) {
+	opts := RenderOptions{IngressClass: "frp", Clients: 1, Common: map[string]string{
+		"server_addr":             "frps.example.com",
+		"authentication_method":   "oidc",
+		"oidc_client_id":          "ingress-frp",
+		"oidc_client_secret":      "secret",
+		"oidc_audience":           "frps",
+		"oidc_token_endpoint_url": "https://sso.example.com/token",
+		"meta_team":               "platform",
+	}}
+	rendered, _, err := Render(context.Background(), nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := frp.Unmarshal(rendered["frp.0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range opts.Common {
+		want := v
+		if k == "oidc_client_secret" || k == "meta_team" {
+			want = "******"
+		}
+		if got := cfg.Common.ToMap()[k]; got != want {
+			t.Errorf("rendered %s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	scheme, err := NewRenderScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := strings.Join([]string{YamlIngressStr, YamlServiceStr, YamlSecretStr}, "\n---\n")
+	objects, err := ReadManifests(strings.NewReader(manifests), scheme, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 3 {
+		t.Fatalf("read %d objects, want 3", len(objects))
+	}
+
+	opts := RenderOptions{IngressClass: "frp", Clients: 2, Common: map[string]string{"server_addr": "frps.example.com", "token": "secret"}}
+	rendered, failures, err := Render(context.Background(), objects, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("render failures %v", failures)
+	}
+	if len(rendered) != 2 {
+		t.Fatalf("rendered %d clients, want 2", len(rendered))
+	}
+	cfg, err := frp.Unmarshal(rendered["frp.0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Common.ToMap()["server_addr"] != "frps.example.com" || cfg.Common.ToMap()["token"] != "******" {
+		t.Errorf("rendered [common] %v", cfg.Common.ToMap())
+	}
+	https, ok := cfg.Proxy["frp.0/default/gitea-ingress/gitea.example.com/:https"]
+	if !ok {
+		t.Fatalf("https proxy not rendered: %s", rendered["frp.0"])
+	}
+	for _, key := range []string{"tls_keys", "http_pwd", "group_key"} {
+		if v := https.ToMap()[key]; v != "******" {
+			t.Errorf("%s = %q, want it masked", key, v)
+		}
+	}
+	if _, ok := cfg.Proxy["frp.0/default/gitea-ingress/gitea.example.com/:http"]; !ok {
+		t.Errorf("http redirect proxy not rendered: %s", rendered["frp.0"])
+	}
+
+	// the output read back has no diff, a removed path is reported
+	var out strings.Builder
+	if err := frp.WriteRendered(&out, rendered); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := frp.ReadRendered(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs, err := frp.DiffRendered(saved, rendered, nil); err != nil || len(diffs) != 0 {
+		t.Fatalf("diff of the saved output %v, %v", diffs, err)
+	}
+	rendered, _, err = Render(context.Background(), objects[1:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := frp.DiffRendered(saved, rendered, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := diffs["frp.0"]; len(d.Removed) != 2 || len(d.Added) != 0 {
+		t.Errorf("diff without the ingress %+v", d)
+	}
+
+	// toml can not carry the inline certificates of the tls ingress, its proxies are reported as left out
+	opts.Codec = frp.TomlCodec
+	rendered, failures, err = Render(context.Background(), objects, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 {
+		t.Fatalf("render failures %v, want the ingress on both clients", failures)
+	}
+	for _, failure := range failures {
+		if failure.Key != "default/gitea-ingress" || !strings.Contains(failure.Reason, "toml") {
+			t.Errorf("render failure %v", failure)
+		}
+	}
+	cfg, err = frp.TomlCodec.Unmarshal(rendered["frp.0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Proxy["frp.0/default/gitea-ingress/gitea.example.com/:https"]; ok {
+		t.Errorf("https proxy rendered in toml: %s", rendered["frp.0"])
+	}
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"fmt"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+// Scope restricts the ingresses and the services publishing remote ports served by the manager to some namespaces and
+// labels. A nil Scope contains every object.
+type Scope struct {
+	// Namespaces are the watched namespaces, all namespaces if empty
+	Namespaces []string
+	// IngressSelector selects the served ingresses and services, all of them if nil
+	IngressSelector labels.Selector
+}
+
+// ParseScope parses a comma separated list of namespaces and a label selector, it returns nil if both are empty
+func ParseScope(namespaces string, ingressSelector string) (*Scope, error) {
+	var scope Scope
+	for _, ns := range strings.Split(namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			scope.Namespaces = append(scope.Namespaces, ns)
+		}
+	}
+	if ingressSelector != "" {
+		selector, err := labels.Parse(ingressSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ingress label selector: %w", err)
+		}
+		scope.IngressSelector = selector
+	}
+	if len(scope.Namespaces) == 0 && scope.IngressSelector == nil {
+		return nil, nil
+	}
+	return &scope, nil
+}
+
+// Contains reports whether the ingress or the service is in the scope
+func (s *Scope) Contains(object client.Object) bool {
+	if s == nil {
+		return true
+	}
+	if !s.InNamespaces(object) {
+		return false
+	}
+	return s.IngressSelector == nil || s.IngressSelector.Matches(labels.Set(object.GetLabels()))
+}
+
+// NewCache builds a manager cache which only lists and watches the objects of the scope,
+// cluster scoped objects such as IngressClasses are still cached cluster wide.
+func (s *Scope) NewCache() cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		if s == nil {
+			return cache.New(config, opts)
+		}
+		if s.IngressSelector != nil {
+			opts.SelectorsByObject = cache.SelectorsByObject{
+				&networkingv1.Ingress{}: {Label: s.IngressSelector},
+			}
+		}
+		if len(s.Namespaces) > 0 {
+			return cache.MultiNamespacedCacheBuilder(s.Namespaces)(config, opts)
+		}
+		return cache.New(config, opts)
+	}
+}
+
+// InNamespaces reports whether a namespaced object is in the namespaces of the scope
+func (s *Scope) InNamespaces(object client.Object) bool {
+	if s == nil || len(s.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range s.Namespaces {
+		if ns == object.GetNamespace() {
+			return true
+		}
+	}
+	return false
+}
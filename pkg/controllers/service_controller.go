@@ -0,0 +1,495 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortRange is the inclusive range of the remote ports services may allocate on frps
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a range like "1024-65535"
+func ParsePortRange(s string) (PortRange, error) {
+	minPort, maxPort, ok := strings.Cut(s, "-")
+	if !ok {
+		maxPort = minPort
+	}
+	var r PortRange
+	var err error
+	if r.Min, err = strconv.Atoi(strings.TrimSpace(minPort)); err != nil {
+		return r, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if r.Max, err = strconv.Atoi(strings.TrimSpace(maxPort)); err != nil {
+		return r, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return r, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// RemotePort is a service port published on a remote port of frps
+type RemotePort struct {
+	Port       corev1.ServicePort
+	RemotePort int
+}
+
+// remotePortClaim identifies a remote port of frps, tcp and udp ports are allocated separately
+type remotePortClaim struct {
+	protocol   corev1.Protocol
+	remotePort int
+}
+
+// ParseRemotePorts reads the constants.AnnotationRemotePort annotation of the service
+func ParseRemotePorts(svc *corev1.Service) ([]RemotePort, error) {
+	value := strings.TrimSpace(svc.Annotations[constants.AnnotationRemotePort])
+	if value == "" {
+		return nil, nil
+	}
+	var res []RemotePort
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		portRef, remote, ok := strings.Cut(item, ":")
+		if !ok {
+			if len(svc.Spec.Ports) != 1 {
+				return nil, fmt.Errorf("%q: the service has %d ports, use port:remotePort", item, len(svc.Spec.Ports))
+			}
+			portRef, remote = "", portRef
+		}
+		remotePort, err := strconv.Atoi(remote)
+		if err != nil || remotePort < 1 || remotePort > 65535 {
+			return nil, fmt.Errorf("%q: invalid remote port", item)
+		}
+		port, err := findServicePort(svc, portRef)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		if port.Protocol != corev1.ProtocolTCP && port.Protocol != corev1.ProtocolUDP && port.Protocol != "" {
+			return nil, fmt.Errorf("%q: unsupported protocol %s", item, port.Protocol)
+		}
+		res = append(res, RemotePort{Port: port, RemotePort: remotePort})
+	}
+	return res, nil
+}
+
+func findServicePort(svc *corev1.Service, ref string) (corev1.ServicePort, error) {
+	if ref == "" {
+		return svc.Spec.Ports[0], nil
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Name == ref || strconv.Itoa(int(port.Port)) == ref {
+			return port, nil
+		}
+	}
+	return corev1.ServicePort{}, fmt.Errorf("port %s not found", ref)
+}
+
+func (p RemotePort) claim() remotePortClaim {
+	protocol := p.Port.Protocol
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	return remotePortClaim{protocol: protocol, remotePort: p.RemotePort}
+}
+
+// ServiceReconciler publishes the ports of the services annotated with constants.AnnotationRemotePort as frp tcp
+// and udp proxies. A remote port is allocated to the oldest service claiming it, the other services are reported.
+type ServiceReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Pools are the syncers of the frp client pools, keyed by the IngressClass they serve
+	Pools *frp.Pools
+	// DefaultClass is the class of the services setting no class
+	DefaultClass *DefaultIngressClass
+	// PortRange are the remote ports services may allocate
+	PortRange PortRange
+	// GroupKeys are the keys of the load balancing groups, required to configure grouped proxies
+	GroupKeys *GroupKeys
+	// Scope restricts the served services, nil serves every service
+	Scope *Scope
+}
+
+func NewServiceReconciler(client client.Client, scheme *runtime.Scheme, recorder record.EventRecorder, pools *frp.Pools, portRange PortRange) *ServiceReconciler {
+	return &ServiceReconciler{
+		Client:    client,
+		Scheme:    scheme,
+		Recorder:  recorder,
+		Pools:     pools,
+		PortRange: portRange,
+	}
+}
+
+//+kubebuilder:rbac:groups=,resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=,resources=events,verbs=create;patch
+
+func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	l.Info("Reconciling", "req", req)
+
+	key := serviceProxyKey(req.NamespacedName.String())
+	var svc corev1.Service
+	if err := r.Get(ctx, req.NamespacedName, &svc); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.deleteProxies(key, "")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !svc.DeletionTimestamp.IsZero() || svc.Annotations[constants.AnnotationRemotePort] == "" || !r.Scope.Contains(&svc) {
+		r.deleteProxies(key, "")
+		return ctrl.Result{}, nil
+	}
+
+	className := r.className(&svc)
+	frpSyncer, ok := r.Pools.Get(className)
+	if !ok {
+		r.deleteProxies(key, "")
+		r.event(ctx, &svc, corev1.EventTypeWarning, constants.ReasonNoPool, fmt.Sprintf("no frp client pool serves the class %q", className))
+		return ctrl.Result{}, nil
+	}
+	r.deleteProxies(key, className)
+
+	ports, err := ParseRemotePorts(&svc)
+	if err != nil {
+		frpSyncer.DeleteProxies(key)
+		r.event(ctx, &svc, corev1.EventTypeWarning, constants.ReasonInvalidRemotePort, err.Error())
+		return ctrl.Result{}, nil
+	}
+	claimants, err := listRemotePortClaimants(ctx, r.Client, r.DefaultClass.Get(), r.PortRange, r.Scope)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	owners := remotePortOwners(claimants, className)
+
+	cfgs := make(map[string]frp.Config)
+	claimed := make(map[remotePortClaim]bool)
+	for _, port := range ports {
+		if claimed[port.claim()] {
+			r.event(ctx, &svc, corev1.EventTypeWarning, constants.ReasonRemotePortConflict,
+				fmt.Sprintf("remote port %s/%d is published twice", strings.ToLower(string(port.claim().protocol)), port.RemotePort))
+			continue
+		}
+		claimed[port.claim()] = true
+		if !r.PortRange.Contains(port.RemotePort) {
+			r.event(ctx, &svc, corev1.EventTypeWarning, constants.ReasonInvalidRemotePort,
+				fmt.Sprintf("remote port %d is outside of the allowed range %s", port.RemotePort, r.PortRange))
+			continue
+		}
+		if owner := owners[port.claim()]; owner != nil && (owner.kind != "service" || owner.name != req.NamespacedName) {
+			r.event(ctx, &svc, corev1.EventTypeWarning, constants.ReasonRemotePortConflict,
+				fmt.Sprintf("remote port %s/%d is allocated to %s", strings.ToLower(string(port.claim().protocol)), port.RemotePort, owner))
+			continue
+		}
+		name := shortenProxyName(fmt.Sprintf("%s/%s:%s:%d", svc.Namespace, svc.Name, strings.ToLower(string(port.claim().protocol)), port.RemotePort))
+		localPort := strconv.Itoa(int(port.Port.Port))
+		remotePort := strconv.Itoa(port.RemotePort)
+		if port.claim().protocol == corev1.ProtocolUDP {
+			cfgs[name] = &frp.UdpConfig{LocalIp: svcToDomain(&svc), LocalPort: localPort, RemotePort: remotePort}
+			continue
+		}
+		cfg := &frp.TcpConfig{LocalIp: svcToDomain(&svc), LocalPort: localPort, RemotePort: remotePort}
+		var err error
+		if cfg.Group, cfg.GroupKey, err = r.GroupKeys.Group(ctx, name, frp.TypeTcp); err != nil {
+			return ctrl.Result{}, err
+		}
+		cfgs[name] = cfg
+	}
+
+	l.Info("update frp config", "cfgs", fmt.Sprintf("%v", cfgs))
+	frpSyncer.SetProxies(key, cfgs)
+	return ctrl.Result{}, nil
+}
+
+// remotePortClaimant is a service or a FrpProxy claiming remote ports of frps
+type remotePortClaimant struct {
+	kind      string
+	name      types.NamespacedName
+	created   metav1.Time
+	className string
+	claims    []remotePortClaim
+}
+
+func (c *remotePortClaimant) String() string {
+	return fmt.Sprintf("the %s %s", c.kind, c.name)
+}
+
+// remotePortOwners returns the claimant each remote port of the class is allocated to, the oldest claimant of a port
+// owns it
+func remotePortOwners(claimants []remotePortClaimant, className string) map[remotePortClaim]*remotePortClaimant {
+	owners := make(map[remotePortClaim]*remotePortClaimant)
+	for i := range claimants {
+		if claimants[i].className != className {
+			continue
+		}
+		for _, claim := range claimants[i].claims {
+			if _, ok := owners[claim]; !ok {
+				owners[claim] = &claimants[i]
+			}
+		}
+	}
+	return owners
+}
+
+// listRemotePortClaimants lists the services of the scope and the FrpProxies claiming remote ports of the range, oldest
+// first, ties are broken by name. Services and FrpProxies share the remote ports of frps.
+func listRemotePortClaimants(ctx context.Context, c client.Client, defaultClass string, portRange PortRange, scope *Scope) ([]remotePortClaimant, error) {
+	var serviceList corev1.ServiceList
+	if err := c.List(ctx, &serviceList); err != nil {
+		return nil, err
+	}
+	var proxyList frpv1alpha1.FrpProxyList
+	if err := c.List(ctx, &proxyList); err != nil {
+		return nil, err
+	}
+
+	var claimants []remotePortClaimant
+	for i := range serviceList.Items {
+		svc := &serviceList.Items[i]
+		if !svc.DeletionTimestamp.IsZero() || !publishesRemotePorts(svc) || !scope.Contains(svc) {
+			continue
+		}
+		ports, err := ParseRemotePorts(svc)
+		if err != nil {
+			continue
+		}
+		claimant := remotePortClaimant{
+			kind:      "service",
+			name:      client.ObjectKeyFromObject(svc),
+			created:   svc.CreationTimestamp,
+			className: serviceClassName(svc, defaultClass),
+		}
+		for _, port := range ports {
+			if portRange.Contains(port.RemotePort) {
+				claimant.claims = append(claimant.claims, port.claim())
+			}
+		}
+		claimants = append(claimants, claimant)
+	}
+	for i := range proxyList.Items {
+		proxy := &proxyList.Items[i]
+		if !proxy.DeletionTimestamp.IsZero() {
+			continue
+		}
+		claim, ok := frpProxyRemotePort(proxy, portRange)
+		if !ok {
+			continue
+		}
+		claimants = append(claimants, remotePortClaimant{
+			kind:      "FrpProxy",
+			name:      client.ObjectKeyFromObject(proxy),
+			created:   proxy.CreationTimestamp,
+			className: FrpProxyClassName(proxy, defaultClass),
+			claims:    []remotePortClaim{claim},
+		})
+	}
+	sort.Slice(claimants, func(i, j int) bool {
+		ti, tj := claimants[i].created, claimants[j].created
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		if ni, nj := claimants[i].name.String(), claimants[j].name.String(); ni != nj {
+			return ni < nj
+		}
+		return claimants[i].kind < claimants[j].kind
+	})
+	return claimants, nil
+}
+
+func (r *ServiceReconciler) className(svc *corev1.Service) string {
+	return serviceClassName(svc, r.DefaultClass.Get())
+}
+
+// serviceClassName returns the class of the service, the default class if it sets no class
+func serviceClassName(svc *corev1.Service, defaultClass string) string {
+	if className := svc.Annotations[constants.AnnotationServiceIngressClass]; className != "" {
+		return className
+	}
+	if defaultClass != "" {
+		return defaultClass
+	}
+	return constants.IngressClassName
+}
+
+// deleteProxies deletes the proxies of the service from every syncer except the one of the given class
+func (r *ServiceReconciler) deleteProxies(key string, exceptClass string) {
+	for className, frpSyncer := range r.Pools.Syncers() {
+		if className != exceptClass {
+			frpSyncer.DeleteProxies(key)
+		}
+	}
+}
+
+func (r *ServiceReconciler) event(ctx context.Context, svc *corev1.Service, eventType, reason, message string) {
+	log.FromContext(ctx).Info(message, "service", client.ObjectKeyFromObject(svc), "reason", reason)
+	if r.Recorder != nil {
+		r.Recorder.Event(svc, eventType, reason, message)
+	}
+}
+
+// serviceProxyKey is the syncer key of the proxies of a service, distinct from the namespace/name keys of ingresses
+func serviceProxyKey(name string) string {
+	return "service/" + name
+}
+
+func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Pools == nil {
+		r.Pools = frp.NewPools(map[string]frp.Syncer{constants.IngressClassName: frp.NewFakeSyncer()})
+	}
+
+	bldr := ctrl.NewControllerManagedBy(mgr)
+	if r.GroupKeys != nil {
+		// the rotated group keys are pushed by requeueing every service publishing remote ports
+		bldr = bldr.Watches(&source.Channel{Source: r.GroupKeys.Subscribe()}, handler.EnqueueRequestsFromMapFunc(r.groupKeysMapFunc))
+	}
+	return bldr.
+		Named("service").
+		For(&corev1.Service{}, builder.WithPredicates(predicate.Funcs{
+			CreateFunc: func(createEvent event.CreateEvent) bool {
+				return publishesRemotePorts(createEvent.Object)
+			},
+			DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+				return publishesRemotePorts(deleteEvent.Object)
+			},
+			UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+				return publishesRemotePorts(updateEvent.ObjectOld) || publishesRemotePorts(updateEvent.ObjectNew)
+			},
+			GenericFunc: func(genericEvent event.GenericEvent) bool {
+				return publishesRemotePorts(genericEvent.Object)
+			},
+		})).
+		// a change of a service or a FrpProxy may free or take a remote port claimed by the other services
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.claimMapFunc), builder.WithPredicates(claimPredicate(publishesRemotePorts))).
+		Watches(&source.Kind{Type: &frpv1alpha1.FrpProxy{}}, handler.EnqueueRequestsFromMapFunc(r.claimMapFunc), builder.WithPredicates(claimPredicate(claimsRemotePort))).
+		Complete(r)
+}
+
+func publishesRemotePorts(object client.Object) bool {
+	return object.GetAnnotations()[constants.AnnotationRemotePort] != ""
+}
+
+// claimPredicate filters the events of the objects which claim, or claimed, remote ports
+func claimPredicate(claims func(client.Object) bool) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(createEvent event.CreateEvent) bool {
+			return claims(createEvent.Object)
+		},
+		DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+			return claims(deleteEvent.Object)
+		},
+		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+			return claims(updateEvent.ObjectOld) || claims(updateEvent.ObjectNew)
+		},
+		GenericFunc: func(genericEvent event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// objectClaims returns the remote ports claimed by a service or a FrpProxy, whatever their range and class
+func objectClaims(object client.Object) []remotePortClaim {
+	switch o := object.(type) {
+	case *corev1.Service:
+		ports, err := ParseRemotePorts(o)
+		if err != nil {
+			return nil
+		}
+		claims := make([]remotePortClaim, 0, len(ports))
+		for _, port := range ports {
+			claims = append(claims, port.claim())
+		}
+		return claims
+	case *frpv1alpha1.FrpProxy:
+		if claim, ok := frpProxyRemotePort(o, PortRange{Min: 0, Max: 65535}); ok {
+			return []remotePortClaim{claim}
+		}
+	}
+	return nil
+}
+
+// claimsOverlap reports whether the two lists of claims share a remote port
+func claimsOverlap(a, b []remotePortClaim) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimMapFunc maps a service or a FrpProxy to the other services publishing one of its remote ports. An update
+// maps both the old and the new object, so the services waiting for a released port are requeued too.
+func (r *ServiceReconciler) claimMapFunc(object client.Object) []reconcile.Request {
+	claims := objectClaims(object)
+	if len(claims) == 0 {
+		return nil
+	}
+	var serviceList corev1.ServiceList
+	if err := r.List(context.Background(), &serviceList); err != nil {
+		return nil
+	}
+
+	_, isService := object.(*corev1.Service)
+	var reqs []reconcile.Request
+	for i := range serviceList.Items {
+		key := client.ObjectKeyFromObject(&serviceList.Items[i])
+		if isService && key == client.ObjectKeyFromObject(object) {
+			continue
+		}
+		if claimsOverlap(objectClaims(&serviceList.Items[i]), claims) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: key})
+		}
+	}
+	return reqs
+}
+
+// groupKeysMapFunc requeues every service publishing remote ports when the group keys are rotated
+func (r *ServiceReconciler) groupKeysMapFunc(client.Object) []reconcile.Request {
+	var serviceList corev1.ServiceList
+	if err := r.List(context.Background(), &serviceList); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for i := range serviceList.Items {
+		if publishesRemotePorts(&serviceList.Items[i]) {
+			reqs = append(reqs, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&serviceList.Items[i])})
+		}
+	}
+	return reqs
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	controllerruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceReconciler_Reconcile(t *testing.T) {
+	newService := func(name string, age time.Duration, remotePort string, ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "default",
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age).Truncate(time.Second)),
+				Annotations:       map[string]string{constants.AnnotationRemotePort: remotePort},
+			},
+			Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP, Ports: ports},
+		}
+	}
+	postgres := newService("postgres", 2*time.Hour, "5432", corev1.ServicePort{Name: "postgres", Port: 5432, Protocol: corev1.ProtocolTCP})
+	// claims the remote port of the older postgres service
+	postgresCopy := newService("postgres-copy", time.Hour, "5432", corev1.ServicePort{Name: "postgres", Port: 5432, Protocol: corev1.ProtocolTCP})
+	game := newService("game", time.Hour, "game:27015,query:27015,rcon:27015",
+		corev1.ServicePort{Name: "game", Port: 27015, Protocol: corev1.ProtocolUDP},
+		corev1.ServicePort{Name: "query", Port: 27016, Protocol: corev1.ProtocolUDP},
+		corev1.ServicePort{Name: "rcon", Port: 27015, Protocol: corev1.ProtocolTCP},
+	)
+	ssh := newService("ssh", time.Hour, "22", corev1.ServicePort{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP})
+	ambiguous := newService("ambiguous", time.Hour, "6000",
+		corev1.ServicePort{Name: "a", Port: 1},
+		corev1.ServicePort{Name: "b", Port: 2},
+	)
+	// out of the scope, it neither gets proxies nor holds the remote port of the younger postgres service
+	foreign := newService("foreign", 3*time.Hour, "5432", corev1.ServicePort{Name: "postgres", Port: 5432, Protocol: corev1.ProtocolTCP})
+	foreign.Labels = map[string]string{"tenant": "b"}
+	// claims the remote port of the older tunnel FrpProxy
+	sshTunnel := newService("ssh-tunnel", time.Hour, "2222", corev1.ServicePort{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP})
+	tunnel := &frpv1alpha1.FrpProxy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "tunnel",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-2 * time.Hour).Truncate(time.Second)),
+		},
+		Spec: frpv1alpha1.FrpProxySpec{
+			Type:    frp.TypeTcp,
+			Plugin:  &frpv1alpha1.FrpProxyPlugin{Name: "socks5"},
+			Options: map[string]string{"remote_port": "2222"},
+		},
+	}
+	cli, scheme := newFakeClient(t, postgres, postgresCopy, game, ssh, ambiguous, foreign, sshTunnel, tunnel)
+
+	portRange, err := ParsePortRange("1024-65535")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePortRange("7000-6000"); err == nil {
+		t.Error("inverted port range accepted")
+	}
+	syncer := &recordSyncer{proxies: make(map[string]map[string]frp.Config)}
+	recorder := record.NewFakeRecorder(10)
+	reconciler := NewServiceReconciler(cli, scheme, recorder, frp.NewPools(map[string]frp.Syncer{"frp": syncer}), portRange)
+	reconciler.GroupKeys = NewMemoryGroupKeys()
+	if reconciler.Scope, err = ParseScope("", "tenant!=b"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		svc        *corev1.Service
+		wantNames  []string
+		wantReason string
+	}{
+		{svc: foreign},
+		{svc: postgres, wantNames: []string{"default/postgres:tcp:5432"}},
+		{svc: postgresCopy, wantReason: constants.ReasonRemotePortConflict},
+		{svc: game, wantNames: []string{"default/game:tcp:27015", "default/game:udp:27015"}, wantReason: constants.ReasonRemotePortConflict},
+		{svc: ssh, wantReason: constants.ReasonInvalidRemotePort},
+		{svc: ambiguous, wantReason: constants.ReasonInvalidRemotePort},
+		{svc: sshTunnel, wantReason: constants.ReasonRemotePortConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.svc.Name, func(t *testing.T) {
+			key := client.ObjectKeyFromObject(tt.svc)
+			if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			proxies := syncer.proxies[serviceProxyKey(key.String())]
+			if len(proxies) != len(tt.wantNames) {
+				t.Errorf("proxies = %v, want %v", proxies, tt.wantNames)
+			}
+			for _, name := range tt.wantNames {
+				if _, ok := proxies[name]; !ok {
+					t.Errorf("proxy %s not set: %v", name, proxies)
+				}
+			}
+			var reason string
+			select {
+			case e := <-recorder.Events:
+				reason = strings.Fields(e)[1]
+			default:
+			}
+			if reason != tt.wantReason {
+				t.Errorf("event reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+
+	// a service requeues the other services publishing one of its remote ports, a FrpProxy the services publishing
+	// its remote port
+	var requeued []string
+	for _, req := range reconciler.claimMapFunc(postgres) {
+		requeued = append(requeued, req.Name)
+	}
+	sort.Strings(requeued)
+	if want := []string{"foreign", "postgres-copy"}; !equality.Semantic.DeepEqual(requeued, want) {
+		t.Errorf("service requeued %v, want %v", requeued, want)
+	}
+	if reqs := reconciler.claimMapFunc(tunnel); len(reqs) != 1 || reqs[0].Name != "ssh-tunnel" {
+		t.Errorf("FrpProxy requeued %v, want the ssh-tunnel service", reqs)
+	}
+
+	cfg, ok := syncer.proxies[serviceProxyKey("default/postgres")]["default/postgres:tcp:5432"].(*frp.TcpConfig)
+	if !ok || cfg.LocalIp != "postgres.default.svc.cluster.local" || cfg.LocalPort != "5432" || cfg.RemotePort != "5432" || !cfg.EnableGroup() {
+		t.Errorf("unexpected postgres proxy: %v", cfg)
+	}
+
+	// the remote port passes to the next service when its owner is deleted
+	if err := cli.Delete(context.Background(), postgres); err != nil {
+		t.Fatal(err)
+	}
+	for _, svc := range []*corev1.Service{postgres, postgresCopy} {
+		if _, err := reconciler.Reconcile(context.Background(), controllerruntime.Request{NamespacedName: client.ObjectKeyFromObject(svc)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := syncer.proxies[serviceProxyKey("default/postgres")]; ok {
+		t.Error("proxies of the deleted service not removed")
+	}
+	if _, ok := syncer.proxies[serviceProxyKey("default/postgres-copy")]["default/postgres-copy:tcp:5432"]; !ok {
+		t.Error("remote port not allocated to the remaining service")
+	}
+}
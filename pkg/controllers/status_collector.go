@@ -0,0 +1,287 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	frpv1alpha1 "github.com/grydovee/ingress-frp/api/v1alpha1"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/grydovee/ingress-frp/pkg/frp"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"strings"
+	"time"
+)
+
+// IngressStatusCollector periodically reads the proxy status of the frp clients and writes it onto the
+// ingresses as conditions in the constants.AnnotationStatus annotation, transitions are also recorded as events.
+// The status of the FrpProxies is written onto their status subresource.
+type IngressStatusCollector struct {
+	client.Client
+	Recorder record.EventRecorder
+	// Pools are the syncers of the frp client pools, keyed by the IngressClass they serve
+	Pools *frp.Pools
+	// DefaultClass is the class of the ingresses setting no class
+	DefaultClass *DefaultIngressClass
+	Interval     time.Duration
+}
+
+var _ manager.LeaderElectionRunnable = (*IngressStatusCollector)(nil)
+
+func NewIngressStatusCollector(client client.Client, recorder record.EventRecorder, pools *frp.Pools) *IngressStatusCollector {
+	return &IngressStatusCollector{
+		Client:   client,
+		Recorder: recorder,
+		Pools:    pools,
+		Interval: constants.FrpStatusSyncInterval,
+	}
+}
+
+//+kubebuilder:rbac:groups=,resources=events,verbs=create;patch
+
+func (c *IngressStatusCollector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			c.Collect(ctx)
+		}
+	}
+}
+
+func (c *IngressStatusCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// Collect updates the status of every frp ingress and FrpProxy once
+func (c *IngressStatusCollector) Collect(ctx context.Context) {
+	l := log.FromContext(ctx)
+
+	syncers := c.Pools.Syncers()
+	status := make(map[string]map[string][]frp.ProxyStatus, len(syncers))
+	for className, frpSyncer := range syncers {
+		status[className] = frpSyncer.Status(ctx)
+	}
+	c.collectFrpProxies(ctx, status)
+
+	var ingressList networkingv1.IngressList
+	if err := c.List(ctx, &ingressList); err != nil {
+		l.Error(err, "list ingress error")
+		return
+	}
+	for i := range ingressList.Items {
+		ingress := &ingressList.Items[i]
+		classStatus, ok := status[ResolveIngressClassName(ingress, c.DefaultClass.Get())]
+		if !ok || !ingress.DeletionTimestamp.IsZero() {
+			continue
+		}
+		key := client.ObjectKeyFromObject(ingress).String()
+		if err := c.updateIngress(ctx, ingress, classStatus[key]); err != nil {
+			l.Error(err, "update ingress status error", "ingress", key)
+		}
+	}
+}
+
+func (c *IngressStatusCollector) updateIngress(ctx context.Context, ingress *networkingv1.Ingress, status []frp.ProxyStatus) error {
+	conditions, err := IngressConditions(ingress)
+	if err != nil {
+		// overwrite a broken annotation
+		conditions = nil
+	}
+	old := meta.FindStatusCondition(conditions, constants.ConditionReady)
+	var oldCond metav1.Condition
+	if old != nil {
+		oldCond = *old
+	}
+
+	cond := proxyCondition(status)
+	cond.ObservedGeneration = ingress.Generation
+	meta.SetStatusCondition(&conditions, cond)
+	if old != nil && oldCond.Status == cond.Status && oldCond.Reason == cond.Reason && oldCond.Message == cond.Message {
+		return nil
+	}
+
+	data, err := json.Marshal(conditions)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(ingress.DeepCopy())
+	if ingress.Annotations == nil {
+		ingress.Annotations = make(map[string]string)
+	}
+	ingress.Annotations[constants.AnnotationStatus] = string(data)
+	if err := c.Patch(ctx, ingress, patch); err != nil {
+		return err
+	}
+
+	if c.Recorder != nil && (old == nil || oldCond.Status != cond.Status || oldCond.Reason != cond.Reason) {
+		eventType := corev1.EventTypeNormal
+		if cond.Status != metav1.ConditionTrue {
+			eventType = corev1.EventTypeWarning
+		}
+		c.Recorder.Event(ingress, eventType, cond.Reason, cond.Message)
+	}
+	return nil
+}
+
+// collectFrpProxies writes the live state of the FrpProxies, it is skipped if the FrpProxy type is not registered
+func (c *IngressStatusCollector) collectFrpProxies(ctx context.Context, status map[string]map[string][]frp.ProxyStatus) {
+	l := log.FromContext(ctx)
+	if !c.Scheme().Recognizes(frpv1alpha1.GroupVersion.WithKind("FrpProxy")) {
+		return
+	}
+
+	var proxyList frpv1alpha1.FrpProxyList
+	if err := c.List(ctx, &proxyList); err != nil {
+		l.Error(err, "list frp proxy error")
+		return
+	}
+	for i := range proxyList.Items {
+		proxy := &proxyList.Items[i]
+		classStatus, ok := status[FrpProxyClassName(proxy, c.DefaultClass.Get())]
+		if !ok || !proxy.DeletionTimestamp.IsZero() {
+			continue
+		}
+		// the FrpProxyReconciler reports the proxies it could not configure
+		if cond := meta.FindStatusCondition(proxy.Status.Conditions, constants.ConditionReady); cond != nil &&
+			frpProxyNotConfigured(cond.Reason) {
+			continue
+		}
+		key := client.ObjectKeyFromObject(proxy).String()
+		if err := c.updateFrpProxy(ctx, proxy, classStatus[frpProxyKey(key)]); err != nil {
+			l.Error(err, "update frp proxy status error", "frpProxy", key)
+		}
+	}
+}
+
+func (c *IngressStatusCollector) updateFrpProxy(ctx context.Context, proxy *frpv1alpha1.FrpProxy, status []frp.ProxyStatus) error {
+	patch := client.MergeFrom(proxy.DeepCopy())
+	old := meta.FindStatusCondition(proxy.Status.Conditions, constants.ConditionReady)
+	var oldCond metav1.Condition
+	if old != nil {
+		oldCond = *old
+	}
+
+	cond := proxyCondition(status)
+	cond.ObservedGeneration = proxy.Generation
+	meta.SetStatusCondition(&proxy.Status.Conditions, cond)
+	proxies := make([]frpv1alpha1.FrpProxyClientStatus, 0, len(status))
+	for _, st := range status {
+		proxies = append(proxies, frpv1alpha1.FrpProxyClientStatus{
+			Client:     st.Client,
+			Name:       st.Name,
+			Status:     st.Status,
+			Error:      st.Err,
+			RemoteAddr: st.RemoteAddr,
+		})
+	}
+	if len(proxies) == 0 {
+		proxies = nil
+	}
+	proxy.Status.Proxies = proxies
+	if err := c.Status().Patch(ctx, proxy, patch); err != nil {
+		return err
+	}
+
+	if c.Recorder != nil && (old == nil || oldCond.Status != cond.Status || oldCond.Reason != cond.Reason) {
+		eventType := corev1.EventTypeNormal
+		if cond.Status != metav1.ConditionTrue {
+			eventType = corev1.EventTypeWarning
+		}
+		c.Recorder.Event(proxy, eventType, cond.Reason, cond.Message)
+	}
+	return nil
+}
+
+// IngressConditions reads the conditions written by the IngressStatusCollector
+func IngressConditions(ingress *networkingv1.Ingress) ([]metav1.Condition, error) {
+	data, ok := ingress.Annotations[constants.AnnotationStatus]
+	if !ok || data == "" {
+		return nil, nil
+	}
+	var conditions []metav1.Condition
+	if err := json.Unmarshal([]byte(data), &conditions); err != nil {
+		return nil, err
+	}
+	return conditions, nil
+}
+
+func proxyCondition(status []frp.ProxyStatus) metav1.Condition {
+	if len(status) == 0 {
+		return metav1.Condition{
+			Type:    constants.ConditionReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  constants.ReasonNoProxy,
+			Message: "no frp proxy is configured for the ingress",
+		}
+	}
+
+	var applyFailed, failed, pending []string
+	var unverified int
+	for _, st := range status {
+		switch st.Status {
+		case frp.ProxyPhaseRunning:
+		case frp.ProxyPhaseUnverified:
+			unverified++
+		case frp.ProxyPhaseApplyFailed:
+			applyFailed = append(applyFailed, describeProxyStatus(st))
+		case frp.ProxyPhaseStartError, frp.ProxyPhaseCheckFailed:
+			failed = append(failed, describeProxyStatus(st))
+		default:
+			pending = append(pending, describeProxyStatus(st))
+		}
+	}
+
+	switch {
+	case len(applyFailed) > 0:
+		return metav1.Condition{
+			Type:    constants.ConditionReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  constants.ReasonApplyFailed,
+			Message: strings.Join(append(applyFailed, failed...), "; "),
+		}
+	case len(failed) > 0:
+		return metav1.Condition{
+			Type:    constants.ConditionReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  constants.ReasonProxyStartError,
+			Message: strings.Join(append(failed, pending...), "; "),
+		}
+	case len(pending) > 0:
+		return metav1.Condition{
+			Type:    constants.ConditionReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  constants.ReasonProxyPending,
+			Message: strings.Join(pending, "; "),
+		}
+	case unverified > 0:
+		return metav1.Condition{
+			Type:    constants.ConditionReady,
+			Status:  metav1.ConditionUnknown,
+			Reason:  constants.ReasonProxyUnverified,
+			Message: fmt.Sprintf("%d of %d proxies delivered to ready frp clients which report no proxy status", unverified, len(status)),
+		}
+	}
+	return metav1.Condition{
+		Type:    constants.ConditionReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  constants.ReasonProxyRunning,
+		Message: fmt.Sprintf("%d proxies running", len(status)),
+	}
+}
+
+func describeProxyStatus(st frp.ProxyStatus) string {
+	if st.Err != "" {
+		return fmt.Sprintf("%s on %s: %s: %s", st.Name, st.Client, st.Status, st.Err)
+	}
+	return fmt.Sprintf("%s on %s: %s", st.Name, st.Client, st.Status)
+}
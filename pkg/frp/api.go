@@ -6,6 +6,7 @@ import "net/http"
 //subRouter.HandleFunc("/api/status", svr.apiStatus).Methods("GET")
 //subRouter.HandleFunc("/api/config", svr.apiGetConfig).Methods("GET")
 //subRouter.HandleFunc("/api/config", svr.apiPutConfig).Methods("PUT")
+//subRouter.HandleFunc("/api/stop", svr.apiStop).Methods("POST")
 
 type API interface {
 	Method() string
@@ -29,4 +30,6 @@ var (
 	ApiGetConfig API = &api{uri: "/api/config", method: http.MethodGet}
 	ApiPutConfig API = &api{uri: "/api/config", method: http.MethodPut}
 	ApiReload    API = &api{uri: "/api/reload", method: http.MethodGet}
+	ApiStatus    API = &api{uri: "/api/status", method: http.MethodGet}
+	ApiStop      API = &api{uri: "/api/stop", method: http.MethodPost}
 )
@@ -0,0 +1,482 @@
+package frp
+
+import (
+	"context"
+	"fmt"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clientPlan is the config a sync applies to a client and the outcome of the apply
+type clientPlan struct {
+	cli    Client
+	prefix string
+	// live is the config read from the client
+	live *Configs
+	// desired are the proxies placed on the client, proxy the config applied of them
+	desired Proxy
+	common  MapConfig
+	proxy   Proxy
+	// applied is recorded as applied instead of proxy when set, it keeps the drifted proxies left in place as applied
+	applied Proxy
+	// changed is set when the config differs from the live one, commonChanged when its [common] section does
+	changed       bool
+	commonChanged bool
+	// refused are the proxies left out of the config, by name
+	refused map[string]error
+	// quarantined are the proxies blamed for a failed apply, by name
+	quarantined map[string]quarantined
+	err         error
+}
+
+// quarantined is a proxy held back from a client after it failed an apply. A suspect proxy was changed together with
+// others by an apply failing without naming a proxy, the suspects are tried again one at a time.
+type quarantined struct {
+	cfg     Config
+	err     error
+	suspect bool
+}
+
+// plan computes the config of the client, s.mu must be held. The proxies the client can not carry or run and the
+// quarantined ones are left out, a quarantined proxy keeps its live config, except a single suspect which is tried
+// again. A quarantined proxy is released when its config changes.
+func (s *syncer) plan(cli Client, configs *Configs, desired Proxy, managed map[string]string) *clientPlan {
+	prefix, _ := s.proxyPrefix(cli)
+	p := &clientPlan{
+		cli:     cli,
+		prefix:  prefix,
+		live:    configs,
+		desired: desired,
+		proxy:   make(Proxy),
+		refused: make(map[string]error),
+	}
+	quarantine := s.quarantine[cli.Addr().String()]
+	for name, q := range quarantine {
+		if cfg, ok := desired[name]; !ok || !Equals(cfg, q.cfg) {
+			delete(quarantine, name)
+		}
+	}
+	probe := ""
+	for name, q := range quarantine {
+		if q.suspect && (probe == "" || name < probe) {
+			probe = name
+		}
+	}
+	for name, cfg := range desired {
+		if err := checkProxy(cli, name, cfg); err != nil {
+			p.refused[name] = err
+			continue
+		}
+		if q, ok := quarantine[name]; ok && name != probe {
+			p.refused[name] = q.err
+			if old, ok := configs.Proxy[prefix+name]; ok {
+				p.proxy[prefix+name] = old
+			}
+			continue
+		}
+		p.proxy[prefix+name] = cfg
+	}
+	p.common, p.commonChanged = mergeCommon(configs.Common, managed)
+	p.changed = !p.proxy.Equals(configs.Proxy) || p.commonChanged
+	return p
+}
+
+// keepDrifted leaves the proxies edited out of band as they are in the live config, s.mu must be held. A drifted proxy
+// the controller changed or deleted since it applied it is still applied.
+func (s *syncer) keepDrifted(p *clientPlan) {
+	addr := p.cli.Addr().String()
+	applied := s.applied[addr]
+	p.applied = p.proxy.Clone()
+	drifted := make(map[string]bool)
+	for _, e := range s.drifts[addr] {
+		drifted[e.Proxy] = true
+	}
+	for name := range drifted {
+		desired, isDesired := p.proxy[name]
+		old, wasApplied := applied[name]
+		if isDesired != wasApplied || isDesired && !Equals(desired, old) {
+			continue
+		}
+		if live, ok := p.live.Proxy[name]; ok {
+			p.proxy[name] = live
+		} else {
+			delete(p.proxy, name)
+		}
+		if wasApplied {
+			p.applied[name] = old
+		} else {
+			delete(p.applied, name)
+		}
+	}
+	p.changed = !p.proxy.Equals(p.live.Proxy) || p.commonChanged
+}
+
+// rollGroupKeys changes the keys of the load balancing groups without frps rejecting members, s.mu must be held.
+// frps keeps the key of the first member of a group and rejects the members joining with another key, so the clients
+// holding a group with its old key leave it but one, which then switches to the new key, and the other clients join
+// the group after it. Nothing is changed while a client is unreachable, it may hold the old key. It reports whether
+// the next step of the roll should be synced.
+func (s *syncer) rollGroupKeys(plans []*clientPlan, complete bool) bool {
+	keys := make(map[string]string)
+	for _, p := range plans {
+		for _, cfg := range p.desired {
+			if group, key := groupOf(cfg); group != "" {
+				keys[group] = key
+			}
+		}
+	}
+	// the plans of the clients holding the groups with another key, in the order of the clients
+	holders := make(map[string][]*clientPlan)
+	for _, p := range plans {
+		held := make(map[string]bool)
+		for _, cfg := range p.live.Proxy {
+			group, key := groupOf(cfg)
+			if want, ok := keys[group]; ok && key != want && !held[group] {
+				held[group] = true
+				holders[group] = append(holders[group], p)
+			}
+		}
+	}
+	if len(holders) == 0 {
+		return false
+	}
+	for group, h := range holders {
+		for _, p := range plans {
+			switch {
+			case !complete, p == h[0] && len(h) > 1:
+				p.keepGroup(group)
+			case p == h[0]:
+				// the last holder switches to the new key
+			default:
+				p.dropGroup(group)
+			}
+		}
+	}
+	changed := false
+	for _, p := range plans {
+		p.changed = !p.proxy.Equals(p.live.Proxy) || p.commonChanged
+		changed = changed || p.changed
+	}
+	return complete && changed
+}
+
+// groupOf returns the load balancing group of a proxy and its key, an empty group if it is not grouped
+func groupOf(cfg Config) (string, string) {
+	if !cfg.EnableGroup() {
+		return "", ""
+	}
+	m := cfg.ToMap()
+	return m["group"], m["group_key"]
+}
+
+// keepGroup leaves the proxies of the group as they are in the live config
+func (p *clientPlan) keepGroup(group string) {
+	for name, cfg := range p.proxy {
+		if g, _ := groupOf(cfg); g == group {
+			p.setProxy(name, nil)
+		}
+	}
+	for name, cfg := range p.live.Proxy {
+		if g, _ := groupOf(cfg); g == group {
+			p.setProxy(name, cfg)
+		}
+	}
+}
+
+// dropGroup leaves the proxies of the group out of the config
+func (p *clientPlan) dropGroup(group string) {
+	for name, cfg := range p.proxy {
+		if g, _ := groupOf(cfg); g == group {
+			p.setProxy(name, nil)
+		}
+	}
+}
+
+// setProxy sets the config of a proxy in the plan and in the proxies recorded as applied, nil removes it
+func (p *clientPlan) setProxy(name string, cfg Config) {
+	if cfg == nil {
+		delete(p.proxy, name)
+		delete(p.applied, name)
+		return
+	}
+	p.proxy[name] = cfg
+	if p.applied != nil {
+		p.applied[name] = cfg
+	}
+}
+
+// applyPlan applies the plan to the client. When the apply fails, the changed proxies it blames are quarantined and
+// the config is applied again without them, so that a bad proxy does not hold back every other change of the client.
+func (s *syncer) applyPlan(ctx context.Context, p *clientPlan) {
+	syncAttempts.WithLabelValues(p.cli.Addr().String()).Inc()
+	p.err = s.apply(ctx, p.cli, p.live, p.common, p.proxy)
+	if p.err == nil {
+		return
+	}
+	syncFailures.WithLabelValues(p.cli.Addr().String()).Inc()
+	blamed := blameProxies(p.live.Proxy, p.proxy, p.err)
+	if len(blamed) == 0 {
+		return
+	}
+	log.FromContext(ctx).Info("quarantine proxies failing the apply", "client", p.cli.Addr(), "proxies", len(blamed))
+	p.quarantined = make(map[string]quarantined, len(blamed))
+	retry := p.proxy.Clone()
+	for name, suspect := range blamed {
+		p.quarantined[strings.TrimPrefix(name, p.prefix)] = quarantined{cfg: p.proxy[name], err: p.err, suspect: suspect}
+		p.refused[strings.TrimPrefix(name, p.prefix)] = p.err
+		if old, ok := p.live.Proxy[name]; ok {
+			retry[name] = old
+		} else {
+			delete(retry, name)
+		}
+		if p.applied != nil {
+			delete(p.applied, name)
+		}
+	}
+	p.proxy = retry
+	p.changed = !retry.Equals(p.live.Proxy) || p.commonChanged
+	p.err = nil
+	if p.changed {
+		syncAttempts.WithLabelValues(p.cli.Addr().String()).Inc()
+		if p.err = s.apply(ctx, p.cli, p.live, p.common, retry); p.err != nil {
+			syncFailures.WithLabelValues(p.cli.Addr().String()).Inc()
+		}
+	}
+}
+
+// blameProxies returns the changed proxies a failed apply is blamed on: the ones named in the error, or every changed
+// proxy as a suspect when several changed and none is named
+func blameProxies(old, proxy Proxy, err error) map[string]bool {
+	reason := err.Error()
+	var changed []string
+	for name, cfg := range proxy {
+		if oldCfg, ok := old[name]; !ok || !Equals(cfg, oldCfg) {
+			changed = append(changed, name)
+		}
+	}
+	blamed := make(map[string]bool)
+	for _, name := range changed {
+		if namedInError(reason, name) {
+			blamed[name] = false
+		}
+	}
+	if len(blamed) > 0 {
+		return blamed
+	}
+	for _, name := range changed {
+		blamed[name] = len(changed) > 1
+	}
+	return blamed
+}
+
+// namedInError reports whether frp names the proxy in the error, as [name], "name" or `proxy name` followed by a
+// separator. A bare substring would blame the proxies whose name is a prefix of the named one, e.g. ns/a:http for
+// ns/a:https.
+func namedInError(reason, name string) bool {
+	if strings.Contains(reason, "["+name+"]") || strings.Contains(reason, `"`+name+`"`) {
+		return true
+	}
+	for rest := reason; ; {
+		i := strings.Index(rest, "proxy "+name)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len("proxy "+name):]
+		if rest == "" || strings.ContainsRune(" :,;)", rune(rest[0])) {
+			return true
+		}
+	}
+}
+
+// record records the outcome of the plan, s.mu must be held. The clients removed meanwhile are ignored.
+func (s *syncer) record(ctx context.Context, p *clientPlan) {
+	if !containsClient(s.clients, p.cli) {
+		return
+	}
+	addr := p.cli.Addr().String()
+	if len(p.quarantined) > 0 {
+		if s.quarantine == nil {
+			s.quarantine = make(map[string]map[string]quarantined)
+		}
+		if s.quarantine[addr] == nil {
+			s.quarantine[addr] = make(map[string]quarantined)
+		}
+		for name, q := range p.quarantined {
+			s.quarantine[addr][name] = q
+		}
+	}
+	if p.err != nil {
+		log.FromContext(ctx).Error(p.err, "apply config error", "client", p.cli.Addr())
+		s.recordFailure(p.cli, p.live.Proxy, p.proxy, p.err)
+		s.recordRefused(p.cli, p.refused)
+		return
+	}
+	for name, q := range s.quarantine[addr] {
+		// a suspect tried again passed the apply
+		if cfg, ok := p.proxy[p.prefix+name]; ok && p.quarantined[name].cfg == nil && Equals(cfg, q.cfg) {
+			delete(s.quarantine[addr], name)
+		}
+	}
+	if p.applied != nil {
+		s.applied[addr] = p.applied.Clone()
+	} else {
+		s.applied[addr] = p.proxy.Clone()
+	}
+	if p.changed {
+		if p.commonChanged {
+			if s.restarts == nil {
+				s.restarts = make(map[Client]bool)
+			}
+			s.restarts[p.cli] = true
+		}
+		syncSuccesses.WithLabelValues(addr).Inc()
+	}
+	lastSuccessfulSync.WithLabelValues(addr).SetToCurrentTime()
+	s.clearFailures(p.cli)
+	s.recordRefused(p.cli, p.refused)
+}
+
+// apply pushes the [common] section and the proxies to the client as a transaction: the config read from the client
+// is kept as a snapshot and restored when the reload fails or the new proxies do not show up in the status of the
+// client.
+func (s *syncer) apply(ctx context.Context, cli Client, snapshot *Configs, common MapConfig, proxy Proxy) error {
+	next := &Configs{
+		Common: common,
+		Proxy:  proxy,
+	}
+	start := time.Now()
+	err := cli.SetConfig(ctx, next)
+	observeRequest(cli, operationPut, start)
+	if err != nil {
+		return fmt.Errorf("set config: %w", err)
+	}
+	start = time.Now()
+	err = cli.Reload(ctx)
+	observeRequest(cli, operationReload, start)
+	if err != nil {
+		s.rollback(ctx, cli, snapshot)
+		return fmt.Errorf("reload config: %w", err)
+	}
+	if err := verify(ctx, cli, proxy); err != nil {
+		s.rollback(ctx, cli, snapshot)
+		return fmt.Errorf("verify config: %w", err)
+	}
+	return nil
+}
+
+func (s *syncer) rollback(ctx context.Context, cli Client, snapshot *Configs) {
+	l := log.FromContext(ctx)
+	l.Info("rollback config", "client", cli.Addr())
+	if err := cli.SetConfig(ctx, snapshot); err != nil {
+		l.Error(err, "rollback set config error", "client", cli.Addr())
+		return
+	}
+	if err := cli.Reload(ctx); err != nil {
+		l.Error(err, "rollback reload config error", "client", cli.Addr())
+	}
+}
+
+// verify waits until every proxy is known to the client
+func verify(ctx context.Context, cli Client, proxy Proxy) error {
+	ctx, cancel := context.WithTimeout(ctx, constants.FrpVerifyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(constants.FrpVerifyInterval)
+	defer ticker.Stop()
+	for {
+		missing, err := missingProxies(ctx, cli, proxy)
+		if err == nil && len(missing) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("proxies not loaded: %s", strings.Join(missing, ", "))
+		case <-ticker.C:
+		}
+	}
+}
+
+func missingProxies(ctx context.Context, cli Client, proxy Proxy) ([]string, error) {
+	status, err := cli.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(status))
+	for _, st := range status {
+		live[st.Name] = true
+	}
+	var missing []string
+	for name := range proxy {
+		if !live[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// recordFailure attributes a failed apply to the keys whose proxies are named in the error, or otherwise to
+// every key with a proxy changed by the apply.
+func (s *syncer) recordFailure(cli Client, old, proxy Proxy, err error) {
+	owners := s.owners()
+	reason := err.Error()
+	prefix, _ := s.proxyPrefix(cli)
+
+	offending := make(map[string]bool)
+	for name := range proxy {
+		if namedInError(reason, name) {
+			offending[owners[strings.TrimPrefix(name, prefix)]] = true
+		}
+	}
+	if len(offending) == 0 {
+		for name, cfg := range proxy {
+			if oldCfg, ok := old[name]; !ok || !Equals(cfg, oldCfg) {
+				offending[owners[strings.TrimPrefix(name, prefix)]] = true
+			}
+		}
+	}
+
+	addr := cli.Addr().String()
+	for key := range offending {
+		if key == "" {
+			continue
+		}
+		if s.failures[key] == nil {
+			s.failures[key] = make(map[string]string)
+		}
+		s.failures[key][addr] = reason
+	}
+}
+
+// recordRefused records the proxies left out of the config of the client as failures of their keys, the other
+// proxies are applied without them
+func (s *syncer) recordRefused(cli Client, refused map[string]error) {
+	owners := s.owners()
+	addr := cli.Addr().String()
+	for name, err := range refused {
+		key := owners[name]
+		if key == "" {
+			continue
+		}
+		if s.failures[key] == nil {
+			s.failures[key] = make(map[string]string)
+		}
+		s.failures[key][addr] = err.Error()
+	}
+}
+
+func (s *syncer) clearFailures(cli Client) {
+	addr := cli.Addr().String()
+	for key, reasons := range s.failures {
+		delete(reasons, addr)
+		if len(reasons) == 0 {
+			delete(s.failures, key)
+		}
+	}
+}
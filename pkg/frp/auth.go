@@ -1,9 +1,17 @@
 package frp
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 type Auth interface {
-	SetAuth(r *http.Request)
+	SetAuth(r *http.Request) error
 }
 
 type BasicAuth struct {
@@ -15,6 +23,190 @@ func NewBasicAuth(username string, password string) Auth {
 	return &BasicAuth{Username: username, Password: password}
 }
 
-func (b *BasicAuth) SetAuth(r *http.Request) {
+func (b *BasicAuth) SetAuth(r *http.Request) error {
 	r.SetBasicAuth(b.Username, b.Password)
+	return nil
+}
+
+// BearerAuth authenticates with a bearer token, e.g. to an authenticating proxy in front of the admin api
+type BearerAuth struct {
+	Token string
+}
+
+func NewBearerAuth(token string) Auth {
+	return &BearerAuth{Token: token}
+}
+
+func (b *BearerAuth) SetAuth(r *http.Request) error {
+	r.Header.Set("Authorization", "Bearer "+b.Token)
+	return nil
+}
+
+// FileBasicAuth reads the username and the password from files, e.g. the keys of a mounted Secret
+type FileBasicAuth struct {
+	Username *File
+	Password *File
+}
+
+func NewFileBasicAuth(usernameFile string, passwordFile string) Auth {
+	return &FileBasicAuth{Username: NewFile(usernameFile), Password: NewFile(passwordFile)}
+}
+
+func (b *FileBasicAuth) SetAuth(r *http.Request) error {
+	username, err := b.Username.ReadString()
+	if err != nil {
+		return err
+	}
+	password, err := b.Password.ReadString()
+	if err != nil {
+		return err
+	}
+	r.SetBasicAuth(username, password)
+	return nil
+}
+
+// FileBearerAuth reads the bearer token from a file, e.g. a key of a mounted Secret
+type FileBearerAuth struct {
+	Token *File
+}
+
+func NewFileBearerAuth(tokenFile string) Auth {
+	return &FileBearerAuth{Token: NewFile(tokenFile)}
+}
+
+func (b *FileBearerAuth) SetAuth(r *http.Request) error {
+	token, err := b.Token.ReadString()
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// File is a file read again whenever it changes. kubelet updates a mounted Secret by swapping the files, so the
+// rotated credentials are picked up without a restart.
+type File struct {
+	Path string
+
+	info os.FileInfo
+	data []byte
+	mu   sync.Mutex
+}
+
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// Read returns the content of the file, it is only read again when the file changed since the last read
+func (f *File) Read() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if f.info != nil && os.SameFile(f.info, info) && f.info.ModTime().Equal(info.ModTime()) && f.info.Size() == info.Size() {
+		return f.data, nil
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	f.info, f.data = info, data
+	return data, nil
+}
+
+// ReadString returns the content of the file without the trailing line break
+func (f *File) ReadString() (string, error) {
+	data, err := f.Read()
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimRight(string(data), "\r\n")
+	if s == "" {
+		return "", fmt.Errorf("%s is empty", f.Path)
+	}
+	return s, nil
+}
+
+// RotatingAuth is an Auth whose credentials are rotated: a frpc keeps the admin credentials it started with, so the
+// admin api is tried again with the previous credentials when it rejects the current ones
+type RotatingAuth interface {
+	Auth
+	// SetPreviousAuth sets the previous credentials, it reports false when there are none
+	SetPreviousAuth(r *http.Request) (bool, error)
+	// Accepted records which credentials the admin api of the host accepted
+	Accepted(host string, previous bool)
+}
+
+// RotatingBasicAuth is a RotatingAuth of a username with a current and a previous password
+type RotatingBasicAuth struct {
+	username         string
+	password         string
+	previousPassword string
+	// previous are the hosts which last accepted the previous password, and when
+	previous map[string]time.Time
+	mu       sync.Mutex
+}
+
+func NewRotatingBasicAuth(username string, password string, previousPassword string) *RotatingBasicAuth {
+	return &RotatingBasicAuth{
+		username:         username,
+		password:         password,
+		previousPassword: previousPassword,
+		previous:         make(map[string]time.Time),
+	}
+}
+
+// Set replaces the credentials
+func (a *RotatingBasicAuth) Set(username string, password string, previousPassword string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.password != password {
+		a.previous = make(map[string]time.Time)
+	}
+	a.username, a.password, a.previousPassword = username, password, previousPassword
+}
+
+func (a *RotatingBasicAuth) SetAuth(r *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+func (a *RotatingBasicAuth) SetPreviousAuth(r *http.Request) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.previousPassword == "" || a.previousPassword == a.password {
+		return false, nil
+	}
+	r.SetBasicAuth(a.username, a.previousPassword)
+	return true, nil
+}
+
+func (a *RotatingBasicAuth) Accepted(host string, previous bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if previous {
+		a.previous[host] = time.Now()
+	} else {
+		delete(a.previous, host)
+	}
+}
+
+// PreviousHosts returns the sorted hosts which accepted the previous password since the time, they run with the
+// previous password until they restart
+func (a *RotatingBasicAuth) PreviousHosts(since time.Time) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var hosts []string
+	for host, at := range a.previous {
+		if !at.Before(since) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
 }
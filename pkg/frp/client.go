@@ -3,10 +3,12 @@ package frp
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sync"
 )
 
 type Client interface {
@@ -14,21 +16,75 @@ type Client interface {
 	GetConfigs(ctx context.Context) (*Configs, error)
 	SetConfig(ctx context.Context, config *Configs) error
 	Reload(ctx context.Context) error
+	Status(ctx context.Context) ([]ProxyStatus, error)
+	// Stop stops frpc, which is restarted by its supervisor, e.g. kubelet
+	Stop(ctx context.Context) error
 }
 
-func NewClient(addr net.IP, port uint16, uname, passwd string) Client {
+// formatClient is implemented by the clients knowing the config format of their frpc, "" while it is unknown
+type formatClient interface {
+	Format() string
+}
+
+// clientFormat returns the config format of the client, ini for the clients not knowing it
+func clientFormat(cli Client) string {
+	if f, ok := cli.(formatClient); ok && f.Format() != "" {
+		return f.Format()
+	}
+	return FormatIni
+}
+
+// proxyChecker is implemented by the clients which can not run every proxy
+type proxyChecker interface {
+	CheckProxy(name string, cfg Config) error
+}
+
+// certFileClient is implemented by the clients writing the inline certificates of the proxies to files
+type certFileClient interface {
+	writesCertFiles() bool
+}
+
+// checkProxy reports an error when the client can not be given the proxy, in its config format or at all
+func checkProxy(cli Client, name string, cfg Config) error {
+	c, ok := cli.(certFileClient)
+	if err := CheckFormat(clientFormat(cli), name, cfg, ok && c.writesCertFiles()); err != nil {
+		return err
+	}
+	if c, ok := cli.(proxyChecker); ok {
+		return c.CheckProxy(name, cfg)
+	}
+	return nil
+}
+
+// NewClient creates a client of the frpc admin API. A nil codec detects the config format
+// from the first GetConfigs response, a nil tlsConfig talks plain http.
+func NewClient(addr net.IP, port uint16, auth Auth, tlsConfig *tls.Config, codec Codec) Client {
 	client := &http.Client{}
+	scheme := "http"
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+		scheme = "https"
+	}
 	return &frpClient{
-		cli:  client,
-		addr: &net.TCPAddr{IP: addr, Port: int(port)},
-		auth: NewBasicAuth(uname, passwd),
+		cli:    client,
+		scheme: scheme,
+		addr:   &net.TCPAddr{IP: addr, Port: int(port)},
+		auth:   auth,
+		codec:  codec,
 	}
 }
 
 type frpClient struct {
-	cli  *http.Client
-	addr *net.TCPAddr
-	auth Auth
+	cli    *http.Client
+	scheme string
+	addr   *net.TCPAddr
+	auth   Auth
+	// codec is detected by the first GetConfigs when it is not set, sync and the status readers call GetConfigs
+	// concurrently
+	codec   Codec
+	codecMu sync.Mutex
 }
 
 func (c *frpClient) Addr() *net.TCPAddr {
@@ -36,96 +92,136 @@ func (c *frpClient) Addr() *net.TCPAddr {
 }
 
 func (c *frpClient) Reload(ctx context.Context) error {
-	request, err := http.NewRequest(ApiReload.Method(), c.buildPath(ApiReload.URI()), nil)
-	request.WithContext(ctx)
+	_, err := c.do(ctx, ApiReload, nil)
+	return err
+}
+
+func (c *frpClient) Stop(ctx context.Context) error {
+	_, err := c.do(ctx, ApiStop, nil)
+	return err
+}
+
+func (c *frpClient) GetConfigs(ctx context.Context) (*Configs, error) {
+	body, err := c.do(ctx, ApiGetConfig, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	cfg, err := c.detectCodec(body).Unmarshal(body)
+	if err != nil {
+		return nil, err
 	}
-	if c.auth != nil {
-		c.auth.SetAuth(request)
+	return cfg, nil
+}
+
+func (c *frpClient) SetConfig(ctx context.Context, configs *Configs) error {
+	codec := c.getCodec()
+	if codec == nil {
+		codec = IniCodec
 	}
+	data, err := codec.Marshal(configs)
 	if err != nil {
 		return err
 	}
-	response, err := c.cli.Do(request)
+	_, err = c.do(ctx, ApiPutConfig, data)
+	return err
+}
 
-	if response.StatusCode != http.StatusOK {
-		msg, _ := io.ReadAll(response.Body)
-		if len(msg) > 0 {
-			return fmt.Errorf("err code: %d, msg: %s", response.StatusCode, string(msg))
-		} else {
-			return fmt.Errorf("err code: %d", response.StatusCode)
-		}
+// Format is the config format of the frpc, "" until the first GetConfigs detects it
+func (c *frpClient) Format() string {
+	if codec := c.getCodec(); codec != nil {
+		return codec.Format()
 	}
-	return nil
+	return ""
 }
 
-func (c *frpClient) GetConfigs(ctx context.Context) (*Configs, error) {
-	request, err := http.NewRequest(ApiGetConfig.Method(), c.buildPath(ApiGetConfig.URI()), nil)
-	request.WithContext(ctx)
+func (c *frpClient) getCodec() Codec {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	return c.codec
+}
+
+// detectCodec returns the codec of the client, detected from the config when it is not set yet
+func (c *frpClient) detectCodec(body []byte) Codec {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	if c.codec == nil {
+		c.codec = DetectCodec(body)
+	}
+	return c.codec
+}
+
+func (c *frpClient) Status(ctx context.Context) ([]ProxyStatus, error) {
+	body, err := c.do(ctx, ApiStatus, nil)
 	if err != nil {
 		return nil, err
 	}
-	if c.auth != nil {
-		c.auth.SetAuth(request)
-	}
+	return UnmarshalStatus(body)
+}
+
+func (c *frpClient) do(ctx context.Context, api API, data []byte) ([]byte, error) {
+	response, err := c.send(ctx, api, data, false)
 	if err != nil {
 		return nil, err
 	}
-	response, err := c.cli.Do(request)
-	if err != nil {
-		return nil, err
+	if rotating, ok := c.auth.(RotatingAuth); ok {
+		previous := false
+		if response.StatusCode == http.StatusUnauthorized {
+			// the frpc may still run with the previous credentials
+			retry, err := c.send(ctx, api, data, true)
+			if err != nil {
+				response.Body.Close()
+				return nil, err
+			}
+			if retry != nil {
+				response.Body.Close()
+				response, previous = retry, true
+			}
+		}
+		if response.StatusCode == http.StatusOK {
+			rotating.Accepted(c.addr.String(), previous)
+		}
 	}
+	defer response.Body.Close()
+
+	msg, err := io.ReadAll(response.Body)
 	if response.StatusCode != http.StatusOK {
-		msg, _ := io.ReadAll(response.Body)
 		if len(msg) > 0 {
 			return nil, fmt.Errorf("err code: %d, msg: %s", response.StatusCode, string(msg))
 		} else {
 			return nil, fmt.Errorf("err code: %d", response.StatusCode)
 		}
 	}
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	cfg, err := Unmarshal(body)
 	if err != nil {
 		return nil, err
 	}
-	return cfg, nil
+	return msg, nil
 }
 
-func (c *frpClient) SetConfig(ctx context.Context, configs *Configs) error {
-	data := Marshal(configs)
-	request, err := http.NewRequest(ApiPutConfig.Method(), c.buildPath(ApiPutConfig.URI()), io.NopCloser(bytes.NewReader(data)))
-	request.WithContext(ctx)
-	if err != nil {
-		return err
-	}
-	if c.auth != nil {
-		c.auth.SetAuth(request)
-	}
-	if err != nil {
-		return err
-	}
-
-	response, err := c.cli.Do(request)
+// send sends a request to the admin api, with the previous credentials of a RotatingAuth if previous is set.
+// It returns a nil response when there are no previous credentials.
+func (c *frpClient) send(ctx context.Context, api API, data []byte, previous bool) (*http.Response, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, api.Method(), c.buildPath(api.URI()), body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if response.StatusCode != http.StatusOK {
-		msg, _ := io.ReadAll(response.Body)
-		if len(msg) > 0 {
-			return fmt.Errorf("err code: %d, msg: %s", response.StatusCode, string(msg))
-		} else {
-			return fmt.Errorf("err code: %d", response.StatusCode)
+	if previous {
+		ok, err := c.auth.(RotatingAuth).SetPreviousAuth(request)
+		if err != nil || !ok {
+			return nil, err
+		}
+	} else if c.auth != nil {
+		if err := c.auth.SetAuth(request); err != nil {
+			return nil, fmt.Errorf("set admin api credentials: %w", err)
 		}
 	}
-	return nil
+	return c.cli.Do(request)
 }
 
 func (c *frpClient) buildPath(api string) string {
-	return fmt.Sprintf("http://%s%s", c.addr.String(), api)
+	return fmt.Sprintf("%s://%s%s", c.scheme, c.addr.String(), api)
 }
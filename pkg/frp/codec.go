@@ -0,0 +1,503 @@
+package frp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatAuto = "auto"
+	FormatIni  = "ini"
+	FormatToml = "toml"
+	FormatYaml = "yaml"
+	FormatJson = "json"
+)
+
+// Codec converts Configs from and to the configuration file format served by the frpc admin API.
+// Configs always holds the legacy INI keys, codecs of newer formats translate them.
+type Codec interface {
+	Format() string
+	Marshal(config *Configs) ([]byte, error)
+	Unmarshal(data []byte) (*Configs, error)
+}
+
+// NewCodec returns the codec of the given format. FormatAuto returns a nil Codec,
+// which lets the client detect the format from the config served by frpc.
+func NewCodec(format string) (Codec, error) {
+	switch strings.ToLower(format) {
+	case "", FormatAuto:
+		return nil, nil
+	case FormatIni:
+		return IniCodec, nil
+	case FormatToml:
+		return TomlCodec, nil
+	case FormatYaml, "yml":
+		return YamlCodec, nil
+	case FormatJson:
+		return JsonCodec, nil
+	}
+	return nil, fmt.Errorf("unknown frp config format: %s", format)
+}
+
+var iniSection = regexp.MustCompile(`(?m)^\s*\[([^\[\].]+)]\s*$`)
+
+// DetectCodec guesses the format of a config file. frpc before v0.52 only understands INI files,
+// newer releases read TOML, YAML or JSON. The format is guessed from the config rather than from the frpc
+// version, which the frpc admin api does not report: the served config is the only hint, and it is the file
+// frpc reads again on reload.
+func DetectCodec(data []byte) Codec {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0:
+		return IniCodec
+	case trimmed[0] == '{':
+		return JsonCodec
+	case hasIniSection(trimmed):
+		return IniCodec
+	}
+	var doc map[string]any
+	if _, err := toml.Decode(string(trimmed), &doc); err == nil {
+		return TomlCodec
+	}
+	return YamlCodec
+}
+
+// hasIniSection reports whether the config has a section which is not a table of the frp v1 client config. A
+// proxies-only INI file may be valid TOML too, but frp v1 configs put their proxies in [[proxies]] arrays and only
+// have a few top level tables.
+func hasIniSection(data []byte) bool {
+	for _, m := range iniSection.FindAllSubmatch(data, -1) {
+		if !v1Tables[strings.TrimSpace(string(m[1]))] {
+			return true
+		}
+	}
+	return false
+}
+
+// v1Tables are the top level tables of the frp v1 client config
+var v1Tables = func() map[string]bool {
+	tables := map[string]bool{"metadatas": true, "start": true, "featureGates": true, "virtualNet": true}
+	for _, m := range commonKeys {
+		if i := strings.Index(m.path, "."); i > 0 {
+			tables[m.path[:i]] = true
+		}
+	}
+	return tables
+}()
+
+var (
+	IniCodec  Codec = iniCodec{}
+	TomlCodec Codec = &structuredCodec{format: FormatToml, encode: encodeToml, decode: decodeToml}
+	YamlCodec Codec = &structuredCodec{format: FormatYaml, encode: yaml.Marshal, decode: decodeYaml}
+	JsonCodec Codec = &structuredCodec{format: FormatJson, encode: encodeJson, decode: decodeJson}
+)
+
+type iniCodec struct{}
+
+func (iniCodec) Format() string {
+	return FormatIni
+}
+
+func (iniCodec) Marshal(config *Configs) ([]byte, error) {
+	return Marshal(config)
+}
+
+func (iniCodec) Unmarshal(data []byte) (*Configs, error) {
+	return Unmarshal(data)
+}
+
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindInt
+	kindBool
+	kindList
+)
+
+type keyMapping struct {
+	path string
+	kind valueKind
+}
+
+// commonKeys maps the legacy [common] keys to their path in the frp v1 client config.
+var commonKeys = map[string]keyMapping{
+	"server_addr":           {path: "serverAddr"},
+	"server_port":           {path: "serverPort", kind: kindInt},
+	"user":                  {path: "user"},
+	"token":                 {path: "auth.token"},
+	"authentication_method": {path: "auth.method"},
+	"admin_addr":            {path: "webServer.addr"},
+	"admin_port":            {path: "webServer.port", kind: kindInt},
+	"admin_user":            {path: "webServer.user"},
+	"admin_pwd":             {path: "webServer.password"},
+	"protocol":              {path: "transport.protocol"},
+	"pool_count":            {path: "transport.poolCount", kind: kindInt},
+	"tcp_mux":               {path: "transport.tcpMux", kind: kindBool},
+	"heartbeat_interval":    {path: "transport.heartbeatInterval", kind: kindInt},
+	"heartbeat_timeout":     {path: "transport.heartbeatTimeout", kind: kindInt},
+	"tls_enable":            {path: "transport.tls.enable", kind: kindBool},
+	"tls_cert_file":         {path: "transport.tls.certFile"},
+	"tls_key_file":          {path: "transport.tls.keyFile"},
+	"tls_trusted_ca_file":   {path: "transport.tls.trustedCaFile"},
+	"tls_server_name":       {path: "transport.tls.serverName"},
+	"log_file":              {path: "log.to"},
+	"log_level":             {path: "log.level"},
+	"log_max_days":          {path: "log.maxDays", kind: kindInt},
+	"login_fail_exit":       {path: "loginFailExit", kind: kindBool},
+	"dns_server":            {path: "dnsServer"},
+}
+
+// proxyKeys maps the legacy proxy keys to their path in a frp v1 proxy. plugin_ keys are moved into the plugin table
+// and converted to camelCase, dotted keys are taken as v1 paths. CheckFormat refuses the other keys, whose path would
+// be guessed.
+var proxyKeys = map[string]keyMapping{
+	"type":                       {path: "type"},
+	"local_ip":                   {path: "localIP"},
+	"local_port":                 {path: "localPort", kind: kindInt},
+	"remote_port":                {path: "remotePort", kind: kindInt},
+	"custom_domains":             {path: "customDomains", kind: kindList},
+	"subdomain":                  {path: "subdomain"},
+	"locations":                  {path: "locations", kind: kindList},
+	"group":                      {path: "loadBalancer.group"},
+	"group_key":                  {path: "loadBalancer.groupKey"},
+	"http_user":                  {path: "httpUser"},
+	"http_pwd":                   {path: "httpPassword"},
+	"host_header_rewrite":        {path: "hostHeaderRewrite"},
+	"header_X-From-Where":        {path: "requestHeaders.set.x-from-where"},
+	"use_encryption":             {path: "transport.useEncryption", kind: kindBool},
+	"use_compression":            {path: "transport.useCompression", kind: kindBool},
+	"bandwidth_limit":            {path: "transport.bandwidthLimit"},
+	"proxy_protocol_version":     {path: "transport.proxyProtocolVersion"},
+	"health_check_type":          {path: "healthCheck.type"},
+	"sk":                         {path: "secretKey"},
+	"plugin":                     {path: "plugin.type"},
+	"plugin_http_passwd":         {path: "plugin.httpPassword"},
+	"plugin_user":                {path: "plugin.username"},
+	"plugin_passwd":              {path: "plugin.password"},
+	"plugin_local_addr":          {path: "plugin.localAddr"},
+	"plugin_host_header_rewrite": {path: "plugin.hostHeaderRewrite"},
+}
+
+// forkKeys are the keys of the frproc fork which frp v1 lacks, its frpc refuses the configs holding unknown keys
+var forkKeys = []string{"redirect", "tls_crts", "tls_keys"}
+
+// inlineCertKeys hold the certificate and key of a https plugin inline. frp v1 only reads them from the files of path,
+// which only the Secret delivery writes.
+var inlineCertKeys = []struct {
+	inline, path, ext string
+}{
+	{inline: "plugin_crt_base64", path: "plugin_crt_path", ext: "crt"},
+	{inline: "plugin_key_base64", path: "plugin_key_path", ext: "key"},
+}
+
+// CheckFormat reports an error when the proxy can not be written in the config format. certFiles tells whether the
+// inline certificates of the proxy are written to files.
+func CheckFormat(format string, name string, cfg Config, certFiles bool) error {
+	if format == "" || format == FormatIni {
+		return nil
+	}
+	m := cfg.ToMap()
+	if m["type"] == TypeServerHttps {
+		return fmt.Errorf("proxy %s: the %s proxy type of the frproc fork can not be written in the %s format, frp v1 lacks it", name, TypeServerHttps, format)
+	}
+	for _, k := range forkKeys {
+		if _, ok := m[k]; ok {
+			return fmt.Errorf("proxy %s: %s of the frproc fork can not be written in the %s format, frp v1 lacks it", name, k, format)
+		}
+	}
+	if !certFiles {
+		for _, k := range inlineCertKeys {
+			if _, ok := m[k.inline]; ok {
+				return fmt.Errorf("proxy %s: %s can not be written in the %s format, frp v1 only reads certificates from files, which only the secret delivery writes", name, k.inline, format)
+			}
+		}
+	}
+	var err error
+	foreach(m, func(k string, _ string) bool {
+		if !proxyKeyMapped(k) {
+			err = fmt.Errorf("proxy %s: %s has no known path in the %s format, set the frp v1 path instead, e.g. transport.bandwidthLimitMode", name, k, format)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// proxyKeyMapped reports whether a legacy proxy key has a known path in a frp v1 proxy
+func proxyKeyMapped(k string) bool {
+	_, ok := proxyKeys[k]
+	return ok || strings.HasPrefix(k, "plugin_") || strings.Contains(k, ".")
+}
+
+// structuredCodec translates Configs into the frp v1 document layout, a top level client
+// config with a `proxies` array, and leaves the byte encoding to encode and decode.
+type structuredCodec struct {
+	format string
+	encode func(v any) ([]byte, error)
+	decode func(data []byte) (map[string]any, error)
+}
+
+func (c *structuredCodec) Format() string {
+	return c.format
+}
+
+func (c *structuredCodec) Marshal(config *Configs) ([]byte, error) {
+	if config == nil {
+		return nil, nil
+	}
+	doc := make(map[string]any)
+	foreach(config.Common, func(k string, v string) bool {
+		setPath(doc, mapKey(commonKeys, k, ""), v)
+		return true
+	})
+	proxies := make([]map[string]any, 0, len(config.Proxy))
+	foreach(config.Proxy, func(name string, cfg Config) bool {
+		proxy := map[string]any{"name": name}
+		foreach(cfg.ToMap(), func(k string, v string) bool {
+			setPath(proxy, mapKey(proxyKeys, k, "plugin_"), v)
+			return true
+		})
+		proxies = append(proxies, proxy)
+		return true
+	})
+	if len(proxies) > 0 {
+		doc["proxies"] = proxies
+	}
+	return c.encode(doc)
+}
+
+func (c *structuredCodec) Unmarshal(data []byte) (*Configs, error) {
+	doc, err := c.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	configs := &Configs{
+		Common: make(MapConfig),
+		Proxy:  make(Proxy),
+	}
+	for k, v := range doc {
+		switch k {
+		case "proxies":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("proxies should be an array, got %T", v)
+			}
+			for i, item := range list {
+				proxy, ok := item.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("proxies[%d] should be a table, got %T", i, item)
+				}
+				name, _ := proxy["name"].(string)
+				if name == "" {
+					return nil, fmt.Errorf("proxies[%d] has no name", i)
+				}
+				m := make(map[string]string)
+				flatten(proxy, "", reverseKeys(proxyKeys), "plugin_", m)
+				delete(m, "name")
+				configs.Proxy[name] = NewConfig(m)
+			}
+		case "visitors", "includes":
+			// visitors and included files are not managed by the controller
+		default:
+			flatten(map[string]any{k: v}, "", reverseKeys(commonKeys), "", configs.Common)
+		}
+	}
+	return configs, nil
+}
+
+// mapKey returns the path of a legacy key together with the type of its value.
+func mapKey(keys map[string]keyMapping, k string, nestedPrefix string) keyMapping {
+	if m, ok := keys[k]; ok {
+		return m
+	}
+	if strings.Contains(k, ".") {
+		return keyMapping{path: k}
+	}
+	if nestedPrefix != "" && strings.HasPrefix(k, nestedPrefix) {
+		return keyMapping{path: strings.TrimSuffix(nestedPrefix, "_") + "." + snakeToCamel(strings.TrimPrefix(k, nestedPrefix))}
+	}
+	return keyMapping{path: snakeToCamel(k)}
+}
+
+func reverseKeys(keys map[string]keyMapping) map[string]string {
+	r := make(map[string]string, len(keys))
+	for k, m := range keys {
+		r[m.path] = k
+	}
+	return r
+}
+
+func setPath(doc map[string]any, m keyMapping, v string) {
+	segments := strings.Split(m.path, ".")
+	for _, seg := range segments[:len(segments)-1] {
+		next, ok := doc[seg].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			doc[seg] = next
+		}
+		doc = next
+	}
+	doc[segments[len(segments)-1]] = typedValue(m.kind, v)
+}
+
+func typedValue(kind valueKind, v string) any {
+	switch kind {
+	case kindInt:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+	case kindBool:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	case kindList:
+		items := strings.Split(v, ",")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		return items
+	}
+	return v
+}
+
+func flatten(doc map[string]any, prefix string, keys map[string]string, nestedPrefix string, out map[string]string) {
+	for k, v := range doc {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			flatten(nested, path, keys, nestedPrefix, out)
+			continue
+		}
+		out[legacyKey(keys, path, nestedPrefix)] = stringValue(v)
+	}
+}
+
+func legacyKey(keys map[string]string, path string, nestedPrefix string) string {
+	if k, ok := keys[path]; ok {
+		return k
+	}
+	if nestedPrefix != "" && strings.HasPrefix(path, strings.TrimSuffix(nestedPrefix, "_")+".") {
+		rest := strings.TrimPrefix(path, strings.TrimSuffix(nestedPrefix, "_")+".")
+		if !strings.Contains(rest, ".") {
+			return nestedPrefix + camelToSnake(rest)
+		}
+	}
+	if strings.Contains(path, ".") {
+		return path
+	}
+	return camelToSnake(path)
+}
+
+func stringValue(v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []any:
+		items := make([]string, len(val))
+		for i := range val {
+			items[i] = stringValue(val[i])
+		}
+		return strings.Join(items, ",")
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func camelToSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func encodeToml(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeToml(data []byte) (map[string]any, error) {
+	doc := make(map[string]any)
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return nil, err
+	}
+	return normalize(doc).(map[string]any), nil
+}
+
+func encodeJson(v any) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+func decodeJson(data []byte) (map[string]any, error) {
+	doc := make(map[string]any)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func decodeYaml(data []byte) (map[string]any, error) {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(j)) == 0 || string(bytes.TrimSpace(j)) == "null" {
+		return make(map[string]any), nil
+	}
+	return decodeJson(j)
+}
+
+// normalize converts the []map[string]any arrays produced by the toml decoder into []any.
+func normalize(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k := range val {
+			val[k] = normalize(val[k])
+		}
+		return val
+	case []map[string]any:
+		list := make([]any, len(val))
+		for i := range val {
+			list[i] = normalize(val[i])
+		}
+		return list
+	case []any:
+		for i := range val {
+			val[i] = normalize(val[i])
+		}
+		return val
+	}
+	return v
+}
@@ -7,6 +7,8 @@ import (
 )
 
 const (
+	TypeTcp         = "tcp"
+	TypeUdp         = "udp"
 	TypeHttp        = "http"
 	TypeHttps       = "https"
 	TypeServerHttps = "server_https"
@@ -40,13 +42,54 @@ func Equals(cfg1, cfg2 Config) bool {
 	return true
 }
 
+// ConfigFactory builds a typed Config from the raw key/value pairs of a proxy section.
+type ConfigFactory func(m map[string]string) Config
+
+type registryKey struct {
+	proxyType string
+	plugin    string
+}
+
+var registry = make(map[registryKey]ConfigFactory)
+
+// RegisterConfig registers the factory used to decode proxy sections with the given type and plugin.
+// An empty plugin matches sections without a plugin.
+func RegisterConfig(proxyType, plugin string, factory ConfigFactory) {
+	registry[registryKey{proxyType: proxyType, plugin: plugin}] = factory
+}
+
+func init() {
+	RegisterConfig(TypeTcp, "", func(m map[string]string) Config { return NewTcpConfig(m) })
+	RegisterConfig(TypeUdp, "", func(m map[string]string) Config { return NewUdpConfig(m) })
+	RegisterConfig(TypeHttp, "", func(m map[string]string) Config { return NewHttpConfig(m) })
+	RegisterConfig(TypeHttps, PluginTypeHttps2Http, func(m map[string]string) Config { return NewHttps2HttpConfig(m) })
+	RegisterConfig(TypeServerHttps, "", func(m map[string]string) Config { return NewServerHttpsConfig(m) })
+	RegisterConfig(TypeServerHttps, PluginTypeHttp2Https, func(m map[string]string) Config { return NewServerHttps2HttpsConfig(m) })
+}
+
+// NewConfig decodes a proxy section into the typed Config registered for its type and plugin.
+// The typed Config is only used when it reproduces the section exactly, otherwise the section is
+// kept as a MapConfig so that Marshal never drops keys.
+func NewConfig(m map[string]string) Config {
+	raw := MapConfig(m)
+	factory, ok := registry[registryKey{proxyType: m["type"], plugin: m["plugin"]}]
+	if !ok {
+		return raw
+	}
+	cfg := factory(m)
+	if !Equals(cfg, raw) {
+		return raw
+	}
+	return cfg
+}
+
 type MapConfig map[string]string
 
 func (p MapConfig) String() string {
 	var pair []string
 	for k, v := range p {
-		if strings.HasPrefix(k, "plugin_crt") || strings.HasPrefix(k, "plugin_key") {
-			pair = append(pair, fmt.Sprintf("%s:%s", k, "******"))
+		if isSensitiveKey(k) {
+			pair = append(pair, fmt.Sprintf("%s:%s", k, redacted))
 		} else {
 			pair = append(pair, fmt.Sprintf("%s:%s", k, v))
 		}
@@ -110,3 +153,35 @@ func processStructFields(val reflect.Value, m map[string]string) {
 		}
 	}
 }
+
+func isSensitiveKey(k string) bool {
+	switch k {
+	case "tls_crts", "tls_keys", "http_pwd", "group_key", "token", "admin_pwd", "sk", "plugin_passwd", "plugin_http_passwd":
+		return true
+	}
+	return strings.HasPrefix(k, "plugin_crt") || strings.HasPrefix(k, "plugin_key")
+}
+
+// publicCommonKeys are the [common] keys whose values are shown. The [common] section takes credentials under many
+// keys, e.g. token, oidc_client_secret or the meta_ keys passed to the server plugins, the values of the keys not
+// listed are masked.
+var publicCommonKeys = map[string]bool{
+	"server_addr": true, "server_port": true, "user": true, "protocol": true, "pool_count": true,
+	"authentication_method": true, "authenticate_heartbeats": true, "authenticate_new_work_conns": true,
+	"oidc_client_id": true, "oidc_audience": true, "oidc_scope": true, "oidc_token_endpoint_url": true,
+	"admin_addr": true, "admin_port": true, "admin_user": true,
+	"tcp_mux": true, "tcp_mux_keepalive_interval": true, "heartbeat_interval": true, "heartbeat_timeout": true,
+	"dial_server_timeout": true, "dial_server_keepalive": true, "connect_server_local_ip": true, "udp_packet_size": true,
+	"tls_enable": true, "tls_server_name": true, "tls_trusted_ca_file": true, "disable_custom_tls_first_byte": true,
+	"tls_cert_file": true, "tls_key_file": true,
+	"log_file": true, "log_way": true, "log_level": true, "log_max_days": true, "disable_log_color": true,
+	"login_fail_exit": true, "dns_server": true, "start": true,
+}
+
+func splitHostPort(addr string) (string, string) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 || strings.HasSuffix(addr, "]") {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
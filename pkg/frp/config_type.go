@@ -1,5 +1,84 @@
 package frp
 
+// TcpConfig
+// [ssh]
+// type = tcp
+// local_ip = 127.0.0.1
+// local_port = 22
+// remote_port = 6000
+// group = ssh
+// group_key = 123
+type TcpConfig struct {
+	LocalIp    string `cfg:"local_ip"`
+	LocalPort  string `cfg:"local_port"`
+	RemotePort string `cfg:"remote_port"`
+	Group      string `cfg:"group"`
+	GroupKey   string `cfg:"group_key"`
+}
+
+var _ Config = (*TcpConfig)(nil)
+
+func (t *TcpConfig) EnableGroup() bool {
+	return t.Group != ""
+}
+
+func (t *TcpConfig) ToMap() map[string]string {
+	m := ToConfigMap(t)
+	m["type"] = TypeTcp
+	return m
+}
+
+func (t *TcpConfig) String() string {
+	return MapConfig(t.ToMap()).String()
+}
+
+func NewTcpConfig(m map[string]string) *TcpConfig {
+	return &TcpConfig{
+		LocalIp:    m["local_ip"],
+		LocalPort:  m["local_port"],
+		RemotePort: m["remote_port"],
+		Group:      m["group"],
+		GroupKey:   m["group_key"],
+	}
+}
+
+// UdpConfig
+// [dns]
+// type = udp
+// local_ip = 8.8.8.8
+// local_port = 53
+// remote_port = 6000
+type UdpConfig struct {
+	LocalIp    string `cfg:"local_ip"`
+	LocalPort  string `cfg:"local_port"`
+	RemotePort string `cfg:"remote_port"`
+}
+
+var _ Config = (*UdpConfig)(nil)
+
+// EnableGroup udp proxies can not be load balanced, a remote port is only bound by one client
+func (u *UdpConfig) EnableGroup() bool {
+	return false
+}
+
+func (u *UdpConfig) ToMap() map[string]string {
+	m := ToConfigMap(u)
+	m["type"] = TypeUdp
+	return m
+}
+
+func (u *UdpConfig) String() string {
+	return MapConfig(u.ToMap()).String()
+}
+
+func NewUdpConfig(m map[string]string) *UdpConfig {
+	return &UdpConfig{
+		LocalIp:    m["local_ip"],
+		LocalPort:  m["local_port"],
+		RemotePort: m["remote_port"],
+	}
+}
+
 // HttpConfig
 // [web01]
 // type = http
@@ -41,18 +120,29 @@ func (h *HttpConfig) String() string {
 
 func NewHttpConfig(m map[string]string) *HttpConfig {
 	return &HttpConfig{
-		LocalIp:   m["local_ip"],
-		LocalPort: m["local_port"],
-		Host:      m["custom_domains"],
-		Locations: m["locations"],
-		Group:     m["group"],
-		GroupKey:  m["group_key"],
-		Redirect:  m["redirect"],
-		HttpUser:  m["http_user"],
-		HttpPwd:   m["http_pwd"],
+		LocalIp:           m["local_ip"],
+		LocalPort:         m["local_port"],
+		Host:              m["custom_domains"],
+		Locations:         m["locations"],
+		Group:             m["group"],
+		GroupKey:          m["group_key"],
+		Redirect:          m["redirect"],
+		HostHeaderRewrite: m["host_header_rewrite"],
+		HeaderXFromWhere:  m["header_X-From-Where"],
+		HttpUser:          m["http_user"],
+		HttpPwd:           m["http_pwd"],
 	}
 }
 
+// newPluginHttpConfig reads the HttpConfig of a plugin proxy, whose backend address is stored in plugin_local_addr.
+func newPluginHttpConfig(m map[string]string) HttpConfig {
+	cfg := *NewHttpConfig(m)
+	if addr, ok := m["plugin_local_addr"]; ok {
+		cfg.LocalIp, cfg.LocalPort = splitHostPort(addr)
+	}
+	return cfg
+}
+
 // Https2HttpConfig
 // [test_htts2http]
 // type = https
@@ -95,23 +185,14 @@ func (h *Https2HttpConfig) ToMap() map[string]string {
 
 func NewHttps2HttpConfig(m map[string]string) *Https2HttpConfig {
 	return &Https2HttpConfig{
-		HttpConfig: HttpConfig{
-			LocalIp:   m["local_ip"],
-			LocalPort: m["local_port"],
-			Host:      m["custom_domains"],
-			Locations: m["locations"],
-			Group:     m["group"],
-			GroupKey:  m["group_key"],
-			HttpUser:  m["http_user"],
-			HttpPwd:   m["http_pwd"],
-		},
-		CrtBase64: m["plugin_crt_base64"],
-		KeyBase64: m["plugin_key_base64"],
+		HttpConfig: newPluginHttpConfig(m),
+		CrtBase64:  m["plugin_crt_base64"],
+		KeyBase64:  m["plugin_key_base64"],
 	}
 }
 
 func (h *Https2HttpConfig) String() string {
-	return h.HttpConfig.String()
+	return MapConfig(h.ToMap()).String()
 }
 
 // ServerHttpsConfig
@@ -143,23 +224,14 @@ func (h *ServerHttpsConfig) ToMap() map[string]string {
 
 func NewServerHttpsConfig(m map[string]string) *ServerHttpsConfig {
 	return &ServerHttpsConfig{
-		HttpConfig: HttpConfig{
-			LocalIp:   m["local_ip"],
-			LocalPort: m["local_port"],
-			Host:      m["custom_domains"],
-			Locations: m["locations"],
-			Group:     m["group"],
-			GroupKey:  m["group_key"],
-			HttpUser:  m["http_user"],
-			HttpPwd:   m["http_pwd"],
-		},
-		TlsCrt: m["tls_crts"],
-		TlsKey: m["tls_keys"],
+		HttpConfig: *NewHttpConfig(m),
+		TlsCrt:     m["tls_crts"],
+		TlsKey:     m["tls_keys"],
 	}
 }
 
 func (h *ServerHttpsConfig) String() string {
-	return h.HttpConfig.String()
+	return MapConfig(h.ToMap()).String()
 }
 
 // Https2HttpsConfig
@@ -204,21 +276,16 @@ func (h *Https2HttpsConfig) ToMap() map[string]string {
 
 func NewHttps2HttpsConfig(m map[string]string) *Https2HttpsConfig {
 	return &Https2HttpsConfig{
-		HttpConfig: HttpConfig{
-			LocalIp:   m["local_ip"],
-			LocalPort: m["local_port"],
-			Host:      m["custom_domains"],
-			Locations: m["locations"],
-			Group:     m["group"],
-			GroupKey:  m["group_key"],
-			HttpUser:  m["http_user"],
-			HttpPwd:   m["http_pwd"],
-		},
-		CrtBase64: m["plugin_crt_base64"],
-		KeyBase64: m["plugin_key_base64"],
+		HttpConfig: newPluginHttpConfig(m),
+		CrtBase64:  m["plugin_crt_base64"],
+		KeyBase64:  m["plugin_key_base64"],
 	}
 }
 
+func (h *Https2HttpsConfig) String() string {
+	return MapConfig(h.ToMap()).String()
+}
+
 // ServerHttps2HttpsConfig
 // [git]
 // type = server_https
@@ -257,21 +324,12 @@ func (h *ServerHttps2HttpsConfig) ToMap() map[string]string {
 
 func NewServerHttps2HttpsConfig(m map[string]string) *ServerHttps2HttpsConfig {
 	return &ServerHttps2HttpsConfig{
-		HttpConfig: HttpConfig{
-			LocalIp:   m["local_ip"],
-			LocalPort: m["local_port"],
-			Host:      m["custom_domains"],
-			Locations: m["locations"],
-			Group:     m["group"],
-			GroupKey:  m["group_key"],
-			HttpUser:  m["http_user"],
-			HttpPwd:   m["http_pwd"],
-		},
-		TlsCrt: m["tls_crts"],
-		TlsKey: m["tls_keys"],
+		HttpConfig: *NewHttpConfig(m),
+		TlsCrt:     m["tls_crts"],
+		TlsKey:     m["tls_keys"],
 	}
 }
 
 func (h *ServerHttps2HttpsConfig) String() string {
-	return h.HttpConfig.String()
+	return MapConfig(h.ToMap()).String()
 }
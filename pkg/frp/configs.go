@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"gopkg.in/ini.v1"
+	"regexp"
 	"sort"
 	"strings"
 )
@@ -26,6 +27,15 @@ func (p Proxy) String() string {
 	return "{" + strings.Join(pairs, ", ") + "}"
 }
 
+// Clone returns a shallow copy of the proxies
+func (p Proxy) Clone() Proxy {
+	c := make(Proxy, len(p))
+	for name, cfg := range p {
+		c[name] = cfg
+	}
+	return c
+}
+
 func (p Proxy) Equals(proxy Proxy) bool {
 	if len(p) != len(proxy) {
 		return false
@@ -72,7 +82,7 @@ func Unmarshal(data []byte) (*Configs, error) {
 			continue
 		}
 
-		c.Proxy[name] = MapConfig(section.KeysHash())
+		c.Proxy[name] = NewConfig(section.KeysHash())
 	}
 	return c, nil
 }
@@ -85,38 +95,116 @@ func NewIni() *Ini {
 	return &Ini{b: bytes.NewBuffer(nil)}
 }
 
-func (i *Ini) Write(name string, config Config) {
+// Write writes a section, nothing is written if the section name, a key or a value could alter the other sections
+func (i *Ini) Write(name string, config Config) error {
+	m := config.ToMap()
+	if err := validateSection(name, m); err != nil {
+		return err
+	}
 	writeHead(i.b, name)
-	foreach(config.ToMap(), func(k string, v string) bool {
+	foreach(m, func(k string, v string) bool {
 		i.b.WriteString(k)
 		i.b.WriteByte('=')
-		i.b.WriteString(v)
+		i.b.WriteString(quoteValue(v))
 		i.b.WriteByte('\n')
 		return true
 	})
 	i.b.WriteByte('\n')
+	return nil
 }
 
 func (i *Ini) Bytes() []byte {
 	return i.b.Bytes()
 }
 
-func Marshal(config *Configs) []byte {
+func Marshal(config *Configs) ([]byte, error) {
 	if config == nil {
-		return nil
+		return nil, nil
 	}
 
 	i := NewIni()
 	if config.Common != nil {
-		i.Write("common", config.Common)
+		if err := i.Write("common", config.Common); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	foreach(config.Proxy, func(name string, proxy Config) bool {
+		if err = ValidateProxyName(name); err == nil {
+			err = i.Write(name, proxy)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return i.Bytes(), nil
+}
+
+// iniKey are the keys which can not be read as a comment, a section, another key or a quoted key
+var iniKey = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.\-]*$`)
+
+// ValidateProxy reports whether a proxy can be written to a frpc config without altering the other proxies
+// or the [common] section
+func ValidateProxy(name string, config Config) error {
+	if err := ValidateProxyName(name); err != nil {
+		return err
+	}
+	return validateSection(name, config.ToMap())
+}
+
+// ValidateProxyName rejects the proxy names frpc would read as another section
+func ValidateProxyName(name string) error {
+	switch {
+	case name == "common", name == ini.DefaultSection, strings.HasPrefix(name, "range:"):
+		return fmt.Errorf("reserved proxy name %q", name)
+	}
+	return nil
+}
+
+func validateSection(name string, m map[string]string) error {
+	if name == "" {
+		return fmt.Errorf("empty section name")
+	}
+	if err := validateText(name); err != nil {
+		return fmt.Errorf("section %q: %w", name, err)
+	}
+	for k, v := range m {
+		if !iniKey.MatchString(k) {
+			return fmt.Errorf("section %q: invalid key %q", name, k)
+		}
+		if err := validateText(v); err != nil {
+			return fmt.Errorf("section %q: key %s: %w", name, k, err)
+		}
+	}
+	return nil
+}
+
+// validateText rejects line breaks and other control characters, which would start a new line of the file,
+// and template actions, which frpc renders before parsing the file
+func validateText(s string) error {
+	for _, r := range s {
+		if r < 0x20 && r != '\t' || r == 0x7f {
+			return fmt.Errorf("invalid character %q", r)
+		}
+	}
+	if strings.Contains(s, "{{") {
+		return fmt.Errorf("template actions are not allowed")
+	}
+	return nil
+}
+
+// quoteValue wraps the values go-ini would not read back verbatim in backquotes: the surrounding spaces are trimmed,
+// surrounding quotes are removed, leading quotes start a multi-line value and a trailing backslash continues the line
+func quoteValue(v string) string {
+	if v == "" {
+		return v
 	}
-	if config.Proxy != nil {
-		foreach(config.Proxy, func(name string, proxy Config) bool {
-			i.Write(name, proxy)
-			return true
-		})
+	if v != strings.TrimSpace(v) || strings.HasPrefix(v, "`") || strings.HasPrefix(v, `"""`) || strings.HasSuffix(v, `\`) ||
+		len(v) > 1 && (v[0] == '"' && v[len(v)-1] == '"' || v[0] == '\'' && v[len(v)-1] == '\'') {
+		return "`" + v + "`"
 	}
-	return i.Bytes()
+	return v
 }
 
 func writeHead(buffer *bytes.Buffer, key string) {
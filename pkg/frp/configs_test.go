@@ -2,9 +2,38 @@ package frp
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	frpclient "github.com/fatedier/frp/client"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -57,14 +86,21 @@ func TestConfig(t *testing.T) {
 		Redirect: "https://baidu.com",
 	}
 
-	l.Info(string(Marshal(cfg)))
+	l.Info(string(mustMarshal(t, cfg)))
 
 	l.Info("print cfg", "cfg", cfg)
 
 	s := NewFakeSyncer()
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go s.Start(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
 	time.Sleep(time.Second)
 
 	s.SetProxies("", cfg.Proxy)
@@ -76,3 +112,1617 @@ func TestConfig(t *testing.T) {
 	time.Sleep(time.Second)
 	s.Sync()
 }
+
+func mustMarshal(t *testing.T, cfg *Configs) []byte {
+	t.Helper()
+	data, err := Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUnmarshalTyped(t *testing.T) {
+	data := []byte(`
+[common]
+server_addr=8.8.8.8
+
+[web]
+type=http
+local_ip=web.default.svc.cluster.local
+local_port=80
+custom_domains=web.example.com
+locations=/
+header_X-From-Where=frp-ingress
+
+[web-https]
+type=https
+plugin=https2http
+plugin_local_addr=web.default.svc.cluster.local:80
+custom_domains=web.example.com
+plugin_crt_base64=crt
+plugin_key_base64=key
+
+[git]
+type=server_https
+local_ip=git.default.svc.cluster.local
+local_port=3000
+custom_domains=git.example.com
+tls_crts=crt
+tls_keys=key
+
+[ssh]
+type=tcp
+local_port=22
+remote_port=22
+
+[dns]
+type=udp
+local_ip=8.8.8.8
+local_port=53
+remote_port=6053
+
+[web-unknown]
+type=http
+local_port=80
+unknown_key=value
+`)
+	cfg, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want Config
+	}{
+		{name: "web", want: &HttpConfig{}},
+		{name: "web-https", want: &Https2HttpConfig{}},
+		{name: "git", want: &ServerHttpsConfig{}},
+		{name: "ssh", want: &TcpConfig{}},
+		{name: "dns", want: &UdpConfig{}},
+		{name: "web-unknown", want: MapConfig{}},
+	}
+	for _, tt := range tests {
+		got, ok := cfg.Proxy[tt.name]
+		if !ok {
+			t.Errorf("proxy %s not found", tt.name)
+			continue
+		}
+		if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+			t.Errorf("proxy %s decoded as %T, want %T", tt.name, got, tt.want)
+		}
+	}
+
+	again, err := Unmarshal(mustMarshal(t, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Proxy.Equals(cfg.Proxy) || !Equals(again.Common, cfg.Common) {
+		t.Errorf("round trip mismatch:\n%s\n%s", mustMarshal(t, cfg), mustMarshal(t, again))
+	}
+	if string(mustMarshal(t, again)) != string(mustMarshal(t, cfg)) {
+		t.Errorf("marshal is not stable:\n%s\n%s", mustMarshal(t, cfg), mustMarshal(t, again))
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	cfg, err := Unmarshal([]byte(defaultConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Proxy["web"] = &ServerHttpsConfig{
+		HttpConfig: HttpConfig{
+			Host:             "example.com",
+			Locations:        "/",
+			LocalIp:          "127.0.0.1",
+			LocalPort:        "3000",
+			Group:            "web",
+			GroupKey:         "key",
+			HeaderXFromWhere: "frp-ingress",
+		},
+		TlsCrt: "crt",
+		TlsKey: "key",
+	}
+	for _, codec := range []Codec{IniCodec, TomlCodec, YamlCodec, JsonCodec} {
+		t.Run(codec.Format(), func(t *testing.T) {
+			data, err := codec.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected := DetectCodec(data); detected.Format() != codec.Format() {
+				t.Errorf("detected format %s, want %s", detected.Format(), codec.Format())
+			}
+			got, err := codec.Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Proxy.Equals(cfg.Proxy) || !Equals(got.Common, cfg.Common) {
+				t.Errorf("round trip mismatch:\n%s\n%s", data, mustMarshal(t, got))
+			}
+			if _, ok := got.Proxy["web"].(*ServerHttpsConfig); !ok {
+				t.Errorf("proxy web decoded as %T", got.Proxy["web"])
+			}
+		})
+	}
+}
+
+func TestDetectCodec(t *testing.T) {
+	tests := map[string]struct {
+		data   string
+		format string
+	}{
+		"ini":               {data: defaultConfig, format: FormatIni},
+		"ini proxies only":  {data: "[web]\nlocal_port = 80\nremote_port = 6000\n", format: FormatIni},
+		"toml":              {data: "serverAddr = \"127.0.0.1\"\n[webServer]\nport = 7400\n", format: FormatToml},
+		"toml proxies only": {data: "[[proxies]]\nname = \"web\"\nlocalPort = 80\n", format: FormatToml},
+		"yaml":              {data: "serverAddr: 127.0.0.1\n", format: FormatYaml},
+		"json":              {data: `{"serverAddr": "127.0.0.1"}`, format: FormatJson},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := DetectCodec([]byte(tt.data)).Format(); got != tt.format {
+				t.Errorf("detected format %s, want %s", got, tt.format)
+			}
+		})
+	}
+}
+
+func TestTomlCodecKeys(t *testing.T) {
+	data := []byte(`
+serverAddr = "8.8.8.8"
+serverPort = 7000
+
+[webServer]
+port = 7400
+
+[[proxies]]
+name = "web"
+type = "http"
+localIP = "127.0.0.1"
+localPort = 80
+customDomains = ["a.example.com", "b.example.com"]
+`)
+	cfg, err := TomlCodec.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Common["server_port"] != "7000" || cfg.Common["admin_port"] != "7400" {
+		t.Errorf("unexpected common: %v", cfg.Common)
+	}
+	web, ok := cfg.Proxy["web"].(*HttpConfig)
+	if !ok {
+		t.Fatalf("proxy web decoded as %T", cfg.Proxy["web"])
+	}
+	if web.LocalIp != "127.0.0.1" || web.LocalPort != "80" || web.Host != "a.example.com,b.example.com" {
+		t.Errorf("unexpected proxy: %v", web)
+	}
+}
+
+func TestSyncRefusesForkProxies(t *testing.T) {
+	r := NewRenderer("frp", 1, nil, TomlCodec)
+	r.configsMap["default/web"] = map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80"}}
+	r.configsMap["default/tls"] = map[string]Config{"tls": &ServerHttpsConfig{
+		HttpConfig: HttpConfig{Host: "tls.example.com", LocalPort: "80"},
+		TlsCrt:     "crt",
+		TlsKey:     "key",
+	}}
+	r.configsMap["default/redirect"] = map[string]Config{"redirect": &HttpConfig{Host: "old.example.com", Redirect: "https://new.example.com"}}
+	r.configsMap["default/inline"] = map[string]Config{"inline": &Https2HttpConfig{
+		HttpConfig: HttpConfig{Host: "inline.example.com", LocalPort: "80"},
+		CrtBase64:  "Y3J0",
+		KeyBase64:  "a2V5",
+	}}
+	// meta_owner has no path in frp v1, the dotted v1 path is written as it is
+	r.configsMap["default/meta"] = map[string]Config{"meta": NewConfig(map[string]string{"type": "tcp", "local_port": "22", "remote_port": "6022", "meta_owner": "a"})}
+	r.configsMap["default/path"] = map[string]Config{"path": NewConfig(map[string]string{"type": "tcp", "local_port": "22", "remote_port": "6023", "metadatas.owner": "a"})}
+	rendered, failures, err := r.Render(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReasons := map[string]string{"default/inline": "plugin_crt_base64", "default/redirect": "redirect", "default/tls": TypeServerHttps, "default/meta": "meta_owner"}
+	if len(failures) != len(wantReasons) {
+		t.Errorf("render failures %v", failures)
+	}
+	for _, f := range failures {
+		if f.Client != "frp.0" || !strings.Contains(f.Reason, wantReasons[f.Key]) {
+			t.Errorf("render failure %v, want %q refused", f, wantReasons[f.Key])
+		}
+	}
+	cfg, err := TomlCodec.Unmarshal(rendered["frp.0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Proxy["frp.0/web"]; !ok {
+		t.Errorf("proxy web not applied:\n%s", rendered["frp.0"])
+	}
+	if path := cfg.Proxy["frp.0/path"]; path == nil || path.ToMap()["metadatas.owner"] != "a" {
+		t.Errorf("proxy with a v1 path not applied:\n%s", rendered["frp.0"])
+	}
+	if _, ok := cfg.Proxy["frp.0/tls"]; ok {
+		t.Errorf("proxy with inline certificates written in toml:\n%s", rendered["frp.0"])
+	}
+	status := r.Status(context.Background())
+	if len(status["default/tls"]) != 1 || status["default/tls"][0].Status != ProxyPhaseApplyFailed ||
+		!strings.Contains(status["default/tls"][0].Err, TypeServerHttps) {
+		t.Errorf("refused proxy status %+v", status["default/tls"])
+	}
+	if len(status["default/web"]) != 1 || !status["default/web"][0].Running() {
+		t.Errorf("proxy web status %+v", status["default/web"])
+	}
+}
+
+func TestUnmarshalStatus(t *testing.T) {
+	data := []byte(`{"http":[{"name":"web","type":"http","status":"start error","err":"custom domain [web.example.com] is already in use","local_addr":"127.0.0.1:80","plugin":"","remote_addr":""}],"tcp":[{"name":"ssh","type":"tcp","status":"running","err":"","local_addr":"127.0.0.1:22","plugin":"","remote_addr":"8.8.8.8:22"}]}`)
+	status, err := UnmarshalStatus(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 {
+		t.Fatalf("got %d proxies, want 2", len(status))
+	}
+	if status[0].Name != "ssh" || !status[0].Running() {
+		t.Errorf("unexpected status: %+v", status[0])
+	}
+	if status[1].Name != "web" || status[1].Status != ProxyPhaseStartError || status[1].Err == "" {
+		t.Errorf("unexpected status: %+v", status[1])
+	}
+}
+
+type reloadFailClient struct {
+	*fakeClient
+}
+
+func (c *reloadFailClient) Reload(ctx context.Context) error {
+	for name := range c.cfg.Proxy {
+		if strings.HasSuffix(name, "/bad") {
+			return fmt.Errorf("proxy [%s] invalid", name)
+		}
+	}
+	return nil
+}
+
+func TestSyncRollback(t *testing.T) {
+	cli := &reloadFailClient{fakeClient: &fakeClient{}}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.configsMap["default/good"] = map[string]Config{"good": &HttpConfig{Host: "good.example.com", LocalPort: "80"}}
+	s.configsMap["default/bad"] = map[string]Config{"bad": &HttpConfig{Host: "bad.example.com", LocalPort: "80"}}
+	s.sync(context.Background())
+
+	// the bad proxy is quarantined and the good one applied without it
+	after, err := cli.GetConfigs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := after.Proxy["frp.0/bad"]; ok {
+		t.Errorf("bad proxy applied:\n%s", mustMarshal(t, after))
+	}
+	if _, ok := after.Proxy["frp.0/good"]; !ok || len(after.Proxy) != 1 {
+		t.Errorf("good proxy not applied:\n%s", mustMarshal(t, after))
+	}
+	s.sync(context.Background())
+	if again, _ := cli.GetConfigs(context.Background()); !again.Proxy.Equals(after.Proxy) {
+		t.Errorf("quarantined proxy applied again:\n%s", mustMarshal(t, again))
+	}
+	addr := cli.Addr().String()
+	if got := testutil.ToFloat64(syncFailures.WithLabelValues(addr)); got < 1 {
+		t.Errorf("sync failures = %v, want at least 1", got)
+	}
+	if got := testutil.ToFloat64(managedProxies.WithLabelValues(addr, TypeHttp)); got != 2 {
+		t.Errorf("managed http proxies = %v, want 2", got)
+	}
+	status := s.Status(context.Background())
+	if len(status["default/bad"]) != 1 || status["default/bad"][0].Status != ProxyPhaseApplyFailed {
+		t.Errorf("failure not recorded for bad proxy: %+v", status["default/bad"])
+	}
+	if len(status["default/good"]) != 1 || status["default/good"][0].Status == ProxyPhaseApplyFailed {
+		t.Errorf("failure recorded for good proxy: %+v", status["default/good"])
+	}
+
+	delete(s.configsMap, "default/bad")
+	s.sync(context.Background())
+	status = s.Status(context.Background())
+	if len(status["default/good"]) != 1 || !status["default/good"][0].Running() {
+		t.Errorf("good proxy not running: %+v", status["default/good"])
+	}
+}
+
+// httpsFailClient fails the reload of a proxy named ns/a:https, naming it as frp does
+type httpsFailClient struct {
+	*fakeClient
+}
+
+func (c *httpsFailClient) Reload(ctx context.Context) error {
+	for name := range c.cfg.Proxy {
+		if strings.HasSuffix(name, ":https") {
+			return fmt.Errorf("proxy [%s] type [https] error", name)
+		}
+	}
+	return nil
+}
+
+func TestSyncBlamesExactProxyName(t *testing.T) {
+	for reason, named := range map[string]bool{
+		"proxy [ns/a:https] type [https] error": false,
+		"proxy ns/a:https has invalid type [x]": false,
+		"proxy [ns/a:http] type [http] error":   true,
+		"proxy ns/a:http has invalid type [x]":  true,
+		`proxy "ns/a:http": invalid local port`: true,
+		"proxy ns/a:http":                       true,
+	} {
+		if got := namedInError(reason, "ns/a:http"); got != named {
+			t.Errorf("namedInError(%q, ns/a:http) = %v, want %v", reason, got, named)
+		}
+	}
+
+	cli := &httpsFailClient{fakeClient: &fakeClient{}}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.configsMap["default/http"] = map[string]Config{"ns/a:http": &HttpConfig{Host: "a.example.com", LocalPort: "80"}}
+	s.configsMap["default/https"] = map[string]Config{"ns/a:https": &HttpConfig{Host: "b.example.com", LocalPort: "80"}}
+	s.sync(context.Background())
+
+	cfg, err := cli.GetConfigs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Proxy["frp.0/ns/a:http"]; !ok || len(cfg.Proxy) != 1 {
+		t.Errorf("only the http proxy should be applied:\n%s", mustMarshal(t, cfg))
+	}
+	status := s.Status(context.Background())
+	if len(status["default/https"]) != 1 || status["default/https"][0].Status != ProxyPhaseApplyFailed {
+		t.Errorf("failure not recorded for the https proxy: %+v", status["default/https"])
+	}
+	if len(status["default/http"]) != 1 || status["default/http"][0].Status == ProxyPhaseApplyFailed {
+		t.Errorf("failure of the https proxy blamed on the http one: %+v", status["default/http"])
+	}
+}
+
+// anonymousFailClient fails the reload of a proxy named bad without naming it
+type anonymousFailClient struct {
+	*fakeClient
+}
+
+func (c *anonymousFailClient) Reload(ctx context.Context) error {
+	for name := range c.cfg.Proxy {
+		if strings.HasSuffix(name, "/bad") {
+			return fmt.Errorf("reload failed")
+		}
+	}
+	return nil
+}
+
+func TestSyncQuarantineSuspects(t *testing.T) {
+	cli := &anonymousFailClient{fakeClient: &fakeClient{}}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.configsMap["default/good"] = map[string]Config{"good": &HttpConfig{Host: "good.example.com", LocalPort: "80"}}
+	s.configsMap["default/bad"] = map[string]Config{"bad": &HttpConfig{Host: "bad.example.com", LocalPort: "80"}}
+
+	// both proxies are suspects, then tried again one at a time
+	for i := 0; i < 3; i++ {
+		s.sync(context.Background())
+	}
+	cfg, err := cli.GetConfigs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Proxy["frp.0/good"]; !ok {
+		t.Errorf("good proxy not applied:\n%s", mustMarshal(t, cfg))
+	}
+	if _, ok := cfg.Proxy["frp.0/bad"]; ok {
+		t.Errorf("bad proxy applied:\n%s", mustMarshal(t, cfg))
+	}
+	if q, ok := s.quarantine[cli.Addr().String()]["bad"]; !ok || q.suspect {
+		t.Errorf("bad proxy quarantine %+v", q)
+	}
+	status := s.Status(context.Background())
+	if len(status["default/bad"]) != 1 || status["default/bad"][0].Status != ProxyPhaseApplyFailed {
+		t.Errorf("failure not recorded for bad proxy: %+v", status["default/bad"])
+	}
+
+	// a changed config releases the quarantine
+	s.configsMap["default/bad"] = map[string]Config{"bad": &HttpConfig{Host: "bad.example.com", LocalPort: "8080"}}
+	s.sync(context.Background())
+	if _, ok := s.quarantine[cli.Addr().String()]["bad"]; !ok {
+		t.Error("bad proxy not quarantined again")
+	}
+}
+
+// blockingClient blocks its reloads until release is closed
+type blockingClient struct {
+	*fakeClient
+	reloading chan struct{}
+	release   chan struct{}
+}
+
+func (c *blockingClient) Reload(ctx context.Context) error {
+	select {
+	case c.reloading <- struct{}{}:
+	default:
+	}
+	<-c.release
+	return nil
+}
+
+func TestSyncDoesNotBlockSetProxies(t *testing.T) {
+	cli := &blockingClient{fakeClient: &fakeClient{}, reloading: make(chan struct{}, 1), release: make(chan struct{})}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.configsMap["default/web"] = map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80"}}
+	done := make(chan struct{})
+	go func() {
+		s.sync(context.Background())
+		close(done)
+	}()
+	<-cli.reloading
+
+	set := make(chan struct{})
+	go func() {
+		s.SetProxies("default/api", map[string]Config{"api": &HttpConfig{Host: "api.example.com", LocalPort: "80"}})
+		s.Status(context.Background())
+		close(set)
+	}()
+	select {
+	case <-set:
+	case <-time.After(time.Second):
+		t.Error("SetProxies blocked by the apply of a client")
+	}
+	close(cli.release)
+	<-done
+	<-set
+}
+
+type countingClient struct {
+	*fakeClient
+	applies int32
+}
+
+func (c *countingClient) SetConfig(ctx context.Context, config *Configs) error {
+	atomic.AddInt32(&c.applies, 1)
+	c.mu.Lock()
+	c.cfg = config
+	c.mu.Unlock()
+	return nil
+}
+
+func TestSyncDebounce(t *testing.T) {
+	cli := &countingClient{fakeClient: &fakeClient{}}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+		debounce:   100 * time.Millisecond,
+		maxWait:    time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; i < 20; i++ {
+		s.SetProxies(fmt.Sprintf("default/ingress%d", i), map[string]Config{
+			fmt.Sprintf("ingress%d", i): &HttpConfig{Host: fmt.Sprintf("ingress%d.example.com", i), LocalPort: "80"},
+		})
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if applies := atomic.LoadInt32(&cli.applies); applies != 1 {
+		t.Errorf("got %d applies, want 1", applies)
+	}
+	cfg, err := cli.GetConfigs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Proxy) != 20 {
+		t.Errorf("got %d proxies, want 20", len(cfg.Proxy))
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	cli := &fakeClient{}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.configsMap["default/web"] = map[string]Config{
+		"web": &HttpConfig{Host: "web.example.com", LocalPort: "80", Group: "web", GroupKey: "secret"},
+	}
+
+	rec := httptest.NewRecorder()
+	NewDebugHandler(NewPools(map[string]Syncer{"frp": s})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/frp", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "secret") || strings.Contains(rec.Body.String(), "admin_pwd\": \"admin") {
+		t.Errorf("dump is not redacted:\n%s", rec.Body.String())
+	}
+	var dumps map[string]Dump
+	if err := json.Unmarshal(rec.Body.Bytes(), &dumps); err != nil {
+		t.Fatal(err)
+	}
+	dump := dumps["frp"]
+	if len(dump.Clients) != 1 || dump.Clients[0].Diff == nil {
+		t.Fatalf("unexpected dump: %+v", dump)
+	}
+	diff := dump.Clients[0].Diff
+	if len(diff.Added) != 1 || diff.Added[0] != "frp.0/web" {
+		t.Errorf("unexpected added proxies: %v", diff.Added)
+	}
+	if len(diff.Removed) != 4 {
+		t.Errorf("unexpected removed proxies: %v", diff.Removed)
+	}
+}
+
+func TestSyncDrift(t *testing.T) {
+	cli := &fakeClient{}
+	s := &syncer{
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.configsMap["default/web"] = map[string]Config{
+		"web": &HttpConfig{Host: "web.example.com", LocalPort: "80", HttpPwd: "secret"},
+	}
+	s.sync(context.Background())
+
+	// edit the config out of band
+	prefix, _ := s.proxyPrefix(cli)
+	name := prefix + "web"
+	edited := MapConfig(cli.cfg.Proxy[name].ToMap())
+	edited["local_port"] = "8080"
+	edited["http_pwd"] = "changed"
+	delete(edited, "custom_domains")
+	cli.cfg.Proxy[name] = edited
+	cli.cfg.Proxy["manual"] = MapConfig{"type": "tcp", "remote_port": "22"}
+
+	want := []DriftEntry{
+		{Proxy: "manual", Key: "remote_port", Change: DriftAdded, Live: "22"},
+		{Proxy: "manual", Key: "type", Change: DriftAdded, Live: "tcp"},
+		{Proxy: name, Key: "custom_domains", Change: DriftRemoved, Applied: "web.example.com"},
+		{Proxy: name, Key: "http_pwd", Change: DriftChanged, Applied: redacted, Live: redacted},
+		{Proxy: name, Key: "local_port", Change: DriftChanged, Applied: "80", Live: "8080"},
+	}
+	live, err := cli.GetConfigs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := DetectDrift(s.applied[cli.Addr().String()], live.Proxy); !reflect.DeepEqual(got, want) {
+		t.Errorf("DetectDrift() = %+v, want %+v", got, want)
+	}
+
+	// the proxies the controller changes are still applied in report mode
+	s.driftMode = constants.DriftModeReport
+	s.configsMap["default/api"] = map[string]Config{
+		"api": &HttpConfig{Host: "api.example.com", LocalPort: "80"},
+	}
+	s.sync(context.Background())
+	if _, ok := cli.cfg.Proxy["manual"]; !ok {
+		t.Errorf("drift corrected in report mode")
+	}
+	if got := cli.cfg.Proxy[name].ToMap()["local_port"]; got != "8080" {
+		t.Errorf("drifted local_port = %s in report mode, want 8080", got)
+	}
+	if _, ok := cli.cfg.Proxy[prefix+"api"]; !ok {
+		t.Errorf("proxy of a drifted client not applied in report mode")
+	}
+	if got := testutil.ToFloat64(driftKeys.WithLabelValues(cli.Addr().String(), string(DriftChanged))); got != 2 {
+		t.Errorf("changed drift keys = %v, want 2", got)
+	}
+
+	s.driftMode = constants.DriftModeCorrect
+	s.sync(context.Background())
+	if _, ok := cli.cfg.Proxy["manual"]; ok {
+		t.Errorf("drift not corrected")
+	}
+	if got := cli.cfg.Proxy[name].ToMap()["local_port"]; got != "80" {
+		t.Errorf("drifted local_port = %s, want 80", got)
+	}
+	if got := testutil.ToFloat64(driftKeys.WithLabelValues(cli.Addr().String(), string(DriftChanged))); got != 2 {
+		t.Errorf("drift reported twice, changed drift keys = %v", got)
+	}
+}
+
+func TestMarshalHostile(t *testing.T) {
+	rejected := []struct {
+		name  string
+		proxy string
+		cfg   Config
+	}{
+		{
+			name:  "newline in value injects a section",
+			proxy: "web",
+			cfg:   &HttpConfig{Host: "example.com", HostHeaderRewrite: "example.com\n[evil]\ntype=tcp\nremote_port=22"},
+		},
+		{
+			name:  "newline in value overrides common",
+			proxy: "web",
+			cfg:   &HttpConfig{Host: "example.com", HeaderXFromWhere: "x\n[common]\nadmin_pwd=evil"},
+		},
+		{
+			name:  "carriage return in value",
+			proxy: "web",
+			cfg:   &HttpConfig{Host: "example.com\r[evil]"},
+		},
+		{
+			name:  "control character in value",
+			proxy: "web",
+			cfg:   MapConfig{"type": "tcp", "local_ip": "a\x00b"},
+		},
+		{
+			name:  "template action in value",
+			proxy: "web",
+			cfg:   &HttpConfig{Host: "example.com", HostHeaderRewrite: "{{ .Envs.FRP_TOKEN }}"},
+		},
+		{
+			name:  "newline in key",
+			proxy: "web",
+			cfg:   MapConfig{"type": "tcp", "a\n[evil]\nb": "c"},
+		},
+		{
+			name:  "delimiter in key",
+			proxy: "web",
+			cfg:   MapConfig{"type": "tcp", "remote_port=22\nx": "1"},
+		},
+		{
+			name:  "comment key",
+			proxy: "web",
+			cfg:   MapConfig{"type": "tcp", ";remote_port": "22"},
+		},
+		{
+			name:  "quoted key",
+			proxy: "web",
+			cfg:   MapConfig{"type": "tcp", `"""remote_port"""`: "22"},
+		},
+		{
+			name:  "empty key",
+			proxy: "web",
+			cfg:   MapConfig{"type": "tcp", "": "22"},
+		},
+		{
+			name:  "newline in section name",
+			proxy: "web]\n[evil",
+			cfg:   &TcpConfig{LocalPort: "22", RemotePort: "6000"},
+		},
+		{
+			name:  "common section name",
+			proxy: "common",
+			cfg:   MapConfig{"admin_pwd": "evil"},
+		},
+		{
+			name:  "default section name",
+			proxy: "DEFAULT",
+			cfg:   &TcpConfig{LocalPort: "22", RemotePort: "6000"},
+		},
+		{
+			name:  "range section name",
+			proxy: "range:web",
+			cfg:   &TcpConfig{LocalPort: "22", RemotePort: "6000-6010"},
+		},
+		{
+			name:  "empty section name",
+			proxy: "",
+			cfg:   &TcpConfig{LocalPort: "22", RemotePort: "6000"},
+		},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateProxy(tt.proxy, tt.cfg); err == nil {
+				t.Error("hostile proxy accepted")
+			}
+			cfg := &Configs{Common: MapConfig{"server_addr": "127.0.0.1"}, Proxy: Proxy{tt.proxy: tt.cfg}}
+			if data, err := Marshal(cfg); err == nil {
+				t.Errorf("hostile proxy marshalled:\n%s", data)
+			}
+		})
+	}
+
+	escaped := []struct {
+		name  string
+		value string
+	}{
+		{name: "leading and trailing spaces", value: "  example.com  "},
+		{name: "tab", value: "a\tb"},
+		{name: "double quoted", value: `"example.com"`},
+		{name: "single quoted", value: `'example.com'`},
+		{name: "multi-line quote", value: `"""example.com`},
+		{name: "leading backquote", value: "`example.com"},
+		{name: "backquotes", value: "`a`b`"},
+		{name: "trailing backslash", value: `example.com\`},
+		{name: "inline comment", value: "a ; b # c"},
+		{name: "brackets", value: "[evil]"},
+		{name: "delimiters", value: "a=b:c"},
+		{name: "unicode", value: "例子.com"},
+	}
+	for _, tt := range escaped {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Configs{
+				Common: MapConfig{"server_addr": "127.0.0.1"},
+				Proxy: Proxy{
+					"default/web/[::1]:http": &HttpConfig{Host: "example.com", LocalPort: "80", HostHeaderRewrite: tt.value},
+					"default/next":           &TcpConfig{LocalPort: "22", RemotePort: "6000"},
+				},
+			}
+			if err := ValidateProxy("default/web/[::1]:http", cfg.Proxy["default/web/[::1]:http"]); err != nil {
+				t.Fatal(err)
+			}
+			data := mustMarshal(t, cfg)
+			got, err := Unmarshal(data)
+			if err != nil {
+				t.Fatalf("%v:\n%s", err, data)
+			}
+			if !got.Proxy.Equals(cfg.Proxy) || !Equals(got.Common, cfg.Common) {
+				t.Errorf("round trip mismatch:\n%s\n%s", data, mustMarshal(t, got))
+			}
+			if again := mustMarshal(t, got); string(again) != string(data) {
+				t.Errorf("marshal is not stable:\n%s\n%s", data, again)
+			}
+		})
+	}
+}
+
+func TestSetProxiesDropsHostile(t *testing.T) {
+	s := NewFakeSyncer().(*syncer)
+	s.SetProxies("default/web", map[string]Config{
+		"good": &HttpConfig{Host: "good.example.com", LocalPort: "80"},
+		"bad":  &HttpConfig{Host: "bad.example.com", LocalPort: "80", HostHeaderRewrite: "x\n[common]\nadmin_pwd=evil"},
+	})
+	configs := s.configsMap["default/web"]
+	if _, ok := configs["bad"]; ok {
+		t.Error("hostile proxy kept")
+	}
+	if _, ok := configs["good"]; !ok {
+		t.Error("valid proxy dropped")
+	}
+}
+
+func TestSyncProxyNames(t *testing.T) {
+	newSyncer := func(clients ...Client) *syncer {
+		return &syncer{
+			pool:       "frp",
+			clients:    clients,
+			ch:         make(chan struct{}, 1),
+			configsMap: map[string]map[string]Config{"default/web": {"web": &HttpConfig{Host: "web.example.com", LocalPort: "80", Group: "web", GroupKey: "key"}}},
+			failures:   make(map[string]map[string]string),
+			applied:    make(map[string]Proxy),
+			drifts:     make(map[string][]DriftEntry),
+		}
+	}
+	names := func(cli *fakeClient) []string {
+		var res []string
+		for name := range cli.cfg.Proxy {
+			res = append(res, name)
+		}
+		return res
+	}
+
+	a, b := &fakeClient{}, &fakeClient{}
+	s := newSyncer(a, b)
+	s.sync(context.Background())
+	if got := names(a); !reflect.DeepEqual(got, []string{"frp.0/web"}) {
+		t.Errorf("proxies of the first client = %v", got)
+	}
+	if got := names(b); !reflect.DeepEqual(got, []string{"frp.1/web"}) {
+		t.Errorf("proxies of the second client = %v", got)
+	}
+
+	// the slot of a frpc gone from discovery is not reused while it still holds it
+	s.slotReuseDelay = 0
+	setClients := func(clients ...Client) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.setClients(clients)
+	}
+	c := &fakeClient{}
+	setClients(a, c)
+	s.sync(context.Background())
+	if got := names(c); !reflect.DeepEqual(got, []string{"frp.2/web"}) {
+		t.Errorf("proxies of the new client = %v", got)
+	}
+
+	// a rescheduled frpc takes over the names of the one it replaces once that one is gone
+	b.cfg = &Configs{Common: MapConfig{}, Proxy: Proxy{}}
+	d := &fakeClient{}
+	setClients(a, c, d)
+	s.sync(context.Background())
+	if got := names(d); !reflect.DeepEqual(got, []string{"frp.1/web"}) {
+		t.Errorf("proxies of the rescheduled client = %v", got)
+	}
+
+	// the slots are recovered from the live configs after a restart of the controller
+	s = newSyncer(c, a)
+	s.sync(context.Background())
+	if got := names(a); !reflect.DeepEqual(got, []string{"frp.0/web"}) {
+		t.Errorf("proxies of the first client after restart = %v", got)
+	}
+	if got := names(c); !reflect.DeepEqual(got, []string{"frp.2/web"}) {
+		t.Errorf("proxies of the new client after restart = %v", got)
+	}
+
+	// the proxies named after the client address are reported, then renamed
+	legacy := &fakeClient{cfg: &Configs{Proxy: Proxy{legacyProxyName(a, "web"): s.configsMap["default/web"]["web"]}}}
+	s = newSyncer(legacy)
+	if status := s.Status(context.Background())["default/web"]; len(status) != 1 || !status[0].Running() {
+		t.Errorf("status of the legacy proxy = %+v", status)
+	}
+	s.sync(context.Background())
+	if got := names(legacy); !reflect.DeepEqual(got, []string{"frp.0/web"}) {
+		t.Errorf("legacy proxies not renamed: %v", got)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		t.Helper()
+		// replace the file like kubelet updates a mounted Secret
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	newCA := func() (*x509.Certificate, *ecdsa.PrivateKey) {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	issue := func(ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage, dnsName string) ([]byte, []byte) {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: dnsName},
+			DNSNames:     []string{dnsName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+	caPEM := func(ca *x509.Certificate) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	}
+
+	ca, caKey := newCA()
+	serverCert, serverKey := issue(ca, caKey, x509.ExtKeyUsageServerAuth, "frpc.example.com")
+	serverPair, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	var token atomic.Value
+	token.Store("first")
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	clientCert, clientKey := issue(ca, caKey, x509.ExtKeyUsageClientAuth, "ingress-frp")
+	tlsConfig := &TLSConfig{
+		CAFile:   writeFile("ca.crt", caPEM(ca)),
+		CertFile: writeFile("tls.crt", clientCert),
+		KeyFile:  writeFile("tls.key", clientKey),
+	}
+	tokenFile := writeFile("token", []byte("first\n"))
+	build := func(cfg *TLSConfig) *tls.Config {
+		t.Helper()
+		built, err := cfg.Build("frpc.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return built
+	}
+	newClient := func(cfg *TLSConfig) Client {
+		return NewClient(addr.IP, uint16(addr.Port), NewFileBearerAuth(tokenFile), build(cfg), nil)
+	}
+
+	built := build(tlsConfig)
+	client := NewClient(addr.IP, uint16(addr.Port), NewFileBearerAuth(tokenFile), built, nil)
+	if err := client.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the rotated token is read again
+	token.Store("second")
+	writeFile("token", []byte("second\n"))
+	if err := client.Reload(context.Background()); err != nil {
+		t.Fatalf("rotated token not used: %v", err)
+	}
+
+	// the admin api certificate must be issued by the pinned CA for the server name
+	if err := newClient(&TLSConfig{CAFile: tlsConfig.CAFile, CertFile: tlsConfig.CertFile, KeyFile: tlsConfig.KeyFile, ServerName: "other.example.com"}).
+		Reload(context.Background()); err == nil {
+		t.Error("certificate of another name accepted")
+	}
+	otherCA, _ := newCA()
+	writeFile("ca.crt", caPEM(otherCA))
+	// the CA file is read again on the next handshake
+	if err := NewClient(addr.IP, uint16(addr.Port), NewFileBearerAuth(tokenFile), built, nil).Reload(context.Background()); err == nil {
+		t.Error("certificate of an unpinned CA accepted")
+	}
+	writeFile("ca.crt", caPEM(ca))
+
+	// the client certificate is required by the admin api
+	if err := newClient(&TLSConfig{CAFile: tlsConfig.CAFile}).Reload(context.Background()); err == nil {
+		t.Error("connected without client certificate")
+	}
+}
+
+func TestRotatingAuth(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("old")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || password != accepted.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	auth := NewRotatingBasicAuth("admin", "new", "old")
+	client := NewClient(addr.IP, uint16(addr.Port), auth, nil, nil)
+	// the frpc started before the rotation still runs with the previous password
+	if err := client.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := auth.PreviousHosts(time.Now().Add(-time.Minute)); !reflect.DeepEqual(hosts, []string{addr.String()}) {
+		t.Errorf("hosts running with the previous password = %v", hosts)
+	}
+
+	// restarted with the new password
+	accepted.Store("new")
+	if err := client.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := auth.PreviousHosts(time.Now().Add(-time.Minute)); len(hosts) != 0 {
+		t.Errorf("hosts running with the previous password = %v", hosts)
+	}
+
+	// neither password is accepted
+	accepted.Store("other")
+	if err := client.Reload(context.Background()); err == nil {
+		t.Error("rejected credentials not reported")
+	}
+}
+
+func TestSyncCommon(t *testing.T) {
+	cli := &fakeClient{}
+	s := &syncer{
+		pool:       "frp",
+		clients:    []Client{cli},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.SetCommon("admin-credentials", map[string]string{"admin_user": "admin", "admin_pwd": "secret"})
+	s.sync(context.Background())
+	if common := cli.cfg.Common; common["admin_pwd"] != "secret" || common["server_addr"] != "8.8.8.8" {
+		t.Errorf("common = %v, want the managed keys merged into the live section", common)
+	}
+
+	// released keys are left as they are
+	s.SetCommon("admin-credentials", nil)
+	s.sync(context.Background())
+	if common := cli.cfg.Common; common["admin_pwd"] != "secret" {
+		t.Errorf("common = %v", common)
+	}
+}
+
+// unreachableClient fails to read its config while down
+type unreachableClient struct {
+	*fakeClient
+	down bool
+}
+
+func (c *unreachableClient) GetConfigs(ctx context.Context) (*Configs, error) {
+	if c.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return c.fakeClient.GetConfigs(ctx)
+}
+
+func TestSyncGroupKeyRoll(t *testing.T) {
+	clients := []*unreachableClient{{fakeClient: &fakeClient{}}, {fakeClient: &fakeClient{}}, {fakeClient: &fakeClient{}}}
+	s := newSyncer("frp")
+	s.ctx = context.Background()
+	for _, cli := range clients {
+		s.clients = append(s.clients, cli)
+	}
+	setKey := func(key string) {
+		s.SetProxies("default/web", map[string]Config{
+			"web": &HttpConfig{Host: "web.example.com", LocalPort: "80", Group: "web", GroupKey: key},
+		})
+	}
+	// members returns the key of the group on every client, empty when the client is not a member
+	members := func() []string {
+		keys := make([]string, len(clients))
+		for i, cli := range clients {
+			for _, cfg := range cli.cfg.Proxy {
+				if group, key := groupOf(cfg); group == "web" {
+					keys[i] = key
+				}
+			}
+		}
+		return keys
+	}
+	setKey("old")
+	s.sync(context.Background())
+	if got := members(); !reflect.DeepEqual(got, []string{"old", "old", "old"}) {
+		t.Fatalf("members = %v", got)
+	}
+
+	// nothing changes while a client may hold the old key
+	setKey("new")
+	clients[2].down = true
+	s.sync(context.Background())
+	if got := members(); !reflect.DeepEqual(got, []string{"old", "old", "old"}) {
+		t.Errorf("members with an unreachable client = %v", got)
+	}
+	clients[2].down = false
+
+	// frps rejects the members joining with another key than the group, so the group never has mixed keys and keeps
+	// a member at every step
+	want := [][]string{
+		{"old", "", ""},
+		{"new", "", ""},
+		{"new", "new", "new"},
+	}
+	for i, w := range want {
+		s.sync(context.Background())
+		if got := members(); !reflect.DeepEqual(got, w) {
+			t.Errorf("members after step %d = %v, want %v", i+1, got, w)
+		}
+	}
+	if n := atomic.LoadInt64(&s.requests); n != 0 {
+		t.Errorf("%d syncs requested after the roll", n)
+	}
+}
+
+type stopCountingClient struct {
+	*fakeClient
+	stops int
+}
+
+func (c *stopCountingClient) Stop(ctx context.Context) error {
+	c.stops++
+	return nil
+}
+
+func TestSyncCommonRestart(t *testing.T) {
+	a, b := &stopCountingClient{fakeClient: &fakeClient{}}, &stopCountingClient{fakeClient: &fakeClient{}}
+	s := &syncer{
+		pool:       "frp",
+		clients:    []Client{a, b},
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.sync(context.Background())
+	if a.stops+b.stops != 0 {
+		t.Fatalf("clients stopped without a [common] change: %d, %d", a.stops, b.stops)
+	}
+
+	// the clients are stopped one sync at a time to read the new [common] section
+	s.SetCommon(poolCommonKey, map[string]string{"server_addr": "frps.example.com"})
+	s.sync(context.Background())
+	if a.stops != 1 || b.stops != 0 {
+		t.Errorf("stops after the first sync = %d, %d, want 1, 0", a.stops, b.stops)
+	}
+	if a.cfg.Common["server_addr"] != "frps.example.com" || b.cfg.Common["server_addr"] != "frps.example.com" {
+		t.Errorf("common = %v, %v", a.cfg.Common, b.cfg.Common)
+	}
+	s.sync(context.Background())
+	if a.stops != 1 || b.stops != 1 {
+		t.Errorf("stops after the second sync = %d, %d, want 1, 1", a.stops, b.stops)
+	}
+	s.sync(context.Background())
+	if a.stops != 1 || b.stops != 1 {
+		t.Errorf("stops after the third sync = %d, %d, want 1, 1", a.stops, b.stops)
+	}
+}
+
+func TestPoolsApplyCommon(t *testing.T) {
+	pools := NewPools(nil)
+	pool := PoolConfig{IngressClass: "frp", Addr: "frpc.example.com", Common: map[string]string{"server_addr": "a.example.com"}}
+	if _, err := pools.Apply(pool); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := pools.Get("frp")
+
+	pool.Common = map[string]string{"server_addr": "b.example.com"}
+	changed, err := pools.Apply(pool)
+	if err != nil || !changed {
+		t.Fatalf("apply = %v, %v", changed, err)
+	}
+	if got, _ := pools.Get("frp"); got != s {
+		t.Error("syncer replaced on a [common] change")
+	}
+	if got := s.(*syncer).managedCommon()["server_addr"]; got != "b.example.com" {
+		t.Errorf("server_addr = %s", got)
+	}
+
+	pool.Common = map[string]string{"admin_pwd": "secret"}
+	if _, err := pools.Apply(pool); err == nil {
+		t.Error("admin keys accepted in the [common] section")
+	}
+}
+
+func TestPoolsHandOver(t *testing.T) {
+	static := newSyncer("frp")
+	static.SetCommon(poolCommonKey, map[string]string{"server_addr": "static.example.com"})
+	pools := NewPools(map[string]Syncer{"frp": static})
+	web := map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80"}}
+	static.SetProxies("default/web", web)
+	static.SetCommon("default/params", map[string]string{"user": "web"})
+
+	// a new syncer starts with the proxies of the one it replaces, and the [common] keys of its own pool
+	pool := PoolConfig{IngressClass: "frp", Addr: "frpc.example.com", Common: map[string]string{"server_addr": "a.example.com"}}
+	if _, err := pools.Apply(pool); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := pools.Get("frp")
+	configsMap, commons := got.(*syncer).desired()
+	if !reflect.DeepEqual(configsMap["default/web"], web) {
+		t.Errorf("proxies of the applied pool = %v", configsMap)
+	}
+	if commons[poolCommonKey]["server_addr"] != "a.example.com" || commons["default/params"]["user"] != "web" {
+		t.Errorf("commons of the applied pool = %v", commons)
+	}
+
+	// the static syncer gets the proxies set while it was replaced
+	api := map[string]Config{"api": &HttpConfig{Host: "api.example.com", LocalPort: "80"}}
+	got.SetProxies("default/api", api)
+	got.DeleteProxies("default/web")
+	pools.Remove("frp")
+	configsMap, commons = static.desired()
+	if _, ok := configsMap["default/web"]; ok || !reflect.DeepEqual(configsMap["default/api"], api) {
+		t.Errorf("proxies of the static pool = %v", configsMap)
+	}
+	if commons[poolCommonKey]["server_addr"] != "static.example.com" {
+		t.Errorf("commons of the static pool = %v", commons)
+	}
+}
+
+func TestPoolsRemoveDrains(t *testing.T) {
+	pools := NewPools(nil)
+	if _, err := pools.Apply(PoolConfig{IngressClass: "frp", Addr: "frpc.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := pools.Get("frp")
+	s := got.(*syncer)
+	cli := &fakeClient{}
+	s.mu.Lock()
+	s.setClients([]Client{cli})
+	s.mu.Unlock()
+	s.SetProxies("default/web", map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80"}})
+	s.sync(context.Background())
+	if cfg, _ := cli.GetConfigs(context.Background()); len(cfg.Proxy) != 1 {
+		t.Fatalf("proxy not applied:\n%s", mustMarshal(t, cfg))
+	}
+
+	// no static pool takes the proxies over, they are removed from the clients
+	if !pools.Remove("frp") {
+		t.Fatal("applied pool not removed")
+	}
+	if _, ok := pools.Get("frp"); ok {
+		t.Error("removed pool still served")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cfg, _ := cli.GetConfigs(context.Background())
+		if len(cfg.Proxy) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxies of the removed pool kept:\n%s", mustMarshal(t, cfg))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the pools applied at runtime only reach their clients through the admin api
+	for _, pool := range []PoolConfig{
+		{IngressClass: "embedded", Embedded: true},
+		{IngressClass: "secret", Secret: &SecretDelivery{Namespace: "kube-system", Name: "frpc-configs", PodSelector: "app=frpc"}},
+	} {
+		if _, err := pools.Apply(pool); err == nil {
+			t.Errorf("pool %s applied", pool.IngressClass)
+		}
+	}
+}
+
+func TestEmbeddedSyncer(t *testing.T) {
+	s := NewEmbeddedSyncer("frp").(*embeddedSyncer)
+	defer s.client.close()
+	// the server never answers, the client waits for the login response
+	s.SetCommon(poolCommonKey, map[string]string{"server_addr": "127.0.0.1", "server_port": silentServer(t)})
+	s.SetProxies("default/web", map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80"}})
+	s.sync(context.Background())
+
+	cli := s.client
+	if cli.svr == nil {
+		t.Fatal("embedded client not started")
+	}
+	if _, ok := cli.cfg.Proxy["frp.0/web"]; !ok {
+		t.Errorf("proxies = %v", cli.cfg.Proxy)
+	}
+	if status := s.Status(context.Background())["default/web"]; len(status) != 1 || status[0].Status != ProxyPhaseWaitStart {
+		t.Errorf("status = %+v, want waiting to log in", status)
+	}
+
+	// a proxy change is reloaded by the running service
+	svr := cli.svr
+	s.SetProxies("default/web", map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "8080"}})
+	s.sync(context.Background())
+	if cli.svr != svr {
+		t.Error("service restarted on a proxy change")
+	}
+
+	// a [common] change restarts the service
+	port := silentServer(t)
+	s.SetCommon(poolCommonKey, map[string]string{"server_addr": "127.0.0.1", "server_port": port})
+	s.sync(context.Background())
+	if cli.svr == svr {
+		t.Error("service not restarted on a [common] change")
+	}
+	if cli.common["server_port"] != port {
+		t.Errorf("common of the service = %v", cli.common)
+	}
+
+	// the server_https proxies of the TLS ingresses are refused, upstream frp lacks the type
+	s.SetProxies("default/tls", map[string]Config{
+		"tls": &ServerHttpsConfig{
+			HttpConfig: HttpConfig{Host: "tls.example.com", LocalPort: "80"},
+			TlsCrt:     "crt",
+			TlsKey:     "key",
+		},
+		"tls-backend": &ServerHttps2HttpsConfig{
+			HttpConfig: HttpConfig{Host: "tls-backend.example.com", LocalIp: "127.0.0.1", LocalPort: "443"},
+			TlsCrt:     "crt",
+			TlsKey:     "key",
+		},
+	})
+	s.sync(context.Background())
+	for _, name := range []string{"frp.0/tls", "frp.0/tls-backend"} {
+		if _, ok := cli.cfg.Proxy[name]; ok {
+			t.Errorf("server_https proxy %s applied to the embedded client", name)
+		}
+	}
+	if _, ok := cli.cfg.Proxy["frp.0/web"]; !ok {
+		t.Errorf("proxy web not applied beside the refused ones: %v", cli.cfg.Proxy)
+	}
+	status := s.Status(context.Background())["default/tls"]
+	if len(status) != 2 {
+		t.Errorf("refused proxies status %+v", status)
+	}
+	for _, st := range status {
+		if st.Status != ProxyPhaseApplyFailed || !strings.Contains(st.Err, TypeServerHttps) {
+			t.Errorf("refused proxy status %+v", st)
+		}
+	}
+
+	// configs frp can not parse are rejected
+	if err := cli.SetConfig(context.Background(), &Configs{Common: MapConfig{"protocol": "carrier-pigeon"}}); err == nil {
+		t.Error("invalid protocol accepted")
+	}
+}
+
+// silentServer listens on a port of the loopback which accepts connections and never answers, the port is returned
+func silentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestEmbeddedClientRestarts(t *testing.T) {
+	s := NewEmbeddedSyncer("frp").(*embeddedSyncer)
+	cli := s.client
+	cli.backoff = 10 * time.Millisecond
+	// nothing listens on the server port, each login fails at once, even though the config asks to retry
+	s.SetCommon(poolCommonKey, map[string]string{"server_addr": "127.0.0.1", "server_port": "1", "login_fail_exit": "false"})
+	s.SetProxies("default/web", map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80"}})
+	s.sync(context.Background())
+
+	services := func() (svr *frpclient.Service, restarting bool, loginErr error) {
+		cli.mu.Lock()
+		defer cli.mu.Unlock()
+		return cli.svr, cli.restart != nil, cli.loginErr
+	}
+	if svr, _, _ := services(); svr == nil {
+		t.Fatal("embedded client not started")
+	}
+	// every restarted service fails again and records its own login error
+	var firstErr error
+	var reported, restarted bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !(reported && restarted); time.Sleep(time.Millisecond) {
+		if status := s.Status(context.Background())["default/web"]; len(status) == 1 && strings.Contains(status[0].Err, "failed to log in") {
+			if status[0].Status != ProxyPhaseWaitStart {
+				t.Errorf("status = %+v, want waiting to start", status[0])
+			}
+			reported = true
+		}
+		if _, _, err := services(); firstErr == nil {
+			firstErr = err
+		} else if err != firstErr {
+			restarted = true
+		}
+	}
+	if !reported {
+		t.Error("failed login not reported in the status")
+	}
+	if !restarted {
+		t.Error("service not restarted after the failed login")
+	}
+
+	// a closed client is not restarted any more
+	cli.close()
+	time.Sleep(100 * time.Millisecond)
+	if svr, restarting, _ := services(); svr != nil || restarting {
+		t.Errorf("closed client restarted: service %v, restart pending %v", svr, restarting)
+	}
+}
+
+func TestSecretSyncer(t *testing.T) {
+	ctx := context.Background()
+	pod := func(name, ip string, phase corev1.PodPhase, ready bool) *corev1.Pod {
+		cond := corev1.ConditionFalse
+		if ready {
+			cond = corev1.ConditionTrue
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: name, Labels: map[string]string{"app": "frpc"}},
+			Status: corev1.PodStatus{
+				Phase:      phase,
+				PodIP:      ip,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: cond}},
+			},
+		}
+	}
+	key := types.NamespacedName{Namespace: "kube-system", Name: "frpc-configs"}
+	c := fake.NewClientBuilder().WithObjects(
+		pod("frpc-a", "10.0.0.1", corev1.PodRunning, true),
+		pod("frpc-b", "10.0.0.2", corev1.PodRunning, false),
+		pod("frpc-c", "", corev1.PodPending, false),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name, Labels: map[string]string{constants.LabelConfigsPool: "frp"}},
+			Data:       map[string][]byte{"frpc-gone.ini": []byte("[common]\n"), "README": []byte("written by ingress-frp")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: "foreign"},
+			Data:       map[string][]byte{"token": []byte("secret")},
+		},
+	).Build()
+
+	s := NewSecretSyncer("frp", c, key, "", labels.SelectorFromSet(labels.Set{"app": "frpc"}), nil).(*secretSyncer)
+	s.SetCommon(poolCommonKey, map[string]string{"server_addr": "frps.example.com"})
+	s.SetProxies("default/web", map[string]Config{"web": &HttpConfig{Host: "web.example.com", LocalPort: "80", Group: "web", GroupKey: "key"}})
+	if err := s.discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.clients) != 2 {
+		t.Fatalf("clients = %d, want the 2 running pods", len(s.clients))
+	}
+	s.sync(ctx)
+
+	var secret corev1.Secret
+	if err := c.Get(ctx, key, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["frpc-gone.ini"]; ok {
+		t.Error("config of a pod which is gone kept")
+	}
+	if _, ok := secret.Data["README"]; !ok {
+		t.Error("foreign key removed")
+	}
+	for podName, proxyName := range map[string]string{"frpc-a.ini": "frp.0/web", "frpc-b.ini": "frp.1/web"} {
+		cfg, err := Unmarshal(secret.Data[podName])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Common["server_addr"] != "frps.example.com" {
+			t.Errorf("common of %s = %v", podName, cfg.Common)
+		}
+		if _, ok := cfg.Proxy[proxyName]; !ok || len(cfg.Proxy) != 1 {
+			t.Errorf("proxies of %s = %v, want %s", podName, cfg.Proxy, proxyName)
+		}
+	}
+
+	status := s.Status(ctx)["default/web"]
+	if len(status) != 2 || status[0].Status != ProxyPhaseUnverified || status[1].Status != ProxyPhaseWaitStart {
+		t.Errorf("status = %+v, want unverified on the ready pod only", status)
+	}
+
+	// the config of a deleted pod is removed
+	if err := c.Delete(ctx, pod("frpc-b", "10.0.0.2", corev1.PodRunning, false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["frpc-b.ini"]; ok || len(s.clients) != 1 {
+		t.Errorf("config of the deleted pod kept: %v", secret.Data)
+	}
+
+	// a Secret which is not labeled with the pool is not written
+	foreign := &secretClient{client: c, pool: "frp", secret: types.NamespacedName{Namespace: key.Namespace, Name: "foreign"},
+		pod: types.NamespacedName{Namespace: key.Namespace, Name: "frpc-a"}, codec: IniCodec}
+	if err := foreign.SetConfig(ctx, &Configs{Common: MapConfig{"server_addr": "frps.example.com"}}); err == nil {
+		t.Error("config written to a Secret of another owner")
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: key.Namespace, Name: "foreign"}, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data) != 1 {
+		t.Errorf("foreign Secret changed: %v", secret.Data)
+	}
+}
+
+func TestSecretClientCertFiles(t *testing.T) {
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "kube-system", Name: "frpc-configs"}
+	c := fake.NewClientBuilder().Build()
+	cli := &secretClient{client: c, pool: "frp", secret: key, mountPath: DefaultSecretMountPath,
+		pod: types.NamespacedName{Namespace: key.Namespace, Name: "frpc-a"}, codec: TomlCodec}
+	if err := checkProxy(cli, "frp.0/tls", &Https2HttpConfig{CrtBase64: "Y3J0"}); err != nil {
+		t.Errorf("inline certificate refused: %v", err)
+	}
+
+	tls := &Https2HttpConfig{
+		HttpConfig: HttpConfig{Host: "tls.example.com", LocalIp: "127.0.0.1", LocalPort: "80"},
+		CrtBase64:  base64.StdEncoding.EncodeToString([]byte("crt")),
+		KeyBase64:  base64.StdEncoding.EncodeToString([]byte("key")),
+	}
+	want := &Configs{Common: MapConfig{"server_addr": "frps.example.com"}, Proxy: Proxy{"frp.0/tls": tls}}
+	if err := cli.SetConfig(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	var secret corev1.Secret
+	if err := c.Get(ctx, key, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(secret.Data["frpc-a.toml"]), "Base64") || !strings.Contains(string(secret.Data["frpc-a.toml"]), "crtPath") {
+		t.Errorf("certificates not moved to files:\n%s", secret.Data["frpc-a.toml"])
+	}
+	var files []string
+	for k, v := range secret.Data {
+		if certFileKey.MatchString(k) {
+			files = append(files, k+"="+string(v))
+			if !strings.Contains(string(secret.Data["frpc-a.toml"]), DefaultSecretMountPath+"/"+k) {
+				t.Errorf("file %s not referenced:\n%s", k, secret.Data["frpc-a.toml"])
+			}
+		}
+	}
+	sort.Strings(files)
+	if len(files) != 2 || !strings.HasSuffix(files[0], ".crt=crt") || !strings.HasSuffix(files[1], ".key=key") {
+		t.Errorf("certificate files %v", files)
+	}
+
+	// the config read back holds the certificates inline again, as they were desired
+	got, err := cli.GetConfigs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Proxy.Equals(want.Proxy) {
+		t.Errorf("read back %v, want %v", got.Proxy, want.Proxy)
+	}
+
+	// the files of a removed proxy are removed with it
+	if err := cli.SetConfig(ctx, &Configs{Common: want.Common, Proxy: Proxy{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data) != 1 {
+		t.Errorf("certificate files kept: %v", secret.Data)
+	}
+}
@@ -0,0 +1,53 @@
+package frp
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Dump is the desired state of the Syncer compared with the live config of every client, sensitive values are masked
+type Dump struct {
+	// Keys are the proxies set on the Syncer by key, e.g. by ingress
+	Keys    map[string]map[string]map[string]string `json:"keys"`
+	Clients []ClientDump                            `json:"clients"`
+}
+
+type ClientDump struct {
+	Addr string `json:"addr"`
+	// Desired are the proxies placed on the client, by the name pushed to the client
+	Desired map[string]map[string]string `json:"desired"`
+	Common  map[string]string            `json:"common,omitempty"`
+	Live    map[string]map[string]string `json:"live,omitempty"`
+	Diff    *Diff                        `json:"diff,omitempty"`
+	Error   string                       `json:"error,omitempty"`
+}
+
+func dumpProxy(proxy map[string]Config) map[string]map[string]string {
+	res := make(map[string]map[string]string, len(proxy))
+	for name, cfg := range proxy {
+		res[name] = RedactMap(cfg.ToMap())
+	}
+	return res
+}
+
+// NewDebugHandler serves the Dump of every Syncer as json, keyed by pool
+func NewDebugHandler(pools *Pools) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		syncers := pools.Syncers()
+		dumps := make(map[string]*Dump, len(syncers))
+		for pool, s := range syncers {
+			dumps[pool] = s.Dump(r.Context())
+		}
+		data, err := json.MarshalIndent(dumps, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
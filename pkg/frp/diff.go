@@ -0,0 +1,221 @@
+package frp
+
+import "sort"
+
+const redacted = "******"
+
+// KeyChange is a key with different values in the desired and the live config
+type KeyChange struct {
+	Desired string `json:"desired"`
+	Live    string `json:"live"`
+}
+
+// ProxyDiff compares the keys of a proxy present in both the desired and the live config
+type ProxyDiff struct {
+	// Added are the keys missing in the live config
+	Added map[string]string `json:"added,omitempty"`
+	// Removed are the keys only present in the live config
+	Removed map[string]string    `json:"removed,omitempty"`
+	Changed map[string]KeyChange `json:"changed,omitempty"`
+}
+
+// Diff compares the desired proxies of a client with its live config
+type Diff struct {
+	// Added are the proxies missing in the live config
+	Added []string `json:"added,omitempty"`
+	// Removed are the proxies only present in the live config
+	Removed []string             `json:"removed,omitempty"`
+	Changed map[string]ProxyDiff `json:"changed,omitempty"`
+}
+
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffProxy compares the desired proxies with the live ones
+func DiffProxy(desired, live Proxy) Diff {
+	var d Diff
+	for name, cfg := range desired {
+		liveCfg, ok := live[name]
+		if !ok {
+			d.Added = append(d.Added, name)
+			continue
+		}
+		if pd := diffConfig(cfg.ToMap(), liveCfg.ToMap()); pd != nil {
+			if d.Changed == nil {
+				d.Changed = make(map[string]ProxyDiff)
+			}
+			d.Changed[name] = *pd
+		}
+	}
+	for name := range live {
+		if _, ok := desired[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+func diffConfig(desired, live map[string]string) *ProxyDiff {
+	var pd ProxyDiff
+	changed := false
+	for k, v := range desired {
+		lv, ok := live[k]
+		switch {
+		case !ok:
+			if pd.Added == nil {
+				pd.Added = make(map[string]string)
+			}
+			pd.Added[k] = v
+			changed = true
+		case lv != v:
+			if pd.Changed == nil {
+				pd.Changed = make(map[string]KeyChange)
+			}
+			pd.Changed[k] = KeyChange{Desired: v, Live: lv}
+			changed = true
+		}
+	}
+	for k, v := range live {
+		if _, ok := desired[k]; !ok {
+			if pd.Removed == nil {
+				pd.Removed = make(map[string]string)
+			}
+			pd.Removed[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return &pd
+}
+
+// Redacted returns a copy of the diff with the values of sensitive keys masked
+func (d Diff) Redacted() Diff {
+	res := Diff{Added: d.Added, Removed: d.Removed}
+	if d.Changed != nil {
+		res.Changed = make(map[string]ProxyDiff, len(d.Changed))
+		for name, pd := range d.Changed {
+			res.Changed[name] = ProxyDiff{
+				Added:   RedactMap(pd.Added),
+				Removed: RedactMap(pd.Removed),
+				Changed: redactChanges(pd.Changed),
+			}
+		}
+	}
+	return res
+}
+
+// RedactMap returns a copy of the map with the values of sensitive keys masked
+func RedactMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		if isSensitiveKey(k) {
+			v = redacted
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// RedactCommon returns a copy of the [common] section with the values of the keys not known to be public masked
+func RedactCommon(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		if !publicCommonKeys[k] {
+			v = redacted
+		}
+		res[k] = v
+	}
+	return res
+}
+
+func redactChanges(m map[string]KeyChange) map[string]KeyChange {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]KeyChange, len(m))
+	for k, v := range m {
+		if isSensitiveKey(k) {
+			v = KeyChange{Desired: redacted, Live: redacted}
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// DriftChange classifies an out-of-band edit of a key, seen from the live config
+type DriftChange string
+
+const (
+	DriftAdded   DriftChange = "added"
+	DriftRemoved DriftChange = "removed"
+	DriftChanged DriftChange = "changed"
+)
+
+// DriftEntry is a key of the live config that differs from the config applied by the Syncer, values are masked
+type DriftEntry struct {
+	Proxy   string      `json:"proxy"`
+	Key     string      `json:"key"`
+	Change  DriftChange `json:"change"`
+	Applied string      `json:"applied,omitempty"`
+	Live    string      `json:"live,omitempty"`
+}
+
+// DetectDrift classifies the differences between the proxies applied to a client and its live proxies
+func DetectDrift(applied, live Proxy) []DriftEntry {
+	var entries []DriftEntry
+	add := func(proxy string, change DriftChange, keys map[string]string) {
+		foreach(keys, func(k string, v string) bool {
+			e := DriftEntry{Proxy: proxy, Key: k, Change: change}
+			if change == DriftAdded {
+				e.Live = v
+			} else {
+				e.Applied = v
+			}
+			if isSensitiveKey(k) {
+				e.Applied, e.Live = maskNonEmpty(e.Applied), maskNonEmpty(e.Live)
+			}
+			entries = append(entries, e)
+			return true
+		})
+	}
+
+	d := DiffProxy(applied, live)
+	for _, name := range d.Removed {
+		add(name, DriftAdded, live[name].ToMap())
+	}
+	for _, name := range d.Added {
+		add(name, DriftRemoved, applied[name].ToMap())
+	}
+	foreach(d.Changed, func(name string, pd ProxyDiff) bool {
+		add(name, DriftAdded, pd.Removed)
+		add(name, DriftRemoved, pd.Added)
+		foreach(pd.Changed, func(k string, c KeyChange) bool {
+			e := DriftEntry{Proxy: name, Key: k, Change: DriftChanged, Applied: c.Desired, Live: c.Live}
+			if isSensitiveKey(k) {
+				e.Applied, e.Live = maskNonEmpty(e.Applied), maskNonEmpty(e.Live)
+			}
+			entries = append(entries, e)
+			return true
+		})
+		return true
+	})
+	return entries
+}
+
+func maskNonEmpty(v string) string {
+	if v == "" {
+		return ""
+	}
+	return redacted
+}
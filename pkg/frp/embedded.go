@@ -0,0 +1,281 @@
+package frp
+
+import (
+	"context"
+	"fmt"
+	frpclient "github.com/fatedier/frp/client"
+	frpconfig "github.com/fatedier/frp/pkg/config"
+	frplog "github.com/fatedier/frp/pkg/util/log"
+	"net"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// embeddedAddr is reported as the address of the embedded client, which has no admin api
+var embeddedAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// the delays before the embedded client restarts a service which failed to log in to frps, doubled on every failure
+const (
+	embeddedMinBackoff = time.Second
+	embeddedMaxBackoff = 5 * time.Minute
+)
+
+// NewEmbeddedSyncer creates a Syncer running a frp client in the manager process, the configs are applied to it
+// directly instead of through the admin api of a frpc. The client starts with the first sync.
+func NewEmbeddedSyncer(pool string) Syncer {
+	cli := &embeddedClient{cfg: &Configs{Common: MapConfig{}, Proxy: Proxy{}}, backoff: embeddedMinBackoff}
+	s := newSyncer(pool)
+	s.clients = []Client{cli}
+	return &embeddedSyncer{syncer: s, client: cli}
+}
+
+type embeddedSyncer struct {
+	*syncer
+	client *embeddedClient
+}
+
+// Start runs the syncer and closes the embedded client when the context is done
+func (s *embeddedSyncer) Start(ctx context.Context) error {
+	discoveredClients.WithLabelValues(s.pool).Set(1)
+	defer s.client.close()
+	return s.syncer.Start(ctx)
+}
+
+// embeddedClient runs a frp client service, it behaves as a frpc: Reload applies the proxies, the [common] section
+// is only read when the service starts, and Stop restarts the service as the supervisor of a frpc would. A service
+// failing to log in to frps is restarted with backoff, as the supervisor would restart a frpc exiting on it.
+type embeddedClient struct {
+	cfg *Configs
+	svr *frpclient.Service
+	// common is the [common] section the service started with
+	common MapConfig
+	// loginErr is the error the last service stopped on, restart starts the next one once backoff elapsed
+	loginErr error
+	restart  *time.Timer
+	backoff  time.Duration
+	closed   bool
+	mu       sync.Mutex
+}
+
+var _ Client = (*embeddedClient)(nil)
+
+func (c *embeddedClient) Addr() *net.TCPAddr {
+	return embeddedAddr
+}
+
+func (c *embeddedClient) GetConfigs(ctx context.Context) (*Configs, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := Marshal(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(data)
+}
+
+// SetConfig stores the config, which is applied by Reload. A config frp can not parse is rejected.
+func (c *embeddedClient) SetConfig(ctx context.Context, config *Configs) error {
+	if _, _, _, err := parseEmbeddedConfig(config); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = config
+	return nil
+}
+
+// CheckProxy refuses the proxies frp can not parse. The embedded client is upstream frp, which lacks the server_https
+// type of the frproc fork the TLS ingresses are served with.
+func (c *embeddedClient) CheckProxy(name string, cfg Config) error {
+	if cfg.ToMap()["type"] == TypeServerHttps {
+		return fmt.Errorf("proxy %s: type %s is not supported by the embedded frp client, TLS ingresses need a frpc of the frproc fork", name, TypeServerHttps)
+	}
+	data, err := Marshal(&Configs{Common: MapConfig{}, Proxy: Proxy{name: cfg}})
+	if err != nil {
+		return err
+	}
+	if _, _, err := frpconfig.LoadAllProxyConfsFromIni("", data, nil); err != nil {
+		return fmt.Errorf("proxy %s is not supported by the embedded frp client: %w", name, err)
+	}
+	return nil
+}
+
+func (c *embeddedClient) Reload(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.svr == nil {
+		if c.restart != nil {
+			// the restarting service starts with the stored config
+			return nil
+		}
+		return c.start()
+	}
+	_, pxyCfgs, visitorCfgs, err := parseEmbeddedConfig(c.cfg)
+	if err != nil {
+		return err
+	}
+	return c.svr.ReloadConf(pxyCfgs, visitorCfgs)
+}
+
+// Stop restarts the service, which reads the [common] section again. A service already running the [common]
+// section, or restarting with it, is kept. A new [common] section is tried at once.
+func (c *embeddedClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sameCommon := reflect.DeepEqual(c.common, MapConfig(c.cfg.Common.ToMap()))
+	if c.svr != nil {
+		if sameCommon {
+			return nil
+		}
+		c.svr.Close()
+		c.svr = nil
+	}
+	if c.restart != nil {
+		if sameCommon {
+			return nil
+		}
+		c.restart.Stop()
+		c.restart = nil
+		c.backoff = embeddedMinBackoff
+	}
+	return c.start()
+}
+
+// Status reports the proxies of the config. frp does not export the status of the proxies of a service, so they are
+// running once the service is logged in to frps and waiting to start before.
+func (c *embeddedClient) Status(ctx context.Context) ([]ProxyStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var reason string
+	switch {
+	case c.svr != nil:
+	case c.restart != nil:
+		reason = fmt.Sprintf("embedded frp client failed to log in to frps, retrying: %v", c.loginErr)
+	default:
+		return nil, fmt.Errorf("embedded frp client is not started")
+	}
+	phase := ProxyPhaseWaitStart
+	if c.svr != nil && c.svr.GetController() != nil {
+		phase = ProxyPhaseRunning
+		// the next failed login is retried at once again
+		c.backoff = embeddedMinBackoff
+	}
+	status := make([]ProxyStatus, 0, len(c.cfg.Proxy))
+	for name, proxy := range c.cfg.Proxy {
+		status = append(status, ProxyStatus{
+			Name:   name,
+			Type:   proxy.ToMap()["type"],
+			Status: phase,
+			Err:    reason,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status, nil
+}
+
+// start starts a service with the current config, c.mu must be held
+func (c *embeddedClient) start() error {
+	common, pxyCfgs, visitorCfgs, err := parseEmbeddedConfig(c.cfg)
+	if err != nil {
+		return err
+	}
+	initEmbeddedLog(common)
+	// frp retries a failed login in a loop Close does not end, the service stops on it and run restarts it instead
+	common.LoginFailExit = true
+	svr, err := frpclient.NewService(common, pxyCfgs, visitorCfgs, "")
+	if err != nil {
+		return err
+	}
+	c.svr = svr
+	c.common = MapConfig(c.cfg.Common.ToMap())
+	go c.run(svr, common.ServerAddr)
+	return nil
+}
+
+// run runs the service until it is closed. A service stopping on a failed login is restarted after the backoff.
+func (c *embeddedClient) run(svr *frpclient.Service, serverAddr string) {
+	err := svr.Run()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil || c.svr != svr {
+		// closed or replaced
+		return
+	}
+	log.Log.Error(err, "embedded frp client failed to log in to frps", "serverAddr", serverAddr, "retryIn", c.backoff)
+	svr.Close()
+	c.svr = nil
+	c.loginErr = err
+	c.restart = time.AfterFunc(c.backoff, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed || c.svr != nil {
+			return
+		}
+		c.restart = nil
+		if err := c.start(); err != nil {
+			log.Log.Error(err, "embedded frp client not restarted", "serverAddr", serverAddr)
+		}
+	})
+	if c.backoff *= 2; c.backoff > embeddedMaxBackoff {
+		c.backoff = embeddedMaxBackoff
+	}
+}
+
+// embeddedLog are the settings the global logger of frp was last initialized with
+var embeddedLog struct {
+	settings [5]any
+	mu       sync.Mutex
+}
+
+// initEmbeddedLog initializes the global logger of frp when its settings change, the running services log through it
+func initEmbeddedLog(common frpconfig.ClientCommonConf) {
+	settings := [5]any{common.LogWay, common.LogFile, common.LogLevel, common.LogMaxDays, common.DisableLogColor}
+	embeddedLog.mu.Lock()
+	defer embeddedLog.mu.Unlock()
+	if embeddedLog.settings == settings {
+		return
+	}
+	embeddedLog.settings = settings
+	frplog.InitLog(common.LogWay, common.LogFile, common.LogLevel, common.LogMaxDays, common.DisableLogColor)
+}
+
+func (c *embeddedClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.restart != nil {
+		c.restart.Stop()
+		c.restart = nil
+	}
+	if c.svr != nil {
+		c.svr.Close()
+		c.svr = nil
+	}
+}
+
+// parseEmbeddedConfig parses the config as frpc parses its config file, the admin api is never served
+func parseEmbeddedConfig(config *Configs) (frpconfig.ClientCommonConf, map[string]frpconfig.ProxyConf, map[string]frpconfig.VisitorConf, error) {
+	data, err := Marshal(config)
+	if err != nil {
+		return frpconfig.ClientCommonConf{}, nil, nil, err
+	}
+	common, err := frpconfig.UnmarshalClientConfFromIni(data)
+	if err != nil {
+		return common, nil, nil, err
+	}
+	common.Complete()
+	if err := common.Validate(); err != nil {
+		return common, nil, nil, err
+	}
+	common.AdminPort = 0
+	pxyCfgs, visitorCfgs, err := frpconfig.LoadAllProxyConfsFromIni(common.User, data, common.Start)
+	if err != nil {
+		return common, nil, nil, err
+	}
+	return common, pxyCfgs, visitorCfgs, nil
+}
@@ -3,7 +3,9 @@ package frp
 import (
 	"context"
 	"fmt"
+	"github.com/grydovee/ingress-frp/pkg/constants"
 	"net"
+	"sync"
 )
 
 const defaultConfig = `
@@ -48,6 +50,7 @@ plugin_key_base64 = xx
 
 type fakeClient struct {
 	cfg *Configs
+	mu  sync.Mutex
 }
 
 func NewFakeClient() Client {
@@ -55,6 +58,8 @@ func NewFakeClient() Client {
 }
 
 func (f *fakeClient) GetConfigs(ctx context.Context) (*Configs, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.cfg == nil {
 		cfg, err := Unmarshal([]byte(defaultConfig))
 		if err != nil {
@@ -62,13 +67,21 @@ func (f *fakeClient) GetConfigs(ctx context.Context) (*Configs, error) {
 		}
 		f.cfg = cfg
 	}
-	bytes := Marshal(f.cfg)
+	bytes, err := Marshal(f.cfg)
+	if err != nil {
+		return nil, err
+	}
 	return Unmarshal(bytes)
 }
 
 func (f *fakeClient) SetConfig(ctx context.Context, config *Configs) error {
+	cfg, err := Marshal(config)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
 	f.cfg = config
-	cfg := Marshal(f.cfg)
+	f.mu.Unlock()
 	fmt.Println(string(cfg))
 	return nil
 }
@@ -77,6 +90,27 @@ func (f *fakeClient) Reload(ctx context.Context) error {
 	return nil
 }
 
+func (f *fakeClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeClient) Status(ctx context.Context) ([]ProxyStatus, error) {
+	cfg, err := f.GetConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var status []ProxyStatus
+	foreach(cfg.Proxy, func(name string, proxy Config) bool {
+		status = append(status, ProxyStatus{
+			Name:   name,
+			Type:   proxy.ToMap()["type"],
+			Status: ProxyPhaseRunning,
+		})
+		return true
+	})
+	return status, nil
+}
+
 func (f *fakeClient) Addr() *net.TCPAddr {
 	return &net.TCPAddr{
 		IP:   net.IPv4(127, 0, 0, 1),
@@ -85,11 +119,15 @@ func (f *fakeClient) Addr() *net.TCPAddr {
 }
 func NewFakeSyncer() Syncer {
 	return &syncer{
-		ctx: context.Background(),
+		ctx:  context.Background(),
+		pool: constants.IngressClassName,
 		clients: []Client{
 			NewFakeClient(),
 		},
-		ch:         make(chan struct{}),
+		ch:         make(chan struct{}, 1),
 		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
 	}
 }
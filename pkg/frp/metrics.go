@@ -0,0 +1,128 @@
+package frp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"time"
+)
+
+const metricsNamespace = "ingress_frp"
+
+const (
+	operationPut    = "put"
+	operationReload = "reload"
+	operationStop   = "stop"
+)
+
+var (
+	syncRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "sync_requests_total",
+		Help:      "Total number of sync requests made by proxy changes and client discovery.",
+	})
+	coalescedUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "coalesced_updates_total",
+		Help:      "Total number of sync requests merged into another apply by debouncing.",
+	})
+	syncAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "sync_attempts_total",
+		Help:      "Total number of config applies attempted per frp client.",
+	}, []string{"client"})
+	syncSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "sync_successes_total",
+		Help:      "Total number of successful config applies per frp client.",
+	}, []string{"client"})
+	syncFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "sync_failures_total",
+		Help:      "Total number of failed config applies per frp client.",
+	}, []string{"client"})
+	lastSuccessfulSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync that left the frp client in the desired state.",
+	}, []string{"client"})
+	managedProxies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "managed_proxies",
+		Help:      "Number of proxies placed on each frp client by proxy type.",
+	}, []string{"client", "type"})
+	discoveredClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "discovered_clients",
+		Help:      "Number of frp clients discovered by the syncer of each pool.",
+	}, []string{"pool"})
+	driftKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "syncer",
+		Name:      "drift_keys_total",
+		Help:      "Total number of proxy keys edited out of band in the frp client config, by change.",
+	}, []string{"client", "change"})
+	clientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the config put and reload requests to the frp client admin api.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"client", "operation"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		syncRequests,
+		coalescedUpdates,
+		syncAttempts,
+		syncSuccesses,
+		syncFailures,
+		lastSuccessfulSync,
+		managedProxies,
+		discoveredClients,
+		driftKeys,
+		clientRequestDuration,
+	)
+}
+
+func observeRequest(cli Client, operation string, start time.Time) {
+	clientRequestDuration.WithLabelValues(cli.Addr().String(), operation).Observe(time.Since(start).Seconds())
+}
+
+// observeDesired sets the managed proxy gauges to the placement computed for the clients
+func (s *syncer) observeDesired(desired []Proxy) {
+	counts := make(map[[2]string]int)
+	for i, cli := range s.clients {
+		addr := cli.Addr().String()
+		for _, cfg := range desired[i] {
+			counts[[2]string{addr, proxyType(cfg)}]++
+		}
+	}
+	for labels := range s.observed {
+		if _, ok := counts[labels]; !ok {
+			managedProxies.DeleteLabelValues(labels[0], labels[1])
+		}
+	}
+	s.observed = make(map[[2]string]bool, len(counts))
+	for labels, n := range counts {
+		managedProxies.WithLabelValues(labels[0], labels[1]).Set(float64(n))
+		s.observed[labels] = true
+	}
+	discoveredClients.WithLabelValues(s.pool).Set(float64(len(s.clients)))
+}
+
+func proxyType(cfg Config) string {
+	if t := cfg.ToMap()["type"]; t != "" {
+		return t
+	}
+	// frp defaults to tcp
+	return "tcp"
+}
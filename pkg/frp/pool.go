@@ -0,0 +1,433 @@
+package frp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultAdminPort = 7400
+
+// PoolConfig configures the pool of frp clients serving an IngressClass
+type PoolConfig struct {
+	IngressClass string `json:"ingressClass"`
+	// Addr is resolved to the addresses of the frp clients, e.g. a headless service
+	Addr     string `json:"addr"`
+	Port     uint16 `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Token authenticates with a bearer token instead of the username and password
+	Token        string `json:"token,omitempty"`
+	ConfigFormat string `json:"configFormat,omitempty"`
+	// UsernameFile, PasswordFile and TokenFile read the credentials from files, e.g. the keys of a mounted Secret,
+	// which are read again when the Secret is rotated. They take precedence over Username, Password and Token.
+	UsernameFile string `json:"usernameFile,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	TokenFile    string `json:"tokenFile,omitempty"`
+	// TLS connects to the admin api with https, plain http if nil
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// Common are keys of the [common] section written to the config of every frp client, e.g. server_addr
+	Common map[string]string `json:"common,omitempty"`
+	// Embedded runs the frp client in the manager process instead of reaching the frp clients of Addr, Common
+	// configures it and the admin api settings are unused
+	Embedded bool `json:"embedded,omitempty"`
+	// Secret writes the configs to a Secret mounted by the frp client pods instead of reaching them through their
+	// admin api, Addr and the admin api settings are unused
+	Secret *SecretDelivery `json:"secret,omitempty"`
+	// Auth overrides the credentials, e.g. the admin credentials managed by the controller
+	Auth Auth `json:"-"`
+}
+
+// poolCommonKey owns the [common] keys of the PoolConfig in the syncer
+const poolCommonKey = "pool"
+
+// auth returns the credentials of the admin api, a token takes precedence over a username and password
+func (pool *PoolConfig) auth() (Auth, error) {
+	switch {
+	case pool.Auth != nil:
+		return pool.Auth, nil
+	case pool.TokenFile != "":
+		return NewFileBearerAuth(pool.TokenFile), nil
+	case pool.Token != "":
+		return NewBearerAuth(pool.Token), nil
+	case pool.UsernameFile != "" || pool.PasswordFile != "":
+		if pool.UsernameFile == "" || pool.PasswordFile == "" {
+			return nil, fmt.Errorf("usernameFile and passwordFile must be set together")
+		}
+		return NewFileBasicAuth(pool.UsernameFile, pool.PasswordFile), nil
+	default:
+		return NewBasicAuth(pool.Username, pool.Password), nil
+	}
+}
+
+// PoolsConfig
+// pools:
+//   - ingressClass: frp
+//     addr: ingress-frp-frpc-service.kube-system.svc.cluster.local
+//     port: 7400
+//     username: admin
+//     password: admin
+//   - ingressClass: frp-partner
+//     addr: ingress-frp-partner-frpc-service.kube-system.svc.cluster.local
+//     tokenFile: /etc/ingress-frp/partner/token
+//     common: {server_addr: partner.example.com}
+//     tls: {caFile: /etc/ingress-frp/partner/ca.crt}
+//   - ingressClass: frp-embedded
+//     embedded: true
+//     common: {server_addr: frps.example.com, server_port: "7000"}
+//   - ingressClass: frp-isolated
+//     secret: {namespace: kube-system, name: frpc-configs, podSelector: app=isolated-frpc}
+type PoolsConfig struct {
+	Pools []PoolConfig `json:"pools"`
+}
+
+// LoadPoolConfigs reads and validates a PoolsConfig file
+func LoadPoolConfigs(path string) ([]PoolConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg PoolsConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(cfg.Pools) == 0 {
+		return nil, fmt.Errorf("no pool defined in %s", path)
+	}
+	classes := make(map[string]bool, len(cfg.Pools))
+	for i := range cfg.Pools {
+		pool := &cfg.Pools[i]
+		if pool.IngressClass == "" {
+			return nil, fmt.Errorf("pools[%d]: ingressClass is required", i)
+		}
+		if classes[pool.IngressClass] {
+			return nil, fmt.Errorf("pools[%d]: duplicated ingressClass %s", i, pool.IngressClass)
+		}
+		classes[pool.IngressClass] = true
+		if pool.Addr == "" && !pool.Embedded && pool.Secret == nil {
+			return nil, fmt.Errorf("pools[%d]: addr is required", i)
+		}
+		if pool.Port == 0 {
+			pool.Port = defaultAdminPort
+		}
+		if err := ValidateCommon(pool.Common); err != nil {
+			return nil, fmt.Errorf("pools[%d]: %w", i, err)
+		}
+	}
+	return cfg.Pools, nil
+}
+
+// LoadCommon reads the [common] section of a frpc config file, the admin api keys are dropped
+func LoadCommon(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := DetectCodec(data).Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	common := cfg.Common.ToMap()
+	for k := range common {
+		if strings.HasPrefix(k, "admin_") {
+			delete(common, k)
+		}
+	}
+	if err := ValidateCommon(common); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return common, nil
+}
+
+// NewPoolSyncers creates a Syncer with the options for every pool, keyed by IngressClass. The client writes the
+// Secrets of the pools delivering their configs through a Secret.
+func NewPoolSyncers(pools []PoolConfig, c client.Client, opts SyncOptions) (map[string]Syncer, error) {
+	syncers := make(map[string]Syncer, len(pools))
+	for _, pool := range pools {
+		s, err := newPoolSyncer(pool, c, opts)
+		if err != nil {
+			return nil, err
+		}
+		syncers[pool.IngressClass] = s
+	}
+	return syncers, nil
+}
+
+func newPoolSyncer(pool PoolConfig, c client.Client, opts SyncOptions) (Syncer, error) {
+	if err := ValidateCommon(pool.Common); err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pool.IngressClass, err)
+	}
+	if pool.Embedded {
+		s := NewEmbeddedSyncer(pool.IngressClass)
+		s.(*embeddedSyncer).setOptions(opts)
+		s.SetCommon(poolCommonKey, pool.Common)
+		return s, nil
+	}
+	codec, err := NewCodec(pool.ConfigFormat)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pool.IngressClass, err)
+	}
+	if pool.Secret != nil {
+		if c == nil {
+			return nil, fmt.Errorf("pool %s: secret delivery is not available", pool.IngressClass)
+		}
+		selector, err := pool.Secret.selector()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", pool.IngressClass, err)
+		}
+		secret := types.NamespacedName{Namespace: pool.Secret.Namespace, Name: pool.Secret.Name}
+		s := NewSecretSyncer(pool.IngressClass, c, secret, pool.Secret.MountPath, selector, codec)
+		s.(*secretSyncer).setOptions(opts)
+		s.SetCommon(poolCommonKey, pool.Common)
+		return s, nil
+	}
+	auth, err := pool.auth()
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %w", pool.IngressClass, err)
+	}
+	var tlsConfig *tls.Config
+	if pool.TLS != nil {
+		if tlsConfig, err = pool.TLS.Build(pool.Addr); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", pool.IngressClass, err)
+		}
+	}
+	s := NewSyncer(pool.IngressClass, pool.Addr, pool.Port, auth, tlsConfig, codec)
+	s.(*syncer).setOptions(opts)
+	if len(pool.Common) > 0 {
+		s.SetCommon(poolCommonKey, pool.Common)
+	}
+	return s, nil
+}
+
+// ValidateCommon rejects the [common] keys which can not be written to the config of a frp client, and the admin api
+// settings, which the controller needs to reach the clients
+func ValidateCommon(common map[string]string) error {
+	for k := range common {
+		if strings.HasPrefix(k, "admin_") {
+			return fmt.Errorf("common key %s can not be set, the admin api is configured by the pool", k)
+		}
+	}
+	return validateSection("common", common)
+}
+
+// Pools holds the syncers of the frp client pools keyed by IngressClass.
+// Besides the static pools it is created with, pools can be applied and removed while it is running,
+// removing an applied pool restores the static pool of the IngressClass. The syncer replacing another one starts with
+// its proxies.
+type Pools struct {
+	// SyncOptions are the options of the syncers of the applied pools
+	SyncOptions SyncOptions
+
+	ctx     context.Context
+	static  map[string]Syncer
+	syncers map[string]Syncer
+	configs map[string]PoolConfig
+	cancels map[string]context.CancelFunc
+	mu      sync.RWMutex
+}
+
+func NewPools(syncers map[string]Syncer) *Pools {
+	p := &Pools{
+		SyncOptions: DefaultSyncOptions(),
+		static:      syncers,
+		syncers:     make(map[string]Syncer, len(syncers)),
+		configs:     make(map[string]PoolConfig),
+		cancels:     make(map[string]context.CancelFunc),
+	}
+	for className, s := range syncers {
+		p.syncers[className] = s
+	}
+	return p
+}
+
+// Start runs the syncers until the context is done
+func (p *Pools) Start(ctx context.Context) error {
+	p.mu.Lock()
+	p.ctx = ctx
+	for className, s := range p.syncers {
+		p.start(className, s)
+	}
+	p.mu.Unlock()
+
+	<-ctx.Done()
+	return nil
+}
+
+func (p *Pools) start(className string, s Syncer) {
+	if p.ctx == nil {
+		// started by Start
+		return
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.cancels[className] = cancel
+	go func() {
+		if err := s.Start(ctx); err != nil {
+			log.FromContext(ctx).Error(err, "frp syncer stopped", "ingressClass", className)
+		}
+	}()
+}
+
+func (p *Pools) stop(className string) {
+	if cancel, ok := p.cancels[className]; ok {
+		cancel()
+		delete(p.cancels, className)
+	}
+}
+
+// Get returns the syncer of the IngressClass
+func (p *Pools) Get(className string) (Syncer, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s, ok := p.syncers[className]
+	return s, ok
+}
+
+// Syncers returns a copy of the syncers keyed by IngressClass
+func (p *Pools) Syncers() map[string]Syncer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	syncers := make(map[string]Syncer, len(p.syncers))
+	for className, s := range p.syncers {
+		syncers[className] = s
+	}
+	return syncers
+}
+
+// ClassNames returns the sorted IngressClasses served by the pools
+func (p *Pools) ClassNames() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, 0, len(p.syncers))
+	for name := range p.syncers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply creates the pool of the config, replacing the syncer of its IngressClass.
+// It reports whether the pool changed, an unchanged config keeps the running syncer and a change of the [common] keys
+// only is pushed by it. The applied pools reach their frp clients through the admin api, the embedded and Secret
+// deliveries are refused.
+func (p *Pools) Apply(pool PoolConfig) (bool, error) {
+	if pool.Embedded || pool.Secret != nil {
+		return false, fmt.Errorf("pool %s: the pools applied at runtime reach their frp clients through the admin api, "+
+			"embedded and secret delivery are only available to the pools the manager starts with", pool.IngressClass)
+	}
+	if pool.Port == 0 {
+		pool.Port = defaultAdminPort
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.configs[pool.IngressClass]; ok {
+		if reflect.DeepEqual(old, pool) {
+			return false, nil
+		}
+		old.Common = pool.Common
+		if reflect.DeepEqual(old, pool) {
+			if err := ValidateCommon(pool.Common); err != nil {
+				return false, fmt.Errorf("pool %s: %w", pool.IngressClass, err)
+			}
+			p.syncers[pool.IngressClass].SetCommon(poolCommonKey, pool.Common)
+			p.configs[pool.IngressClass] = pool
+			return true, nil
+		}
+	}
+	s, err := newPoolSyncer(pool, nil, p.SyncOptions)
+	if err != nil {
+		return false, err
+	}
+	p.stop(pool.IngressClass)
+	handOver(p.syncers[pool.IngressClass], s)
+	p.syncers[pool.IngressClass] = s
+	p.configs[pool.IngressClass] = pool
+	p.start(pool.IngressClass, s)
+	return true, nil
+}
+
+// Remove removes the pool applied for the IngressClass and reports whether there was one. Without a static pool to
+// hand its proxies over to, they are removed from the frp clients before the syncer stops.
+func (p *Pools) Remove(className string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.configs[className]; !ok {
+		return false
+	}
+	old := p.syncers[className]
+	delete(p.configs, className)
+	delete(p.syncers, className)
+	if s, ok := p.static[className]; ok {
+		p.stop(className)
+		handOver(old, s)
+		p.syncers[className] = s
+		p.start(className, s)
+		return true
+	}
+
+	ctx, cancel := p.ctx, p.cancels[className]
+	delete(p.cancels, className)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go func() {
+		drain(ctx, old)
+		if cancel != nil {
+			cancel()
+		}
+	}()
+	return true
+}
+
+// Groups returns the load balancing groups of the proxies set on the syncers
+func (p *Pools) Groups() map[string]bool {
+	groups := make(map[string]bool)
+	for _, s := range p.Syncers() {
+		b, ok := s.(interface{ base() *syncer })
+		if !ok {
+			continue
+		}
+		configsMap, _ := b.base().desired()
+		for _, configs := range configsMap {
+			for _, cfg := range configs {
+				if group, _ := groupOf(cfg); group != "" {
+					groups[group] = true
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// drain deletes the proxies of a syncer no other syncer takes over and syncs its clients a last time
+func drain(ctx context.Context, s Syncer) {
+	b, ok := s.(interface{ base() *syncer })
+	if !ok {
+		return
+	}
+	configsMap, _ := b.base().desired()
+	for key := range configsMap {
+		s.DeleteProxies(key)
+	}
+	b.base().sync(ctx)
+}
+
+// handOver sets the proxies of the syncer being replaced on the syncer replacing it. The owners set their proxies
+// again once requeued, but the new syncer would push a partial config to its clients if it synced before.
+func handOver(from, to Syncer) {
+	src, ok := from.(interface{ base() *syncer })
+	if !ok {
+		return
+	}
+	if dst, ok := to.(interface{ base() *syncer }); ok {
+		dst.base().takeOver(src.base())
+	}
+}
@@ -0,0 +1,237 @@
+package frp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// renderHeader starts the config of a client in the output of Renderer.Write
+const renderHeader = "### "
+
+// Renderer is a Syncer applying the configs of a pool to in-memory clients, it renders the configs which would be
+// pushed to the frp clients of the pool without reaching them
+type Renderer struct {
+	*syncer
+	codec Codec
+}
+
+// NewRenderer creates a Renderer of the pool with the number of clients, whose live [common] section is common.
+// A nil codec renders ini.
+func NewRenderer(pool string, clients int, common map[string]string, codec Codec) *Renderer {
+	if codec == nil {
+		codec = IniCodec
+	}
+	s := newSyncer(pool)
+	s.format = codec.Format()
+	for i := 0; i < clients; i++ {
+		s.clients = append(s.clients, &memoryClient{
+			addr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, byte(i+1))},
+			cfg:   &Configs{Common: MapConfig(MapConfig(common).ToMap()), Proxy: Proxy{}},
+			codec: codec,
+		})
+	}
+	return &Renderer{syncer: s, codec: codec}
+}
+
+// SetPoolCommon sets the [common] keys of the pool, as Pools.Apply does for the PoolConfig
+func (r *Renderer) SetPoolCommon(common map[string]string) {
+	r.SetCommon(poolCommonKey, common)
+}
+
+// RenderFailure is a failure the syncer recorded for the proxies of an owner on a client, the proxies are left out of
+// the rendered config of the client
+type RenderFailure struct {
+	// Client is the rendered client, e.g. frp.0
+	Client string
+	// Key is the owner of the proxies, e.g. namespace/name of an ingress
+	Key    string
+	Reason string
+}
+
+func (f RenderFailure) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Client, f.Key, f.Reason)
+}
+
+// Render applies the proxies to the clients and returns their configs with the sensitive values masked, keyed by
+// the prefix of the proxy names pushed to the client, e.g. frp.0, and the failures of the proxies left out of them,
+// sorted by client and owner
+func (r *Renderer) Render(ctx context.Context) (map[string][]byte, []RenderFailure, error) {
+	r.sync(ctx)
+
+	r.mu.Lock()
+	clients := make([]Client, len(r.clients))
+	copy(clients, r.clients)
+	prefixes := r.proxyPrefixes(clients)
+	names := make(map[string]string, len(clients))
+	for i, cli := range clients {
+		names[cli.Addr().String()] = strings.TrimSuffix(prefixes[i], "/")
+	}
+	var failures []RenderFailure
+	for key, reasons := range r.failures {
+		for addr, reason := range reasons {
+			failures = append(failures, RenderFailure{Client: names[addr], Key: key, Reason: reason})
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Client != failures[j].Client {
+			return failures[i].Client < failures[j].Client
+		}
+		if failures[i].Key != failures[j].Key {
+			return failures[i].Key < failures[j].Key
+		}
+		return failures[i].Reason < failures[j].Reason
+	})
+
+	res := make(map[string][]byte, len(clients))
+	for i, cli := range clients {
+		cfg, err := cli.GetConfigs(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		masked := &Configs{Common: MapConfig(RedactCommon(cfg.Common)), Proxy: make(Proxy, len(cfg.Proxy))}
+		for name, proxy := range cfg.Proxy {
+			masked.Proxy[name] = MapConfig(RedactMap(proxy.ToMap()))
+		}
+		data, err := r.codec.Marshal(masked)
+		if err != nil {
+			return nil, nil, err
+		}
+		res[strings.TrimSuffix(prefixes[i], "/")] = data
+	}
+	return res, failures, nil
+}
+
+// WriteRendered writes the rendered configs sorted by client, each one after a header line naming the client
+func WriteRendered(w io.Writer, rendered map[string][]byte) error {
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s%s\n%s\n", renderHeader, name, bytes.TrimRight(rendered[name], "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRendered parses the output of WriteRendered
+func ReadRendered(r io.Reader) (map[string][]byte, error) {
+	res := make(map[string][]byte)
+	var name string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, renderHeader) {
+			name = strings.TrimSpace(strings.TrimPrefix(line, renderHeader))
+			res[name] = nil
+			continue
+		}
+		if name == "" {
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("config without a %q header: %s", renderHeader, line)
+			}
+			continue
+		}
+		res[name] = append(append(res[name], line...), '\n')
+	}
+	return res, scanner.Err()
+}
+
+// DiffRendered compares the rendered configs of every client with the saved ones, clients only present on one side
+// are compared with an empty config
+func DiffRendered(saved, rendered map[string][]byte, codec Codec) (map[string]Diff, error) {
+	if codec == nil {
+		codec = IniCodec
+	}
+	parse := func(data []byte) (Proxy, error) {
+		if len(bytes.TrimSpace(data)) == 0 {
+			return Proxy{}, nil
+		}
+		cfg, err := codec.Unmarshal(data)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.Proxy, nil
+	}
+	res := make(map[string]Diff)
+	names := make(map[string]bool, len(saved)+len(rendered))
+	for name := range saved {
+		names[name] = true
+	}
+	for name := range rendered {
+		names[name] = true
+	}
+	for name := range names {
+		live, err := parse(saved[name])
+		if err != nil {
+			return nil, fmt.Errorf("saved config of %s: %w", name, err)
+		}
+		desired, err := parse(rendered[name])
+		if err != nil {
+			return nil, fmt.Errorf("rendered config of %s: %w", name, err)
+		}
+		if d := DiffProxy(desired, live); !d.Empty() {
+			res[name] = d
+		}
+	}
+	return res, nil
+}
+
+// memoryClient keeps the config in memory, it is the client of a Renderer
+type memoryClient struct {
+	addr  *net.TCPAddr
+	cfg   *Configs
+	codec Codec
+}
+
+var _ Client = (*memoryClient)(nil)
+
+func (c *memoryClient) Format() string {
+	return c.codec.Format()
+}
+
+func (c *memoryClient) Addr() *net.TCPAddr {
+	return c.addr
+}
+
+func (c *memoryClient) GetConfigs(ctx context.Context) (*Configs, error) {
+	data, err := Marshal(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(data)
+}
+
+func (c *memoryClient) SetConfig(ctx context.Context, config *Configs) error {
+	if _, err := Marshal(config); err != nil {
+		return err
+	}
+	c.cfg = config
+	return nil
+}
+
+func (c *memoryClient) Reload(ctx context.Context) error {
+	return nil
+}
+
+func (c *memoryClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (c *memoryClient) Status(ctx context.Context) ([]ProxyStatus, error) {
+	status := make([]ProxyStatus, 0, len(c.cfg.Proxy))
+	for name, proxy := range c.cfg.Proxy {
+		status = append(status, ProxyStatus{Name: name, Type: proxy.ToMap()["type"], Status: ProxyPhaseRunning})
+	}
+	return status, nil
+}
@@ -0,0 +1,421 @@
+package frp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/grydovee/ingress-frp/pkg/constants"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"net"
+	"path"
+	"regexp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SecretDelivery delivers the configs of a pool through a Secret instead of the admin api of the frp clients. The
+// configs hold the token of frps and the credentials of the proxies, so they are not written to a ConfigMap.
+type SecretDelivery struct {
+	// Namespace and Name of the Secret, which is created in the namespace of the frp client pods
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// PodSelector selects the frp client pods, e.g. app=ingress-frpc
+	PodSelector string `json:"podSelector"`
+	// MountPath is where the pods mount the Secret, DefaultSecretMountPath if empty. The certificates frp v1 only
+	// reads from files are written to the Secret and referenced under it.
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+// DefaultSecretMountPath is where the frp client pods of the helm chart mount the configs Secret
+const DefaultSecretMountPath = "/etc/frp/configs"
+
+// certFileKey matches the keys of the certificate files of the pods, <pod name>.<proxy hash>.<crt|key>
+var certFileKey = regexp.MustCompile(`^(.+)\.[0-9a-f]{16}\.(crt|key)$`)
+
+// NewSecretSyncer creates a Syncer writing the config of every frp client pod matching the selector to the key
+// <pod name>.<format> of the Secret, which the pod mounts at mountPath. The pods restart frpc when their config
+// changes, since they expose no admin api to reload it. The Secret is only written while it is labeled with the pool.
+func NewSecretSyncer(pool string, c client.Client, secret types.NamespacedName, mountPath string, selector labels.Selector, codec Codec) Syncer {
+	if codec == nil {
+		codec = IniCodec
+	}
+	if mountPath == "" {
+		mountPath = DefaultSecretMountPath
+	}
+	s := newSyncer(pool)
+	s.format = codec.Format()
+	return &secretSyncer{
+		syncer:    s,
+		client:    c,
+		secret:    secret,
+		mountPath: mountPath,
+		selector:  selector,
+		codec:     codec,
+	}
+}
+
+type secretSyncer struct {
+	*syncer
+	client    client.Client
+	secret    types.NamespacedName
+	mountPath string
+	selector  labels.Selector
+	codec     Codec
+}
+
+// Start discovers the frp client pods every FrpClientSyncInterval and runs the syncer
+func (s *secretSyncer) Start(ctx context.Context) error {
+	go func() {
+		ticker := time.NewTicker(constants.FrpClientSyncInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.discover(ctx); err != nil {
+				log.FromContext(ctx).Error(err, "discover frpc pods error", "pool", s.pool)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return s.syncer.Start(ctx)
+}
+
+// discover replaces the clients with the running frp client pods, sorted by name, and removes the configs of the
+// pods which are gone from the Secret
+func (s *secretSyncer) discover(ctx context.Context) error {
+	var pods corev1.PodList
+	if err := s.client.List(ctx, &pods, client.InNamespace(s.secret.Namespace), client.MatchingLabelsSelector{Selector: s.selector}); err != nil {
+		return err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
+
+	s.mu.Lock()
+	newClients := make([]Client, 0, len(pods.Items))
+	running := make(map[string]bool, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		ip := net.ParseIP(pod.Status.PodIP)
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning || ip == nil {
+			continue
+		}
+		var cli Client
+		for _, c := range s.clients {
+			if sc := c.(*secretClient); sc.pod.Name == pod.Name && sc.addr.IP.Equal(ip) {
+				cli = c
+				break
+			}
+		}
+		if cli == nil {
+			cli = &secretClient{
+				client:    s.client,
+				pool:      s.pool,
+				secret:    s.secret,
+				mountPath: s.mountPath,
+				pod:       client.ObjectKeyFromObject(pod),
+				addr:      &net.TCPAddr{IP: ip},
+				codec:     s.codec,
+			}
+		}
+		newClients = append(newClients, cli)
+		running[pod.Name] = true
+	}
+	changed := len(newClients) != len(s.clients)
+	for i := 0; !changed && i < len(newClients); i++ {
+		changed = newClients[i] != s.clients[i]
+	}
+	if changed {
+		s.setClients(newClients)
+	}
+	s.mu.Unlock()
+
+	return s.prune(ctx, running)
+}
+
+// prune removes the configs and certificate files of the pods which are gone
+func (s *secretSyncer) prune(ctx context.Context, running map[string]bool) error {
+	suffix := "." + s.codec.Format()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var secret corev1.Secret
+		if err := s.client.Get(ctx, s.secret, &secret); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		if err := checkSecretOwner(&secret, s.pool); err != nil {
+			return err
+		}
+		var stale bool
+		for key := range secret.Data {
+			pod := strings.TrimSuffix(key, suffix)
+			if m := certFileKey.FindStringSubmatch(key); m != nil {
+				pod = m[1]
+			} else if pod == key {
+				continue
+			}
+			if !running[pod] {
+				delete(secret.Data, key)
+				stale = true
+			}
+		}
+		if !stale {
+			return nil
+		}
+		return s.client.Update(ctx, &secret)
+	})
+}
+
+// checkSecretOwner refuses a Secret which was not created for the configs of the pool, e.g. a Secret of the same name
+// holding something else
+func checkSecretOwner(secret *corev1.Secret, pool string) error {
+	if owner := secret.Labels[constants.LabelConfigsPool]; owner != pool {
+		return fmt.Errorf("secret %s/%s is not labeled %s=%s, refusing to write the configs of the pool to it",
+			secret.Namespace, secret.Name, constants.LabelConfigsPool, pool)
+	}
+	return nil
+}
+
+// secretClient writes the config of a frp client pod to its key of the Secret
+type secretClient struct {
+	client    client.Client
+	pool      string
+	secret    types.NamespacedName
+	mountPath string
+	pod       types.NamespacedName
+	addr      *net.TCPAddr
+	codec     Codec
+}
+
+var _ Client = (*secretClient)(nil)
+
+// writesCertFiles is true for the frp v1 formats, the INI format of the fork holds the certificates inline
+func (c *secretClient) writesCertFiles() bool {
+	return c.codec.Format() != FormatIni
+}
+
+func (c *secretClient) key() string {
+	return c.pod.Name + "." + c.codec.Format()
+}
+
+func (c *secretClient) Format() string {
+	return c.codec.Format()
+}
+
+// Addr is the address of the pod, the frp client has no admin api
+func (c *secretClient) Addr() *net.TCPAddr {
+	return c.addr
+}
+
+// GetConfigs returns the config written for the pod, an empty config before the first write
+func (c *secretClient) GetConfigs(ctx context.Context) (*Configs, error) {
+	var secret corev1.Secret
+	if err := c.client.Get(ctx, c.secret, &secret); err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	data, ok := secret.Data[c.key()]
+	if !ok {
+		return &Configs{Common: MapConfig{}, Proxy: Proxy{}}, nil
+	}
+	configs, err := c.codec.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	c.readCertFiles(configs, secret.Data)
+	return configs, nil
+}
+
+func (c *secretClient) SetConfig(ctx context.Context, config *Configs) error {
+	config, files, err := c.writeCertFiles(config)
+	if err != nil {
+		return err
+	}
+	data, err := c.codec.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var secret corev1.Secret
+		if err := c.client.Get(ctx, c.secret, &secret); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			secret = corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: c.secret.Namespace,
+					Name:      c.secret.Name,
+					Labels:    map[string]string{constants.LabelConfigsPool: c.pool},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{c.key(): data},
+			}
+			for key, file := range files {
+				secret.Data[key] = file
+			}
+			err = c.client.Create(ctx, &secret)
+			if apierrors.IsAlreadyExists(err) {
+				// created concurrently, read it again
+				return apierrors.NewConflict(corev1.Resource("secrets"), c.secret.Name, err)
+			}
+			return err
+		}
+		if err := checkSecretOwner(&secret, c.pool); err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		for key := range secret.Data {
+			if m := certFileKey.FindStringSubmatch(key); m != nil && m[1] == c.pod.Name && files[key] == nil {
+				delete(secret.Data, key)
+			}
+		}
+		for key, file := range files {
+			secret.Data[key] = file
+		}
+		secret.Data[c.key()] = data
+		if size := secretSize(&secret); size > corev1.MaxSecretSize {
+			return fmt.Errorf("the configs of secret %s/%s would take %d bytes, more than the %d bytes a Secret holds",
+				secret.Namespace, secret.Name, size, corev1.MaxSecretSize)
+		}
+		return c.client.Update(ctx, &secret)
+	})
+}
+
+// writeCertFiles moves the inline certificates of the proxies to files of the Secret, keyed by the pod and a hash of the
+// proxy name, which frp v1 reads from the mount path. It returns the config referencing the files.
+func (c *secretClient) writeCertFiles(config *Configs) (*Configs, map[string][]byte, error) {
+	if config == nil || !c.writesCertFiles() {
+		return config, nil, nil
+	}
+	files := make(map[string][]byte)
+	out := &Configs{Common: config.Common, Proxy: make(Proxy, len(config.Proxy))}
+	for name, cfg := range config.Proxy {
+		out.Proxy[name] = cfg
+		m := cfg.ToMap()
+		sum := sha256.Sum256([]byte(name))
+		var moved bool
+		for _, k := range inlineCertKeys {
+			v, ok := m[k.inline]
+			if !ok {
+				continue
+			}
+			file, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("proxy %s: invalid %s: %w", name, k.inline, err)
+			}
+			key := fmt.Sprintf("%s.%x.%s", c.pod.Name, sum[:8], k.ext)
+			files[key] = file
+			delete(m, k.inline)
+			m[k.path] = path.Join(c.mountPath, key)
+			moved = true
+		}
+		if moved {
+			out.Proxy[name] = MapConfig(m)
+		}
+	}
+	return out, files, nil
+}
+
+// readCertFiles puts the certificate files written by writeCertFiles back inline, as the proxies were desired
+func (c *secretClient) readCertFiles(config *Configs, data map[string][]byte) {
+	if !c.writesCertFiles() {
+		return
+	}
+	for name, cfg := range config.Proxy {
+		m := cfg.ToMap()
+		var moved bool
+		for _, k := range inlineCertKeys {
+			file, ok := data[strings.TrimPrefix(m[k.path], c.mountPath+"/")]
+			if !ok || path.Dir(m[k.path]) != c.mountPath {
+				continue
+			}
+			delete(m, k.path)
+			m[k.inline] = base64.StdEncoding.EncodeToString(file)
+			moved = true
+		}
+		if moved {
+			config.Proxy[name] = NewConfig(m)
+		}
+	}
+}
+
+func secretSize(secret *corev1.Secret) int {
+	var size int
+	for k, v := range secret.Data {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// Reload does nothing, the pod restarts frpc when the kubelet updates its config
+func (c *secretClient) Reload(ctx context.Context) error {
+	return nil
+}
+
+// Stop does nothing, a frpc restarted by its pod already reads the [common] section
+func (c *secretClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+// Status reports the proxies written for the pod. Without the admin api the status of the proxies is unknown: they
+// are unverified while the pod is ready, which does not tell whether frpc started them, and waiting to start before.
+func (c *secretClient) Status(ctx context.Context) ([]ProxyStatus, error) {
+	var pod corev1.Pod
+	if err := c.client.Get(ctx, c.pod, &pod); err != nil {
+		return nil, err
+	}
+	cfg, err := c.GetConfigs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	phase := ProxyPhaseWaitStart
+	if podReady(&pod) {
+		phase = ProxyPhaseUnverified
+	}
+	status := make([]ProxyStatus, 0, len(cfg.Proxy))
+	for name, proxy := range cfg.Proxy {
+		status = append(status, ProxyStatus{
+			Name:   name,
+			Type:   proxy.ToMap()["type"],
+			Status: phase,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status, nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// selector parses the pod selector of the delivery
+func (d *SecretDelivery) selector() (labels.Selector, error) {
+	if d.Namespace == "" || d.Name == "" {
+		return nil, fmt.Errorf("secret namespace and name are required")
+	}
+	selector, err := labels.Parse(d.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret podSelector: %w", err)
+	}
+	if selector.Empty() {
+		return nil, fmt.Errorf("secret podSelector is required")
+	}
+	return selector, nil
+}
@@ -0,0 +1,64 @@
+package frp
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// proxy phases reported by frpc
+const (
+	ProxyPhaseNew         = "new"
+	ProxyPhaseWaitStart   = "wait start"
+	ProxyPhaseStartError  = "start error"
+	ProxyPhaseRunning     = "running"
+	ProxyPhaseCheckFailed = "check failed"
+	ProxyPhaseClosed      = "closed"
+
+	// ProxyPhaseMissing is reported by the Syncer for a proxy that is not (yet) in the config of its client
+	ProxyPhaseMissing = "missing"
+	// ProxyPhaseUnknown is reported by the Syncer when the status of the client can not be read
+	ProxyPhaseUnknown = "unknown"
+	// ProxyPhaseApplyFailed is reported by the Syncer when the config of the proxy could not be applied to its client
+	// and the previous config was restored
+	ProxyPhaseApplyFailed = "apply failed"
+	// ProxyPhaseUnverified is reported for a proxy delivered to a ready frp client which serves no status of its
+	// proxies, it may still fail to start
+	ProxyPhaseUnverified = "unverified"
+)
+
+// ProxyStatus
+// {"name":"web","type":"http","status":"start error","err":"custom domain [web.example.com] is already in use",
+// "local_addr":"127.0.0.1:80","plugin":"","remote_addr":""}
+type ProxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Err        string `json:"err"`
+	LocalAddr  string `json:"local_addr"`
+	Plugin     string `json:"plugin"`
+	RemoteAddr string `json:"remote_addr"`
+
+	// Client is the admin address of the frpc reporting the status, it is filled by the Syncer
+	Client string `json:"-"`
+}
+
+func (s *ProxyStatus) Running() bool {
+	return s.Status == ProxyPhaseRunning
+}
+
+// UnmarshalStatus parses the response of /api/status, which groups the proxies by type.
+func UnmarshalStatus(data []byte) ([]ProxyStatus, error) {
+	var res map[string][]ProxyStatus
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	var status []ProxyStatus
+	foreach(res, func(_ string, v []ProxyStatus) bool {
+		status = append(status, v...)
+		return true
+	})
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status, nil
+}
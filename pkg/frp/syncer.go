@@ -2,12 +2,18 @@ package frp
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/grydovee/ingress-frp/pkg/constants"
 	"github.com/grydovee/ingress-frp/pkg/utils"
 	"net"
+	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,28 +21,70 @@ type Syncer interface {
 	Start(ctx context.Context) error
 	SetProxies(key string, configs map[string]Config)
 	DeleteProxies(key string)
+	// SetCommon sets the [common] keys owned by the key, they are merged into the config of every client.
+	// A nil common releases the keys, which are left as they are on the clients.
+	SetCommon(key string, common map[string]string)
 	Sync()
+	// Status returns the live status of the proxies of every key, as reported by the clients they are placed on
+	Status(ctx context.Context) map[string][]ProxyStatus
+	// Dump compares the desired proxies with the live config of every client
+	Dump(ctx context.Context) *Dump
 }
 
 type syncer struct {
 	ctx context.Context
+	// pool is the name of the pool of clients, the IngressClass it serves
+	pool string
+	// format is the config format written to the clients, "" when each client detects the format of its frpc
+	format string
 
 	domainWatcher *utils.DomainWatcher
 	clients       []Client
 
 	configsMap map[string]map[string]Config
-	ch         chan struct{}
-	mu         sync.Mutex
+	// commons are the [common] keys set by SetCommon, by owner key
+	commons map[string]map[string]string
+	// restarts are the clients whose [common] section changed since they started
+	restarts map[Client]bool
+	// failures records the reason of the last failed apply, by key and client address
+	failures map[string]map[string]string
+	// applied are the proxies last applied to each client, by client address
+	applied map[string]Proxy
+	// drifts are the drifts reported for each client, by client address
+	drifts map[string][]DriftEntry
+	// observed are the label values of the managed proxies gauge set by the last sync
+	observed map[[2]string]bool
+	// slots number the clients, the proxy names pushed to a client are prefixed with its slot
+	slots map[Client]int
+	// retired are the slots of the clients gone from discovery, by slot. They are not reused while the client may
+	// still be connected to frps with the proxy names of the slot.
+	retired map[int]*retiredSlot
+	// quarantine are the proxies held back from each client after they failed an apply, by client address and name
+	quarantine map[string]map[string]quarantined
+	// debounce is the quiet period after a sync request before the sync, maxWait bounds the delay of a burst of
+	// requests. A zero debounce syncs on every request.
+	debounce time.Duration
+	maxWait  time.Duration
+	// driftMode is constants.DriftModeReport to leave the drifted proxies in place, they are corrected otherwise
+	driftMode string
+	// slotReuseDelay is how long a retired slot is kept after its client was last seen holding it
+	slotReuseDelay time.Duration
+	// requests counts the sync requests since the last sync
+	requests int64
+	ch       chan struct{}
+	mu       sync.Mutex
+	// syncMu serializes the syncs
+	syncMu sync.Mutex
 }
 
 var _ Syncer = (*syncer)(nil)
 
-func NewSyncer(addr string, port uint16, uname string, passwd string) Syncer {
-	s := &syncer{
-		domainWatcher: utils.NewDomainWatcher(addr),
-		ch:            make(chan struct{}),
-		configsMap:    make(map[string]map[string]Config),
+func NewSyncer(pool string, addr string, port uint16, auth Auth, tlsConfig *tls.Config, codec Codec) Syncer {
+	s := newSyncer(pool)
+	if codec != nil {
+		s.format = codec.Format()
 	}
+	s.domainWatcher = utils.NewDomainWatcher(addr)
 	s.domainWatcher.OnClientChange = func(ips []net.IP) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
@@ -53,30 +101,144 @@ func NewSyncer(addr string, port uint16, uname string, passwd string) Syncer {
 			if foundCli != nil {
 				newClients = append(newClients, foundCli)
 			} else {
-				newClients = append(newClients, NewClient(ip, port, uname, passwd))
+				newClients = append(newClients, NewClient(ip, port, auth, tlsConfig, codec))
 			}
 		}
-		s.clients = newClients
-		s.Sync()
+		s.setClients(newClients)
 	}
 	return s
 }
 
+// Format is the config format written to the clients, "" when each client detects the format of its frpc
+func (s *syncer) Format() string {
+	return s.format
+}
+
+// SyncerFormat returns the config format the syncer writes, "" when it is not known before the clients are reached
+func SyncerFormat(s Syncer) string {
+	if f, ok := s.(interface{ Format() string }); ok {
+		return f.Format()
+	}
+	return ""
+}
+
+// SyncOptions tune how the syncers of the pools apply the configs to their clients
+type SyncOptions struct {
+	// Debounce is the quiet period after a change before the config is applied, 0 applies every change immediately
+	Debounce time.Duration
+	// MaxWait bounds how long a burst of changes can delay the apply
+	MaxWait time.Duration
+	// DriftMode is constants.DriftModeCorrect or constants.DriftModeReport
+	DriftMode string
+	// SlotReuseDelay is how long the slot of a frpc gone from discovery is kept from the new frpc after it was last
+	// seen holding it
+	SlotReuseDelay time.Duration
+}
+
+// DefaultSyncOptions returns the options the syncers are created with
+func DefaultSyncOptions() SyncOptions {
+	return SyncOptions{
+		Debounce:       constants.DefaultFrpSyncDebounce,
+		MaxWait:        constants.DefaultFrpSyncMaxWait,
+		DriftMode:      constants.DefaultFrpDriftMode,
+		SlotReuseDelay: constants.DefaultFrpSlotReuseDelay,
+	}
+}
+
+// newSyncer creates a syncer of the pool without clients, with the DefaultSyncOptions
+func newSyncer(pool string) *syncer {
+	s := &syncer{
+		pool:       pool,
+		ch:         make(chan struct{}, 1),
+		configsMap: make(map[string]map[string]Config),
+		failures:   make(map[string]map[string]string),
+		applied:    make(map[string]Proxy),
+		drifts:     make(map[string][]DriftEntry),
+	}
+	s.setOptions(DefaultSyncOptions())
+	return s
+}
+
+// setOptions sets the options of the syncer before it starts
+func (s *syncer) setOptions(opts SyncOptions) {
+	s.debounce = opts.Debounce
+	s.maxWait = opts.MaxWait
+	s.driftMode = opts.DriftMode
+	s.slotReuseDelay = opts.SlotReuseDelay
+}
+
+// setClients replaces the clients and forgets the removed ones, s.mu must be held
+func (s *syncer) setClients(newClients []Client) {
+	for _, cli := range s.clients {
+		if !containsClient(newClients, cli) {
+			if slot, ok := s.slots[cli]; ok {
+				if s.retired == nil {
+					s.retired = make(map[int]*retiredSlot)
+				}
+				s.retired[slot] = &retiredSlot{cli: cli, seen: time.Now()}
+			}
+			lastSuccessfulSync.DeleteLabelValues(cli.Addr().String())
+			delete(s.applied, cli.Addr().String())
+			delete(s.drifts, cli.Addr().String())
+			delete(s.slots, cli)
+			delete(s.restarts, cli)
+			delete(s.quarantine, cli.Addr().String())
+		}
+	}
+	s.clients = newClients
+	discoveredClients.WithLabelValues(s.pool).Set(float64(len(s.clients)))
+	s.requestSync()
+}
+
 func (s *syncer) Start(ctx context.Context) error {
 	if s.domainWatcher != nil {
 		go s.domainWatcher.Start(ctx)
 	}
+	s.mu.Lock()
 	s.ctx = ctx
+	s.mu.Unlock()
 	ticker := time.NewTicker(constants.FrpClientSyncInterval)
 	defer ticker.Stop()
+
+	// sync requests are debounced: a burst of requests is applied once, debounce after the last request but no later
+	// than maxWait after the first one
+	var debounce *time.Timer
+	var debounceC <-chan time.Time
+	var deadline time.Time
 	for {
 		select {
 		case <-ctx.Done():
-			s.mu.Lock()
-			close(s.ch)
-			s.mu.Unlock()
+			if debounce != nil {
+				debounce.Stop()
+			}
 			return nil
 		case <-s.ch:
+			if s.debounce <= 0 {
+				s.sync(ctx)
+				continue
+			}
+			now := time.Now()
+			if debounceC == nil {
+				deadline = now.Add(s.maxWait)
+			}
+			wait := s.debounce
+			if remaining := deadline.Sub(now); remaining < wait {
+				wait = remaining
+			}
+			if debounce == nil {
+				debounce = time.NewTimer(wait)
+			} else {
+				if !debounce.Stop() {
+					select {
+					case <-debounce.C:
+					default:
+					}
+				}
+				debounce.Reset(wait)
+			}
+			debounceC = debounce.C
+		case <-debounceC:
+			debounceC = nil
 			s.sync(ctx)
 		case <-ticker.C:
 			s.sync(ctx)
@@ -88,24 +250,134 @@ func (s *syncer) SetProxies(key string, configs map[string]Config) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.configsMap[key] = configs
+	s.configsMap[key] = s.validProxies(key, configs)
 
-	s.Sync()
+	s.requestSync()
 }
 
 func (s *syncer) DeleteProxies(key string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if _, ok := s.configsMap[key]; !ok {
+		return
+	}
+
 	delete(s.configsMap, key)
+	delete(s.failures, key)
+
+	s.requestSync()
+}
+
+func (s *syncer) SetCommon(key string, common map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.Sync()
+	if common == nil {
+		if _, ok := s.commons[key]; !ok {
+			return
+		}
+		delete(s.commons, key)
+	} else {
+		if s.commons == nil {
+			s.commons = make(map[string]map[string]string)
+		}
+		if reflect.DeepEqual(s.commons[key], common) {
+			return
+		}
+		s.commons[key] = common
+	}
+
+	s.requestSync()
+}
+
+// base returns the syncer, which the syncers of the other client kinds embed
+func (s *syncer) base() *syncer {
+	return s
+}
+
+// desired returns copies of the proxies and [common] keys set on the syncer, by owner key
+func (s *syncer) desired() (map[string]map[string]Config, map[string]map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configsMap := make(map[string]map[string]Config, len(s.configsMap))
+	for key, configs := range s.configsMap {
+		configsMap[key] = configs
+	}
+	commons := make(map[string]map[string]string, len(s.commons))
+	for key, common := range s.commons {
+		commons[key] = common
+	}
+	return configsMap, commons
+}
+
+// takeOver replaces the proxies and [common] keys with those of the syncer it replaces, except the [common] keys of
+// the pool, which belong to the pool config of each syncer
+func (s *syncer) takeOver(from *syncer) {
+	configsMap, commons := from.desired()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configsMap = configsMap
+	for key := range s.failures {
+		if _, ok := configsMap[key]; !ok {
+			delete(s.failures, key)
+		}
+	}
+	if pool, ok := s.commons[poolCommonKey]; ok {
+		commons[poolCommonKey] = pool
+	} else {
+		delete(commons, poolCommonKey)
+	}
+	s.commons = commons
+	s.requestSync()
+}
+
+// managedCommon merges the [common] keys of every owner, the owners are merged in order so that a key set twice
+// has a stable value
+func (s *syncer) managedCommon() map[string]string {
+	keys := make([]string, 0, len(s.commons))
+	for key := range s.commons {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	common := make(map[string]string)
+	for _, key := range keys {
+		for k, v := range s.commons[key] {
+			common[k] = v
+		}
+	}
+	return common
+}
+
+// mergeCommon returns the live [common] section with the managed keys, and whether it differs from the live one
+func mergeCommon(live MapConfig, managed map[string]string) (MapConfig, bool) {
+	changed := false
+	merged := make(MapConfig, len(live)+len(managed))
+	for k, v := range live {
+		merged[k] = v
+	}
+	for k, v := range managed {
+		if old, ok := merged[k]; !ok || old != v {
+			changed = true
+		}
+		merged[k] = v
+	}
+	return merged, changed
 }
 
 func (s *syncer) Sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestSync()
+}
+
+// requestSync requests a sync from Start, s.mu must be held
+func (s *syncer) requestSync() {
 	if s.ctx == nil {
 		return
 	}
+	syncRequests.Inc()
+	atomic.AddInt64(&s.requests, 1)
 	select {
 	case <-s.ctx.Done():
 		return
@@ -114,13 +386,124 @@ func (s *syncer) Sync() {
 	}
 }
 
+// sync applies the desired proxies to every client. Syncs are serialized by syncMu, s.mu is only held while the plans
+// are made and their results recorded, so that a slow client blocks neither SetProxies nor the status readers.
 func (s *syncer) sync(ctx context.Context) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	if s.configsMap == nil {
+		s.mu.Unlock()
+		return
+	}
+	if n := atomic.SwapInt64(&s.requests, 0); n > 1 {
+		coalescedUpdates.Add(float64(n - 1))
+	}
+	clients := make([]Client, len(s.clients))
+	copy(clients, s.clients)
+	desired := s.desiredProxies()
+	s.observeDesired(desired)
+	managed := s.managedCommon()
+	retired := make(map[int]Client, len(s.retired))
+	for slot, r := range s.retired {
+		retired[slot] = r.cli
+	}
+	s.mu.Unlock()
+
+	l := log.FromContext(ctx)
+	live := make(map[Client]*Configs, len(clients))
+	for _, cli := range clients {
+		configs, err := cli.GetConfigs(ctx)
+		if err != nil {
+			l.Error(err, "get config error", "client", cli.Addr())
+			syncFailures.WithLabelValues(cli.Addr().String()).Inc()
+			continue
+		}
+		live[cli] = configs
+	}
+	holding := make(map[int]bool, len(retired))
+	for slot, cli := range retired {
+		holding[slot] = s.holdsSlot(ctx, cli, slot)
+	}
+
+	s.mu.Lock()
+	s.assignSlots(live, holding)
+	plans := make([]*clientPlan, 0, len(clients))
+	for i, cli := range clients {
+		configs, ok := live[cli]
+		if !ok || !containsClient(s.clients, cli) {
+			continue
+		}
+		if n := legacyProxies(cli, configs.Proxy); n > 0 {
+			l.Info("rename the proxies prefixed with the client address", "client", cli.Addr(), "proxies", n)
+		}
+
+		drifted := s.detectDrift(ctx, cli, configs.Proxy)
+		p := s.plan(cli, configs, desired[i], managed)
+		if drifted && s.driftMode == constants.DriftModeReport {
+			l.Info("leave drifted proxies in place", "client", cli.Addr(), "mode", s.driftMode)
+			s.keepDrifted(p)
+		}
+		plans = append(plans, p)
+	}
+	if s.rollGroupKeys(plans, len(live) == len(clients)) {
+		l.Info("rolling the keys of load balancing groups")
+		s.requestSync()
+	}
+	s.mu.Unlock()
+
+	for _, p := range plans {
+		if p.changed {
+			l.Info("sync config", "client", p.cli.Addr())
+			s.applyPlan(ctx, p)
+		}
+	}
+
+	s.mu.Lock()
+	for _, p := range plans {
+		s.record(ctx, p)
+	}
+	var stop Client
+	if len(live) == len(clients) {
+		stop = s.pendingRestart()
+	}
+	s.mu.Unlock()
+	s.restart(ctx, stop)
+}
+
+// pendingRestart picks a client whose [common] section changed since it started, s.mu must be held
+func (s *syncer) pendingRestart() Client {
+	for _, cli := range s.clients {
+		if s.restarts[cli] {
+			delete(s.restarts, cli)
+			return cli
+		}
+	}
+	return nil
+}
+
+// restart stops a client whose [common] section changed, since frpc only reads it when it starts, and lets its
+// supervisor restart it. A single client is stopped by sync and only while every client is reachable, so that the
+// load balancing groups are served by the other clients meanwhile.
+func (s *syncer) restart(ctx context.Context, cli Client) {
+	if cli == nil {
+		return
+	}
+	l := log.FromContext(ctx)
+	start := time.Now()
+	err := cli.Stop(ctx)
+	observeRequest(cli, operationStop, start)
+	if err != nil {
+		l.Error(err, "stop frpc error, restart it to apply the [common] section", "client", cli.Addr())
 		return
 	}
+	l.Info("frpc stopped to apply the [common] section", "client", cli.Addr())
+}
 
+// desiredProxies places the proxies of configsMap on the clients, grouped proxies are pushed to every client and
+// the others to a single client chosen by the hash of their name. The result is indexed like s.clients.
+func (s *syncer) desiredProxies() []Proxy {
 	singletonProxies := make(map[string]Config)
 	groupProxies := make(map[string]Config)
 	for _, configs := range s.configsMap {
@@ -132,42 +515,320 @@ func (s *syncer) sync(ctx context.Context) {
 			}
 		}
 	}
-	l := log.FromContext(ctx)
 
-	for i, cli := range s.clients {
-		configs, err := cli.GetConfigs(ctx)
-		if err != nil {
-			l.Error(err, "get config error", "client", cli.Addr())
-			continue
-		}
-		newProxy := make(Proxy)
+	desired := make([]Proxy, len(s.clients))
+	for i := range s.clients {
+		desired[i] = make(Proxy)
 		for name, cfg := range groupProxies {
-			newProxy[fmt.Sprintf("%s/%s", cli.Addr(), name)] = cfg
+			desired[i][name] = cfg
 		}
-
 		for name, cfg := range singletonProxies {
 			if i == hashStr(name)%len(s.clients) {
-				newProxy[fmt.Sprintf("%s/%s", cli.Addr(), name)] = cfg
+				desired[i][name] = cfg
 			}
 		}
+	}
+	return desired
+}
+
+func (s *syncer) Status(ctx context.Context) map[string][]ProxyStatus {
+	s.mu.Lock()
+	clients := make([]Client, len(s.clients))
+	copy(clients, s.clients)
+	prefixes := s.proxyPrefixes(clients)
+	desired := s.desiredProxies()
+	owners := s.owners()
+	failures := make(map[string]map[string]string, len(s.failures))
+	for key, reasons := range s.failures {
+		failures[key] = make(map[string]string, len(reasons))
+		for addr, reason := range reasons {
+			failures[key][addr] = reason
+		}
+	}
+	s.mu.Unlock()
 
-		if newProxy.Equals(configs.Proxy) {
+	l := log.FromContext(ctx)
+	res := make(map[string][]ProxyStatus)
+	for i, cli := range clients {
+		live, liveErr := cli.Status(ctx)
+		if liveErr != nil {
+			l.Error(liveErr, "get status error", "client", cli.Addr())
+		}
+		liveMap := make(map[string]ProxyStatus, len(live))
+		for _, st := range live {
+			liveMap[st.Name] = st
+		}
+		foreach(desired[i], func(name string, cfg Config) bool {
+			st, ok := liveMap[prefixes[i]+name]
+			if !ok {
+				// not renamed yet
+				st, ok = liveMap[legacyProxyName(cli, name)]
+			}
+			if !ok {
+				st = ProxyStatus{Type: cfg.ToMap()["type"], Status: ProxyPhaseMissing}
+				if liveErr != nil {
+					st.Status = ProxyPhaseUnknown
+					st.Err = liveErr.Error()
+				}
+			}
+			st.Name = name
+			st.Client = cli.Addr().String()
+			if reason, ok := failures[owners[name]][st.Client]; ok {
+				st.Status = ProxyPhaseApplyFailed
+				st.Err = reason
+			}
+			res[owners[name]] = append(res[owners[name]], st)
+			return true
+		})
+	}
+	return res
+}
+
+// detectDrift compares the live proxies of the client with the proxies last applied to it, and reports
+// out-of-band edits once as audit log entries and metrics.
+func (s *syncer) detectDrift(ctx context.Context, cli Client, live Proxy) bool {
+	addr := cli.Addr().String()
+	applied, ok := s.applied[addr]
+	if !ok {
+		return false
+	}
+	drift := DetectDrift(applied, live)
+	if len(drift) == 0 {
+		delete(s.drifts, addr)
+		return false
+	}
+	if reflect.DeepEqual(drift, s.drifts[addr]) {
+		return true
+	}
+	s.drifts[addr] = drift
+
+	l := log.FromContext(ctx).WithValues("audit", "drift", "client", addr, "mode", s.driftMode)
+	for _, e := range drift {
+		l.Info("frp client config drifted", "proxy", e.Proxy, "key", e.Key, "change", e.Change, "applied", e.Applied, "live", e.Live)
+		driftKeys.WithLabelValues(addr, string(e.Change)).Inc()
+	}
+	return true
+}
+
+func containsClient(clients []Client, cli Client) bool {
+	for i := range clients {
+		if clients[i] == cli {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *syncer) Dump(ctx context.Context) *Dump {
+	s.mu.Lock()
+	clients := make([]Client, len(s.clients))
+	copy(clients, s.clients)
+	prefixes := s.proxyPrefixes(clients)
+	desired := s.desiredProxies()
+	dump := &Dump{
+		Keys:    make(map[string]map[string]map[string]string, len(s.configsMap)),
+		Clients: make([]ClientDump, 0, len(clients)),
+	}
+	for key, configs := range s.configsMap {
+		dump.Keys[key] = dumpProxy(configs)
+	}
+	s.mu.Unlock()
+
+	for i, cli := range clients {
+		newProxy := make(Proxy)
+		for name, cfg := range desired[i] {
+			newProxy[prefixes[i]+name] = cfg
+		}
+		cd := ClientDump{
+			Addr:    cli.Addr().String(),
+			Desired: dumpProxy(newProxy),
+		}
+		if configs, err := cli.GetConfigs(ctx); err != nil {
+			cd.Error = err.Error()
+		} else {
+			diff := DiffProxy(newProxy, configs.Proxy).Redacted()
+			cd.Common = RedactCommon(configs.Common)
+			cd.Live = dumpProxy(configs.Proxy)
+			cd.Diff = &diff
+		}
+		dump.Clients = append(dump.Clients, cd)
+	}
+	return dump
+}
+
+// validProxies drops the proxies which can not be written to the config of a client, such as values injecting
+// lines into the config, so that they do not fail the apply of the proxies of every other key
+func (s *syncer) validProxies(key string, configs map[string]Config) map[string]Config {
+	valid := make(map[string]Config, len(configs))
+	for name, cfg := range configs {
+		if err := ValidateProxy(name, cfg); err != nil {
+			log.FromContext(s.ctx).Error(err, "invalid proxy dropped", "pool", s.pool, "key", key, "proxy", name)
+			continue
+		}
+		valid[name] = cfg
+	}
+	return valid
+}
+
+// owners maps the proxy names to the key they were set with
+func (s *syncer) owners() map[string]string {
+	owners := make(map[string]string)
+	for key, configs := range s.configsMap {
+		for name := range configs {
+			owners[name] = key
+		}
+	}
+	return owners
+}
+
+// assignSlots numbers the clients whose config could be read. frps requires distinct names for the proxies of a load
+// balancing group, so the names pushed to a client are prefixed with the pool and the slot of the client rather than
+// its address, which changes when the frpc is rescheduled: a client keeps its slot while it is discovered, adopts the
+// slot found in its config after a restart of the controller, and a new client takes the lowest free slot, the one
+// of the frpc it replaces.
+func (s *syncer) assignSlots(live map[Client]*Configs, holding map[int]bool) {
+	if s.slots == nil {
+		s.slots = make(map[Client]int)
+	}
+	s.releaseSlots(holding)
+	used := s.usedSlots()
+	var free []Client
+	for _, cli := range s.clients {
+		configs, ok := live[cli]
+		if _, assigned := s.slots[cli]; assigned || !ok {
+			continue
+		}
+		// a client whose config names a retired slot is the client which held it, back in discovery
+		if slot, ok := s.liveSlot(configs.Proxy); ok && (!used[slot] || s.retired[slot] != nil) {
+			s.slots[cli] = slot
+			used[slot] = true
+			delete(s.retired, slot)
 			continue
 		}
-		l.Info("sync config", "client", cli.Addr())
+		free = append(free, cli)
+	}
+	for _, cli := range free {
+		s.slots[cli] = freeSlot(used)
+	}
+}
+
+// retiredSlot is the slot of a client gone from discovery
+type retiredSlot struct {
+	cli Client
+	// seen is when the client was last seen holding the slot
+	seen time.Time
+}
+
+// holdsSlot reports whether a client gone from discovery still answers with the proxies of the slot
+func (s *syncer) holdsSlot(ctx context.Context, cli Client, slot int) bool {
+	ctx, cancel := context.WithTimeout(ctx, constants.FrpVerifyTimeout)
+	defer cancel()
+	configs, err := cli.GetConfigs(ctx)
+	if err != nil {
+		return false
+	}
+	held, ok := s.liveSlot(configs.Proxy)
+	return ok && held == slot
+}
+
+// releaseSlots frees the retired slots whose client was not seen holding them for slotReuseDelay, by then frps
+// dropped the proxies of the client, s.mu must be held
+func (s *syncer) releaseSlots(holding map[int]bool) {
+	now := time.Now()
+	for slot, r := range s.retired {
+		switch {
+		case holding[slot]:
+			r.seen = now
+		case now.Sub(r.seen) >= s.slotReuseDelay:
+			delete(s.retired, slot)
+		}
+	}
+}
+
+// usedSlots returns the slots of the clients and the retired slots, s.mu must be held
+func (s *syncer) usedSlots() map[int]bool {
+	used := make(map[int]bool, len(s.slots)+len(s.retired))
+	for _, slot := range s.slots {
+		used[slot] = true
+	}
+	for slot := range s.retired {
+		used[slot] = true
+	}
+	return used
+}
 
-		configs.Proxy = newProxy
-		if err = cli.SetConfig(ctx, configs); err != nil {
-			l.Error(err, "set config error", "client", cli.Addr())
+// liveSlot returns the slot of the proxy names of the pool found in the config of a client
+func (s *syncer) liveSlot(proxy Proxy) (int, bool) {
+	prefix := s.poolName() + "."
+	for name := range proxy {
+		if !strings.HasPrefix(name, prefix) {
 			continue
 		}
+		digits, _, ok := strings.Cut(strings.TrimPrefix(name, prefix), "/")
+		if !ok {
+			continue
+		}
+		if slot, err := strconv.Atoi(digits); err == nil && slot >= 0 {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// proxyPrefix is the prefix of the proxy names in the config of the client, false until the client has a slot
+func (s *syncer) proxyPrefix(cli Client) (string, bool) {
+	slot, ok := s.slots[cli]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s.%d/", s.poolName(), slot), true
+}
 
-		if err := cli.Reload(ctx); err != nil {
-			l.Error(err, "reload config error", "client", cli.Addr())
+// proxyPrefixes returns the prefixes of the clients, the clients without a slot get the slot they would take
+func (s *syncer) proxyPrefixes(clients []Client) []string {
+	used := s.usedSlots()
+	prefixes := make([]string, len(clients))
+	for i, cli := range clients {
+		if prefix, ok := s.proxyPrefix(cli); ok {
+			prefixes[i] = prefix
 			continue
 		}
+		prefixes[i] = fmt.Sprintf("%s.%d/", s.poolName(), freeSlot(used))
+	}
+	return prefixes
+}
+
+// freeSlot marks the lowest free slot as used and returns it
+func freeSlot(used map[int]bool) int {
+	slot := 0
+	for used[slot] {
+		slot++
+	}
+	used[slot] = true
+	return slot
+}
 
+func (s *syncer) poolName() string {
+	if s.pool == "" {
+		return constants.IngressClassName
+	}
+	return s.pool
+}
+
+// legacyProxyName is the name of a proxy prefixed with the address of the client, as pushed by previous releases
+func legacyProxyName(cli Client, name string) string {
+	return fmt.Sprintf("%s/%s", cli.Addr(), name)
+}
+
+// legacyProxies counts the proxies of a client named by previous releases, the next apply renames them
+func legacyProxies(cli Client, proxy Proxy) int {
+	var n int
+	for name := range proxy {
+		if strings.HasPrefix(name, legacyProxyName(cli, "")) {
+			n++
+		}
 	}
+	return n
 }
 
 func hashStr(str string) int {
@@ -0,0 +1,101 @@
+package frp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// TLSConfig connects to the frpc admin api with https. The files are read again when they change, so that a rotated
+// CA or client certificate is used without a restart.
+type TLSConfig struct {
+	// CAFile pins the CAs the admin api certificate must be issued by, the system CAs are trusted if empty
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the client certificate presented to the admin api
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ServerName is the name verified in the admin api certificate, the pool address if empty.
+	// The frp clients are reached by ip, so the certificate is not verified against their addresses.
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// Build creates the tls config of the admin api clients, serverName is used when ServerName is empty
+func (c *TLSConfig) Build(serverName string) (*tls.Config, error) {
+	if c.ServerName != "" {
+		serverName = c.ServerName
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("tls certFile and keyFile must be set together")
+		}
+		certFile, keyFile := NewFile(c.CertFile), NewFile(c.KeyFile)
+		getCertificate := func() (*tls.Certificate, error) {
+			certPEM, err := certFile.Read()
+			if err != nil {
+				return nil, err
+			}
+			keyPEM, err := keyFile.Read()
+			if err != nil {
+				return nil, err
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("load client certificate %s: %w", c.CertFile, err)
+			}
+			return &cert, nil
+		}
+		if _, err := getCertificate(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return getCertificate()
+		}
+	}
+
+	if c.CAFile != "" {
+		caFile := NewFile(c.CAFile)
+		roots := func() (*x509.CertPool, error) {
+			caPEM, err := caFile.Read()
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no CA certificate found in %s", c.CAFile)
+			}
+			return pool, nil
+		}
+		if _, err := roots(); err != nil {
+			return nil, err
+		}
+		// the certificate is verified by VerifyConnection against the CAs currently in the file,
+		// RootCAs would pin the CAs read at startup
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("no certificate presented by the frpc admin api")
+			}
+			pool, err := roots()
+			if err != nil {
+				return err
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: intermediates,
+				DNSName:       serverName,
+			})
+			return err
+		}
+	}
+	return cfg, nil
+}
@@ -27,6 +27,7 @@ func NewDomainWatcher(addr string) *DomainWatcher {
 func (w *DomainWatcher) Start(ctx context.Context) {
 	w.syncClients(ctx)
 	ticker := time.NewTicker(constants.DomainSyncInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():